@@ -0,0 +1,513 @@
+package cmd
+
+// =====================================
+// Archive
+//
+// 1. create zip or tar archive, optionally compressed and encrypted by aes
+// 2. extract archive
+// 3. list entries in archive and verify its integrity
+// =====================================
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	archiveFormatZip = "zip"
+	archiveFormatTar = "tar"
+	// archiveMagicPeekLen enough for magic bytes of all compressors
+	archiveMagicPeekLen = 10
+)
+
+var zipMagic = []byte("PK\x03\x04")
+
+// archiveCompressExts compressor name of tar by file extension
+var archiveCompressExts = map[string]gutils.CompressFormat{
+	".tgz": gutils.CompressFormatGzip,
+	".gz":  gutils.CompressFormatGzip,
+	".zst": gutils.CompressFormatZstd,
+	".lz4": gutils.CompressFormatLZ4,
+	".s2":  gutils.CompressFormatS2,
+	".sz":  gutils.CompressFormatSnappy,
+}
+
+// ArchiveCMD archive tools
+var ArchiveCMD = &cobra.Command{
+	Use:   "archive",
+	Short: "archive tools",
+	Long:  `create, extract and list zip or tar archive`,
+	Args:  NoExtraArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+	},
+}
+
+// ArchiveCreateCMD create archive
+//
+//   `go run cmd/main/main.go archive create -i cmd -o cmd.tar.gz --exclude '*.tmp'`
+var ArchiveCreateCMD = &cobra.Command{
+	Use:   "create",
+	Short: "create archive",
+	Long:  `create zip or tar archive of files, optionally compressed and encrypted by aes`,
+	Args:  NoExtraArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupArchiveCreateArgs(cmd)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := createArchive(); err != nil {
+			gutils.Logger.Error("create archive", zap.Error(err))
+			os.Exit(1)
+		}
+	},
+}
+
+// ArchiveExtractCMD extract archive
+//
+//   `go run cmd/main/main.go archive extract -i cmd.tar.gz -o /tmp/cmd`
+var ArchiveExtractCMD = &cobra.Command{
+	Use:   "extract",
+	Short: "extract archive",
+	Long: `extract zip or tar archive, format and compression are detected automatically.
+
+symlinks in archive are skipped unless --keep-symlink is set.`,
+	Args: NoExtraArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupArchiveExtractArgs(cmd)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := extractArchive(); err != nil {
+			gutils.Logger.Error("extract archive", zap.Error(err))
+			os.Exit(1)
+		}
+	},
+}
+
+// ArchiveListCMD list entries in archive
+//
+//   `go run cmd/main/main.go archive list -i cmd.tar.gz --verify`
+var ArchiveListCMD = &cobra.Command{
+	Use:   "list",
+	Short: "list entries in archive",
+	Long:  `list entries in zip or tar archive, optionally verify integrity by reading all entries`,
+	Args:  NoExtraArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupArchiveListArgs(cmd)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := listArchive(); err != nil {
+			gutils.Logger.Error("list archive", zap.Error(err))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(ArchiveCMD)
+
+	ArchiveCMD.AddCommand(ArchiveCreateCMD)
+	ArchiveCreateCMD.Flags().StringSliceP("inputfile", "i", nil, "files or directories tobe archived")
+	ArchiveCreateCMD.Flags().StringP("outputfile", "o", "", "file path to output archive")
+	ArchiveCreateCMD.Flags().String("format", "", "\"zip\" or \"tar\", default to detect by extension of outputfile")
+	ArchiveCreateCMD.Flags().String("compress", "", "compressor of tar, like \"gzip\" or \"zstd\", default to detect by extension of outputfile")
+	ArchiveCreateCMD.Flags().StringSlice("exclude", nil, "do not add files that match patterns, like \".git\" or \"*.tmp\"")
+	ArchiveCreateCMD.Flags().StringP("secret", "s", "", "secret to encrypt archive by aes")
+	ArchiveCreateCMD.Flags().Bool("verify", false, "verify archive after created")
+
+	ArchiveCMD.AddCommand(ArchiveExtractCMD)
+	ArchiveExtractCMD.Flags().StringP("inputfile", "i", "", "file path of archive")
+	ArchiveExtractCMD.Flags().StringP("outputdir", "o", "", "directory to extract into, default to current directory")
+	ArchiveExtractCMD.Flags().StringP("secret", "s", "", "secret to decrypt archive by aes")
+	ArchiveExtractCMD.Flags().Bool("keep-symlink", false, "extract symlinks that point inside outputdir, default to skip all symlinks")
+
+	ArchiveCMD.AddCommand(ArchiveListCMD)
+	ArchiveListCMD.Flags().StringP("inputfile", "i", "", "file path of archive")
+	ArchiveListCMD.Flags().StringP("secret", "s", "", "secret to decrypt archive by aes")
+	ArchiveListCMD.Flags().Bool("verify", false, "verify integrity of archive by reading all entries")
+}
+
+func setupArchiveCreateArgs(cmd *cobra.Command) (err error) {
+	if err = gutils.Settings.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+
+	if len(gutils.Settings.GetStringSlice("inputfile")) == 0 {
+		return errors.Errorf("inputfile cannot be empty")
+	}
+	out := gutils.Settings.GetString("outputfile")
+	if out == "" {
+		return errors.Errorf("outputfile cannot be empty")
+	}
+
+	format := gutils.Settings.GetString("format")
+	if format == "" {
+		format = archiveFormatTar
+		if strings.EqualFold(filepath.Ext(out), ".zip") {
+			format = archiveFormatZip
+		}
+
+		gutils.Settings.Set("format", format)
+	}
+
+	compress := gutils.Settings.GetString("compress")
+	switch format {
+	case archiveFormatZip:
+		if compress != "" {
+			return errors.Errorf("compress is not supported by zip")
+		}
+	case archiveFormatTar:
+		if compress == "" {
+			compress = string(archiveCompressExts[strings.ToLower(filepath.Ext(out))])
+			gutils.Settings.Set("compress", compress)
+		}
+		// tar will be decompressed by magic bytes when extracting
+		if gutils.CompressFormat(compress) == gutils.CompressFormatBrotli {
+			return errors.Errorf("brotli cannot be detected when extracting, use other compressor")
+		}
+	default:
+		return errors.Errorf("unknown format `%s`", format)
+	}
+
+	return nil
+}
+
+func setupArchiveExtractArgs(cmd *cobra.Command) (err error) {
+	if err = gutils.Settings.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+
+	if gutils.Settings.GetString("inputfile") == "" {
+		return errors.Errorf("inputfile cannot be empty")
+	}
+	if gutils.Settings.GetString("outputdir") == "" {
+		gutils.Settings.Set("outputdir", ".")
+	}
+
+	return nil
+}
+
+func setupArchiveListArgs(cmd *cobra.Command) (err error) {
+	if err = gutils.Settings.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+
+	if gutils.Settings.GetString("inputfile") == "" {
+		return errors.Errorf("inputfile cannot be empty")
+	}
+
+	return nil
+}
+
+// archiveReader content of archive file
+type archiveReader interface {
+	io.Reader
+	io.ReaderAt
+}
+
+// openArchive open archive file, decrypt by secret if not empty,
+// return reader and size of archive
+func openArchive(fpath string, secret []byte) (r archiveReader, size int64, closer func(), err error) {
+	if len(secret) == 0 {
+		fp, err := os.Open(fpath)
+		if err != nil {
+			return nil, 0, nil, errors.Wrapf(err, "open file `%s`", fpath)
+		}
+
+		finfo, err := fp.Stat()
+		if err != nil {
+			gutils.CloseQuietly(fp)
+			return nil, 0, nil, errors.Wrapf(err, "get stat of `%s`", fpath)
+		}
+
+		return fp, finfo.Size(), func() { gutils.CloseQuietly(fp) }, nil
+	}
+
+	// zip requires random access, so decrypt into temp file by stream
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return nil, 0, nil, errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer gutils.CloseQuietly(fp)
+
+	decrypter, err := gutils.NewAesStreamReader(bufio.NewReader(fp), secret)
+	if err != nil {
+		return nil, 0, nil, errors.Wrap(err, "new aes reader")
+	}
+
+	tmp, err := ioutil.TempFile("", "go-utils-archive-")
+	if err != nil {
+		return nil, 0, nil, errors.Wrap(err, "create temp file")
+	}
+	closer = func() {
+		gutils.CloseQuietly(tmp)
+		if err := os.Remove(tmp.Name()); err != nil {
+			gutils.Logger.Warn("remove temp file", zap.String("file", tmp.Name()), zap.Error(err))
+		}
+	}
+
+	if size, err = io.Copy(tmp, decrypter); err != nil {
+		closer()
+		return nil, 0, nil, errors.Wrap(err, "decrypt archive")
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		closer()
+		return nil, 0, nil, errors.Wrap(err, "seek temp file")
+	}
+
+	return tmp, size, closer, nil
+}
+
+// isZipArchive check archive format by magic bytes
+func isZipArchive(r io.ReaderAt) (bool, error) {
+	header := make([]byte, len(zipMagic))
+	if _, err := r.ReadAt(header, 0); err != nil && err != io.EOF {
+		return false, errors.Wrap(err, "read header")
+	}
+
+	return bytes.Equal(header, zipMagic), nil
+}
+
+func createArchive() (err error) {
+	files := gutils.Settings.GetStringSlice("inputfile")
+	out := gutils.Settings.GetString("outputfile")
+	format := gutils.Settings.GetString("format")
+	secret := []byte(gutils.Settings.GetString("secret"))
+	excludes := gutils.Settings.GetStringSlice("exclude")
+	logger := gutils.Logger.With(
+		zap.Strings("in", files),
+		zap.String("out", out),
+		zap.String("format", format),
+	)
+	logger.Info("create archive")
+
+	perm := os.FileMode(0666)
+	if len(secret) != 0 {
+		perm = 0600
+	}
+	fp, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return errors.Wrapf(err, "create file `%s`", out)
+	}
+	defer gutils.CloseQuietly(fp)
+
+	bufWriter := bufio.NewWriter(fp)
+	var writer io.Writer = bufWriter
+	var encrypter *gutils.AesStreamWriter
+	if len(secret) != 0 {
+		if encrypter, err = gutils.NewAesStreamWriter(bufWriter, secret); err != nil {
+			return errors.Wrap(err, "new aes writer")
+		}
+
+		writer = encrypter
+	}
+
+	switch format {
+	case archiveFormatZip:
+		err = gutils.WriteZip(writer, files, gutils.WithZipExclude(excludes...))
+	case archiveFormatTar:
+		err = gutils.WriteTar(writer, files,
+			gutils.WithTarCompress(gutils.CompressFormat(gutils.Settings.GetString("compress"))),
+			gutils.WithTarExclude(excludes...),
+		)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "write %s", format)
+	}
+
+	if encrypter != nil {
+		if err = encrypter.Close(); err != nil {
+			return errors.Wrap(err, "encrypt archive")
+		}
+	}
+	if err = bufWriter.Flush(); err != nil {
+		return errors.Wrapf(err, "write file `%s`", out)
+	}
+	if err = fp.Close(); err != nil {
+		return errors.Wrapf(err, "close file `%s`", out)
+	}
+
+	if gutils.Settings.GetBool("verify") {
+		if _, err = walkArchive(out, secret, true, nil); err != nil {
+			return errors.Wrap(err, "verify archive")
+		}
+	}
+
+	logger.Info("successed")
+	return nil
+}
+
+func extractArchive() error {
+	in := gutils.Settings.GetString("inputfile")
+	out := gutils.Settings.GetString("outputdir")
+	logger := gutils.Logger.With(
+		zap.String("in", in),
+		zap.String("out", out),
+	)
+	logger.Info("extract archive")
+
+	r, size, closer, err := openArchive(in, []byte(gutils.Settings.GetString("secret")))
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	isZip, err := isZipArchive(r)
+	if err != nil {
+		return err
+	}
+
+	symlink := gutils.UnzipSymlinkSkip
+	if gutils.Settings.GetBool("keep-symlink") {
+		symlink = gutils.UnzipSymlinkInDir
+	}
+
+	var filenames []string
+	if isZip {
+		result, err := gutils.ExtractZip(r, size, out, gutils.WithUnzipSymlinkPolicy(symlink))
+		if err != nil {
+			return errors.Wrap(err, "extract zip")
+		}
+
+		filenames = result.Files
+	} else {
+		if filenames, err = gutils.ExtractTar(r, out, gutils.WithTarSymlinkPolicy(symlink)); err != nil {
+			return errors.Wrap(err, "extract tar")
+		}
+	}
+
+	logger.Info("successed", zap.Int("n", len(filenames)))
+	return nil
+}
+
+func listArchive() error {
+	in := gutils.Settings.GetString("inputfile")
+	verify := gutils.Settings.GetBool("verify")
+	n, err := walkArchive(in, []byte(gutils.Settings.GetString("secret")), verify,
+		func(mode os.FileMode, size int64, name string) {
+			fmt.Printf("%s\t%d\t%s\n", mode, size, name)
+		})
+	if err != nil {
+		return err
+	}
+
+	if verify {
+		fmt.Printf("verified %d entries\n", n)
+	}
+
+	return nil
+}
+
+// walkArchive iterate all entries in archive,
+// content of entries will be read and checked if verify is true.
+//
+// zip is checked by crc32 of each entry,
+// tar is checked by structure and checksum of compressor (if any).
+func walkArchive(fpath string, secret []byte, verify bool, fn func(mode os.FileMode, size int64, name string)) (n int, err error) {
+	r, size, closer, err := openArchive(fpath, secret)
+	if err != nil {
+		return 0, err
+	}
+	defer closer()
+
+	isZip, err := isZipArchive(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if isZip {
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return 0, errors.Wrap(err, "open zip")
+		}
+
+		for _, f := range zr.File {
+			if fn != nil {
+				fn(f.Mode(), int64(f.UncompressedSize64), f.Name)
+			}
+			if verify {
+				if err = verifyZipEntry(f); err != nil {
+					return n, err
+				}
+			}
+
+			n++
+		}
+
+		return n, nil
+	}
+
+	buf := bufio.NewReader(r)
+	header, err := buf.Peek(archiveMagicPeekLen)
+	if err != nil && err != io.EOF {
+		return 0, errors.Wrap(err, "read header")
+	}
+
+	var reader io.Reader = buf
+	if format := gutils.DetectCompressFormat(header); format != gutils.CompressFormatUnknown {
+		d, err := gutils.NewDecompressorByFormat(format, buf)
+		if err != nil {
+			return 0, errors.Wrap(err, "new decompressor")
+		}
+		defer gutils.CloseQuietly(d)
+
+		reader = d
+	}
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, errors.Wrap(err, "read tar")
+		}
+
+		if fn != nil {
+			fn(hdr.FileInfo().Mode(), hdr.Size, hdr.Name)
+		}
+		if verify {
+			if _, err = io.Copy(ioutil.Discard, tr); err != nil {
+				return n, errors.Wrapf(err, "read entry `%s`", hdr.Name)
+			}
+		}
+
+		n++
+	}
+
+	if verify {
+		// read till the end to check the footer of compressor
+		if _, err = io.Copy(ioutil.Discard, reader); err != nil {
+			return n, errors.Wrap(err, "read archive")
+		}
+	}
+
+	return n, nil
+}
+
+// verifyZipEntry read entry to check its crc32
+func verifyZipEntry(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return errors.Wrapf(err, "open entry `%s`", f.Name)
+	}
+	defer gutils.CloseQuietly(rc)
+
+	if _, err = io.Copy(ioutil.Discard, rc); err != nil {
+		return errors.Wrapf(err, "read entry `%s`", f.Name)
+	}
+
+	return nil
+}
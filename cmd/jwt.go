@@ -0,0 +1,297 @@
+package cmd
+
+// =====================================
+// JWT
+//
+// 1. decode & verify jwt token
+// 2. sign jwt token
+// =====================================
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// JWTCMD jwt tools
+var JWTCMD = &cobra.Command{
+	Use:   "jwt",
+	Short: "jwt tools",
+	Long:  `decode, verify and sign jwt token`,
+	Args:  NoExtraArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+	},
+}
+
+// JWTDecodeCMD decode jwt token
+//
+//   `go run cmd/main/main.go jwt decode -t <token> --alg HS256 --secret 123`
+var JWTDecodeCMD = &cobra.Command{
+	Use:   "decode",
+	Short: "decode jwt token",
+	Long:  `pretty-print header and claims of jwt token, optionally verify with key or secret`,
+	Args:  NoExtraArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupJWTDecodeArgs(cmd)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := decodeJWT(); err != nil {
+			gutils.Logger.Error("decode jwt", zap.Error(err))
+			os.Exit(1)
+		}
+	},
+}
+
+// JWTSignCMD sign jwt token
+//
+//   `go run cmd/main/main.go jwt sign --alg ES256 -k key.pem --sub laisky --exp 1h`
+var JWTSignCMD = &cobra.Command{
+	Use:   "sign",
+	Short: "sign jwt token",
+	Long:  `sign jwt token, claims from json and flags, key from PEM file or secret`,
+	Args:  NoExtraArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupJWTSignArgs(cmd)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := signJWT(); err != nil {
+			gutils.Logger.Error("sign jwt", zap.Error(err))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(JWTCMD)
+
+	JWTCMD.AddCommand(JWTDecodeCMD)
+	JWTDecodeCMD.Flags().StringP("token", "t", "", "jwt token, read from stdin if \"-\"")
+	JWTDecodeCMD.Flags().StringP("key", "k", "", "file path of public key in PEM to verify token")
+	JWTDecodeCMD.Flags().StringP("secret", "s", "", "secret to verify token")
+	JWTDecodeCMD.Flags().String("alg", "", "expected signing method, required to verify token")
+
+	JWTCMD.AddCommand(JWTSignCMD)
+	JWTSignCMD.Flags().String("alg", gutils.SignMethodHS256.Alg(), "signing method, like HS256, RS256, ES256, EdDSA")
+	JWTSignCMD.Flags().StringP("key", "k", "", "file path of private key in PEM")
+	JWTSignCMD.Flags().StringP("secret", "s", "", "secret for HMAC")
+	JWTSignCMD.Flags().String("kid", "", "key id in header")
+	JWTSignCMD.Flags().StringP("claims", "c", "", "claims in json, or \"@file\" to read from file")
+	JWTSignCMD.Flags().String("sub", "", "subject")
+	JWTSignCMD.Flags().String("iss", "", "issuer")
+	JWTSignCMD.Flags().StringSlice("aud", nil, "audiences")
+	JWTSignCMD.Flags().Duration("exp", 0, "token lifetime, like \"1h\", never expire if 0")
+}
+
+func setupJWTDecodeArgs(cmd *cobra.Command) (err error) {
+	if err = gutils.Settings.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+
+	if gutils.Settings.GetString("token") == "" {
+		return errors.Errorf("token cannot be empty")
+	}
+
+	// do not trust alg in token header
+	if gutils.Settings.GetString("key") != "" ||
+		gutils.Settings.GetString("secret") != "" {
+		alg := gutils.Settings.GetString("alg")
+		if alg == "" {
+			return errors.Errorf("alg is required to verify token")
+		}
+		if jwt.GetSigningMethod(alg) == nil {
+			return errors.Errorf("unknown alg `%s`", alg)
+		}
+	}
+
+	return nil
+}
+
+func setupJWTSignArgs(cmd *cobra.Command) (err error) {
+	if err = gutils.Settings.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+
+	if jwt.GetSigningMethod(gutils.Settings.GetString("alg")) == nil {
+		return errors.Errorf("unknown alg `%s`", gutils.Settings.GetString("alg"))
+	}
+	if gutils.Settings.GetString("key") == "" &&
+		gutils.Settings.GetString("secret") == "" {
+		return errors.Errorf("key & secret cannot both be empty")
+	}
+
+	return nil
+}
+
+func printJSON(title string, v interface{}) error {
+	cnt, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "marshal %s", title)
+	}
+
+	fmt.Printf("%s:\n%s\n", title, string(cnt))
+	return nil
+}
+
+// describeJWTTime describe NumericDate claim relative to now
+func describeJWTTime(claims jwt.MapClaims, name string) (string, bool) {
+	num, ok := claims[name].(json.Number)
+	if !ok {
+		return "", false
+	}
+
+	ts, err := num.Int64()
+	if err != nil {
+		return "", false
+	}
+
+	t := gutils.ParseUnix2UTC(ts)
+	d := t.Sub(gutils.Clock.GetUTCNow()).Round(time.Second)
+	if d >= 0 {
+		return fmt.Sprintf("%s (in %s)", t.Format(time.RFC3339), d), true
+	}
+
+	return fmt.Sprintf("%s (%s ago)", t.Format(time.RFC3339), -d), true
+}
+
+func decodeJWT() (err error) {
+	tokenStr := gutils.Settings.GetString("token")
+	if tokenStr == "-" {
+		cnt, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return errors.Wrap(err, "read token from stdin")
+		}
+
+		tokenStr = string(cnt)
+	}
+	tokenStr = strings.TrimSpace(tokenStr)
+
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{UseJSONNumber: true}
+	token, _, err := parser.ParseUnverified(tokenStr, claims)
+	if err != nil {
+		return errors.Wrap(err, "parse token")
+	}
+
+	if err = printJSON("header", token.Header); err != nil {
+		return err
+	}
+	if err = printJSON("claims", claims); err != nil {
+		return err
+	}
+	for _, name := range []string{"iat", "nbf", "exp"} {
+		if desc, ok := describeJWTTime(claims, name); ok {
+			fmt.Printf("%s: %s\n", name, desc)
+		}
+	}
+
+	keyFile := gutils.Settings.GetString("key")
+	secret := gutils.Settings.GetString("secret")
+	if keyFile == "" && secret == "" {
+		fmt.Println("signature: not verified")
+		return nil
+	}
+
+	method := jwt.GetSigningMethod(gutils.Settings.GetString("alg"))
+	opts := []gutils.JWTOptFunc{gutils.WithJWTSignMethod(method)}
+	if secret != "" {
+		opts = append(opts, gutils.WithJWTSecretByte([]byte(secret)))
+	}
+	if keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return errors.Wrapf(err, "read file `%s`", keyFile)
+		}
+
+		opts = append(opts, gutils.WithJWTPubKeyByte(key))
+	}
+
+	j, err := gutils.NewJWT(opts...)
+	if err != nil {
+		return errors.Wrap(err, "new jwt")
+	}
+
+	if err = j.VerifySignature(tokenStr); err != nil {
+		fmt.Println("signature: invalid")
+		return errors.Wrap(err, "verify signature")
+	}
+	fmt.Println("signature: valid")
+
+	if err = j.ParseClaims(tokenStr, &jwt.MapClaims{}); err != nil {
+		fmt.Println("claims: invalid")
+		return errors.Wrap(err, "validate claims")
+	}
+	fmt.Println("claims: valid")
+
+	return nil
+}
+
+func signJWT() (err error) {
+	claims := jwt.MapClaims{}
+	if raw := gutils.Settings.GetString("claims"); raw != "" {
+		cnt := []byte(raw)
+		if strings.HasPrefix(raw, "@") {
+			if cnt, err = ioutil.ReadFile(raw[1:]); err != nil {
+				return errors.Wrapf(err, "read file `%s`", raw[1:])
+			}
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(string(cnt)))
+		decoder.UseNumber()
+		if err = decoder.Decode(&claims); err != nil {
+			return errors.Wrap(err, "unmarshal claims")
+		}
+	}
+
+	now := gutils.Clock.GetUTCNow()
+	claims["iat"] = now.Unix()
+	if v := gutils.Settings.GetString("sub"); v != "" {
+		claims["sub"] = v
+	}
+	if v := gutils.Settings.GetString("iss"); v != "" {
+		claims["iss"] = v
+	}
+	if v := gutils.Settings.GetStringSlice("aud"); len(v) != 0 {
+		claims["aud"] = v
+	}
+	if v := gutils.Settings.GetDuration("exp"); v > 0 {
+		claims["exp"] = now.Add(v).Unix()
+	}
+
+	opts := []gutils.JWTOptFunc{
+		gutils.WithJWTSignMethod(jwt.GetSigningMethod(gutils.Settings.GetString("alg"))),
+		gutils.WithJWTKeyID(gutils.Settings.GetString("kid")),
+	}
+	if v := gutils.Settings.GetString("secret"); v != "" {
+		opts = append(opts, gutils.WithJWTSecretByte([]byte(v)))
+	}
+	if keyFile := gutils.Settings.GetString("key"); keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return errors.Wrapf(err, "read file `%s`", keyFile)
+		}
+
+		opts = append(opts, gutils.WithJWTPriKeyByte(key))
+	}
+
+	j, err := gutils.NewJWT(opts...)
+	if err != nil {
+		return errors.Wrap(err, "new jwt")
+	}
+
+	token, err := j.Sign(claims)
+	if err != nil {
+		return errors.Wrap(err, "sign")
+	}
+
+	fmt.Println(token)
+	return nil
+}
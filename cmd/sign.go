@@ -0,0 +1,295 @@
+package cmd
+
+// =====================================
+// Sign & Verify File
+//
+// 1. sign file by ecdsa private key, output detached signature file
+// 2. verify file by ecdsa public key and detached signature file
+// =====================================
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+
+	gutils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	signAlgorithmES256 = "ES256"
+	signFileExt        = ".sig"
+)
+
+// detachedSignature content of detached signature file
+type detachedSignature struct {
+	// Algorithm signature algorithm, only support `ES256` now
+	Algorithm string `json:"algorithm"`
+	// KeyFingerprint sha256 of public key in PKIX DER, like `sha256:xxxx`
+	KeyFingerprint string `json:"key_fingerprint"`
+	// Signature encoded by `EncodeES256SignByBase64`
+	Signature string `json:"signature"`
+}
+
+// SignCMD sign file
+//
+//   `go run cmd/main/main.go sign -i cmd/root.go -k key.pem`
+var SignCMD = &cobra.Command{
+	Use:   "sign",
+	Short: "sign file by ecdsa private key",
+	Long:  `sign file by ecdsa private key, output detached signature file`,
+	Args:  NoExtraArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupSignArgs(cmd)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := signFile(); err != nil {
+			gutils.Logger.Error("sign file", zap.Error(err))
+			os.Exit(1)
+		}
+	},
+}
+
+// VerifyCMD verify file by detached signature
+//
+//   `go run cmd/main/main.go verify -i cmd/root.go -k pubkey.pem`
+var VerifyCMD = &cobra.Command{
+	Use:   "verify",
+	Short: "verify file by ecdsa public key",
+	Long:  `verify file by ecdsa public key and detached signature file`,
+	Args:  NoExtraArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupVerifyArgs(cmd)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := verifyFile(); err != nil {
+			gutils.Logger.Error("verify file", zap.Error(err))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(SignCMD)
+	SignCMD.Flags().StringP("inputfile", "i", "", "file path tobe signed")
+	SignCMD.Flags().StringP("prikey", "k", "", "file path of ecdsa private key in PEM")
+	SignCMD.Flags().StringP("sigfile", "s", "", "file path to output signature, default to \"<inputfile>.sig\"")
+
+	rootCmd.AddCommand(VerifyCMD)
+	VerifyCMD.Flags().StringP("inputfile", "i", "", "file path tobe verified")
+	VerifyCMD.Flags().StringP("pubkey", "k", "", "file path of ecdsa public key in PEM")
+	VerifyCMD.Flags().StringP("sigfile", "s", "", "file path of signature, default to \"<inputfile>.sig\"")
+}
+
+func setupSignArgs(cmd *cobra.Command) (err error) {
+	if err = gutils.Settings.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+
+	if gutils.Settings.GetString("inputfile") == "" {
+		return errors.Errorf("inputfile cannot be empty")
+	}
+	if gutils.Settings.GetString("prikey") == "" {
+		return errors.Errorf("prikey cannot be empty")
+	}
+	if gutils.Settings.GetString("sigfile") == "" {
+		gutils.Settings.Set("sigfile", gutils.Settings.GetString("inputfile")+signFileExt)
+	}
+
+	return nil
+}
+
+func setupVerifyArgs(cmd *cobra.Command) (err error) {
+	if err = gutils.Settings.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+
+	if gutils.Settings.GetString("inputfile") == "" {
+		return errors.Errorf("inputfile cannot be empty")
+	}
+	if gutils.Settings.GetString("pubkey") == "" {
+		return errors.Errorf("pubkey cannot be empty")
+	}
+	if gutils.Settings.GetString("sigfile") == "" {
+		gutils.Settings.Set("sigfile", gutils.Settings.GetString("inputfile")+signFileExt)
+	}
+
+	return nil
+}
+
+// loadECDSAPrivateKey load ecdsa private key from PEM file,
+// support both SEC1 (`EncodeECDSAPrivateKey`) and PKCS8 (`gentls`)
+func loadECDSAPrivateKey(fpath string) (*ecdsa.PrivateKey, error) {
+	cnt, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file `%s`", fpath)
+	}
+
+	block, _ := pem.Decode(cnt)
+	if block == nil {
+		return nil, errors.Errorf("`%s` is not PEM", fpath)
+	}
+
+	if priKey, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return priKey, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse private key")
+	}
+
+	priKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("`%s` is not ecdsa private key", fpath)
+	}
+
+	return priKey, nil
+}
+
+func loadECDSAPublicKey(fpath string) (*ecdsa.PublicKey, error) {
+	cnt, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file `%s`", fpath)
+	}
+
+	block, _ := pem.Decode(cnt)
+	if block == nil {
+		return nil, errors.Errorf("`%s` is not PEM", fpath)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse public key")
+	}
+
+	pubKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("`%s` is not ecdsa public key", fpath)
+	}
+
+	return pubKey, nil
+}
+
+// ecdsaKeyFingerprint calculate sha256 of public key in PKIX DER
+func ecdsaKeyFingerprint(pubKey *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal public key")
+	}
+
+	hashed := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(hashed[:]), nil
+}
+
+func signFile() error {
+	in := gutils.Settings.GetString("inputfile")
+	out := gutils.Settings.GetString("sigfile")
+	logger := gutils.Logger.With(
+		zap.String("in", in),
+		zap.String("out", out),
+	)
+	logger.Info("sign file")
+
+	priKey, err := loadECDSAPrivateKey(gutils.Settings.GetString("prikey"))
+	if err != nil {
+		return errors.Wrap(err, "load private key")
+	}
+
+	fp, err := os.Open(in)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", in)
+	}
+	defer gutils.CloseQuietly(fp)
+
+	r, s, err := gutils.SignReaderByECDSAWithSHA256(priKey, fp)
+	if err != nil {
+		return errors.Wrap(err, "sign")
+	}
+
+	sig := &detachedSignature{
+		Algorithm: signAlgorithmES256,
+		Signature: gutils.EncodeES256SignByBase64(r, s),
+	}
+	if sig.KeyFingerprint, err = ecdsaKeyFingerprint(&priKey.PublicKey); err != nil {
+		return err
+	}
+
+	cnt, err := gutils.JSON.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal signature")
+	}
+
+	if err = ioutil.WriteFile(out, cnt, 0644); err != nil {
+		return errors.Wrapf(err, "write file `%s`", out)
+	}
+
+	logger.Info("successed", zap.String("fingerprint", sig.KeyFingerprint))
+	return nil
+}
+
+func verifyFile() error {
+	in := gutils.Settings.GetString("inputfile")
+	sigfile := gutils.Settings.GetString("sigfile")
+	logger := gutils.Logger.With(
+		zap.String("in", in),
+		zap.String("sigfile", sigfile),
+	)
+	logger.Info("verify file")
+
+	pubKey, err := loadECDSAPublicKey(gutils.Settings.GetString("pubkey"))
+	if err != nil {
+		return errors.Wrap(err, "load public key")
+	}
+
+	cnt, err := ioutil.ReadFile(sigfile)
+	if err != nil {
+		return errors.Wrapf(err, "read file `%s`", sigfile)
+	}
+
+	sig := new(detachedSignature)
+	if err = gutils.JSON.Unmarshal(cnt, sig); err != nil {
+		return errors.Wrapf(err, "unmarshal signature `%s`", sigfile)
+	}
+
+	if sig.Algorithm != signAlgorithmES256 {
+		return errors.Errorf("unsupported algorithm `%s`", sig.Algorithm)
+	}
+
+	fingerprint, err := ecdsaKeyFingerprint(pubKey)
+	if err != nil {
+		return err
+	}
+	if sig.KeyFingerprint != fingerprint {
+		return errors.Errorf("key fingerprint `%s` not match signature's `%s`",
+			fingerprint, sig.KeyFingerprint)
+	}
+
+	r, s, err := gutils.DecodeES256SignByBase64(sig.Signature)
+	if err != nil {
+		return errors.Wrap(err, "decode signature")
+	}
+
+	fp, err := os.Open(in)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", in)
+	}
+	defer gutils.CloseQuietly(fp)
+
+	ok, err := gutils.VerifyReaderByECDSAWithSHA256(pubKey, fp, r, s)
+	if err != nil {
+		return errors.Wrap(err, "verify")
+	}
+	if !ok {
+		return errors.Errorf("signature not match")
+	}
+
+	logger.Info("successed")
+	return nil
+}
@@ -7,11 +7,18 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Laisky/zap"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
 	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
 	"github.com/pkg/errors"
 )
 
@@ -21,6 +28,10 @@ const (
 	defaultCompressBufSizeByte  = 4 * 1024 * 1024
 	defaultPgzCompressNBlock    = 16
 	defaultPgzCompressBlockSize = 250000
+	defaultZstdCompressLevel    = 3
+	defaultS2CompressLevel      = 1
+	defaultLZ4CompressLevel     = 0
+	defaultBrotliCompressLevel  = brotli.DefaultCompression
 )
 
 // CompressorItf interface of compressor
@@ -36,6 +47,7 @@ type CompressorItf interface {
 type compressOption struct {
 	level, bufSizeByte,
 	nBlock, blockSizeByte int
+	dict []byte
 }
 
 // CompressOptFunc options for compressor
@@ -214,63 +226,852 @@ func (c *PGZCompressor) WriteFooter() (err error) {
 	return nil
 }
 
+// NewCompressor create compressor by name,
+// name could be `gzip`, `pgzip`, `zstd`, `s2`, `snappy`, `lz4` or `brotli`.
+//
+// meaning of `WithCompressLevel` depends on compressor.
+func NewCompressor(name string, writer io.Writer, opts ...CompressOptFunc) (CompressorItf, error) {
+	switch strings.ToLower(name) {
+	case string(CompressFormatGzip), "gz":
+		return NewGZCompressor(writer, opts...)
+	case "pgzip":
+		return NewPGZCompressor(writer, opts...)
+	case string(CompressFormatZstd):
+		return NewZstdCompressor(writer, opts...)
+	case string(CompressFormatS2):
+		return NewS2Compressor(writer, opts...)
+	case string(CompressFormatSnappy):
+		return NewSnappyCompressor(writer, opts...)
+	case string(CompressFormatLZ4):
+		return NewLZ4Compressor(writer, opts...)
+	case string(CompressFormatBrotli):
+		return NewBrotliCompressor(writer, opts...)
+	default:
+		return nil, errors.Errorf("unknown compressor `%s`", name)
+	}
+}
+
+func newCompressOption(defaultLevel int, opts []CompressOptFunc) (*compressOption, error) {
+	opt := &compressOption{
+		level:       defaultLevel,
+		bufSizeByte: defaultCompressBufSizeByte,
+	}
+	for _, of := range opts {
+		if err := of(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	return opt, nil
+}
+
+// ZstdCompressor compress by zstd with buf
+type ZstdCompressor struct {
+	*compressOption
+	buf     *bufio.Writer
+	encoder *zstd.Encoder
+	writer  io.Writer
+}
+
+// WithCompressZstdDict set dictionary for zstd compressor,
+// decompressor should use the same dictionary.
+func WithCompressZstdDict(dict []byte) CompressOptFunc {
+	return func(opt *compressOption) error {
+		if len(dict) == 0 {
+			return errors.Errorf("dict cannot be empty")
+		}
+
+		opt.dict = dict
+		return nil
+	}
+}
+
+// NewZstdCompressor create new ZstdCompressor
+//
+// level is zstd level from 1 to 22, default to 3
+func NewZstdCompressor(writer io.Writer, opts ...CompressOptFunc) (c *ZstdCompressor, err error) {
+	opt, err := newCompressOption(defaultZstdCompressLevel, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opt.level < 1 || opt.level > 22 {
+		return nil, errors.Errorf("zstd level should between 1 and 22, got %d", opt.level)
+	}
+
+	c = &ZstdCompressor{
+		writer:         writer,
+		compressOption: opt,
+	}
+	c.buf = bufio.NewWriterSize(c.writer, c.bufSizeByte)
+	zopts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opt.level))}
+	if opt.dict != nil {
+		zopts = append(zopts, zstd.WithEncoderDict(opt.dict))
+	}
+	if c.encoder, err = zstd.NewWriter(c.buf, zopts...); err != nil {
+		return nil, errors.Wrap(err, "new zstd")
+	}
+
+	return c, nil
+}
+
+// Write write bytes via compressor
+func (c *ZstdCompressor) Write(d []byte) (int, error) {
+	return c.encoder.Write(d)
+}
+
+// WriteString write string via compressor
+func (c *ZstdCompressor) WriteString(d string) (int, error) {
+	return c.encoder.Write([]byte(d))
+}
+
+// Flush flush buffer bytes into bottom writer with zstd frame end
+func (c *ZstdCompressor) Flush() (err error) {
+	if err = c.encoder.Close(); err != nil {
+		return err
+	}
+	if err = c.buf.Flush(); err != nil {
+		return err
+	}
+	c.encoder.Reset(c.buf)
+	return nil
+}
+
+// WriteFooter write zstd frame end
+func (c *ZstdCompressor) WriteFooter() (err error) {
+	if err = c.encoder.Close(); err != nil {
+		return err
+	}
+	c.encoder.Reset(c.buf)
+	return nil
+}
+
+// S2Compressor compress by s2 (or snappy compatible) stream with buf
+type S2Compressor struct {
+	*compressOption
+	buf     *bufio.Writer
+	encoder *s2.Writer
+	writer  io.Writer
+}
+
+// NewS2Compressor create new S2Compressor
+//
+// level 1 is fastest (default), 2 is better compression, 3 is best compression
+func NewS2Compressor(writer io.Writer, opts ...CompressOptFunc) (c *S2Compressor, err error) {
+	return newS2Compressor(writer, false, opts)
+}
+
+// NewSnappyCompressor create new S2Compressor that output snappy compatible stream
+//
+// level 1 is fastest (default), 2 is better compression, 3 is best compression
+func NewSnappyCompressor(writer io.Writer, opts ...CompressOptFunc) (c *S2Compressor, err error) {
+	return newS2Compressor(writer, true, opts)
+}
+
+func newS2Compressor(writer io.Writer, snappy bool, opts []CompressOptFunc) (c *S2Compressor, err error) {
+	opt, err := newCompressOption(defaultS2CompressLevel, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var sopts []s2.WriterOption
+	switch opt.level {
+	case 1:
+	case 2:
+		sopts = append(sopts, s2.WriterBetterCompression())
+	case 3:
+		sopts = append(sopts, s2.WriterBestCompression())
+	default:
+		return nil, errors.Errorf("s2 level should between 1 and 3, got %d", opt.level)
+	}
+	if snappy {
+		sopts = append(sopts, s2.WriterSnappyCompat())
+	}
+
+	c = &S2Compressor{
+		writer:         writer,
+		compressOption: opt,
+	}
+	c.buf = bufio.NewWriterSize(c.writer, c.bufSizeByte)
+	c.encoder = s2.NewWriter(c.buf, sopts...)
+	return c, nil
+}
+
+// Write write bytes via compressor
+func (c *S2Compressor) Write(d []byte) (int, error) {
+	return c.encoder.Write(d)
+}
+
+// WriteString write string via compressor
+func (c *S2Compressor) WriteString(d string) (int, error) {
+	return c.encoder.Write([]byte(d))
+}
+
+// Flush flush buffer bytes into bottom writer
+func (c *S2Compressor) Flush() (err error) {
+	if err = c.encoder.Close(); err != nil {
+		return err
+	}
+	if err = c.buf.Flush(); err != nil {
+		return err
+	}
+	c.encoder.Reset(c.buf)
+	return nil
+}
+
+// WriteFooter flush pending blocks, s2 stream has no footer
+func (c *S2Compressor) WriteFooter() (err error) {
+	if err = c.encoder.Close(); err != nil {
+		return err
+	}
+	c.encoder.Reset(c.buf)
+	return nil
+}
+
+// LZ4Compressor compress by lz4 frame with buf
+type LZ4Compressor struct {
+	*compressOption
+	buf     *bufio.Writer
+	encoder *lz4.Writer
+	writer  io.Writer
+}
+
+var lz4CompressLevels = []lz4.CompressionLevel{
+	lz4.Fast,
+	lz4.Level1, lz4.Level2, lz4.Level3,
+	lz4.Level4, lz4.Level5, lz4.Level6,
+	lz4.Level7, lz4.Level8, lz4.Level9,
+}
+
+// NewLZ4Compressor create new LZ4Compressor
+//
+// level 0 is fast (default), 1~9 for lz4hc
+func NewLZ4Compressor(writer io.Writer, opts ...CompressOptFunc) (c *LZ4Compressor, err error) {
+	opt, err := newCompressOption(defaultLZ4CompressLevel, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opt.level < 0 || opt.level >= len(lz4CompressLevels) {
+		return nil, errors.Errorf("lz4 level should between 0 and 9, got %d", opt.level)
+	}
+
+	c = &LZ4Compressor{
+		writer:         writer,
+		compressOption: opt,
+	}
+	c.buf = bufio.NewWriterSize(c.writer, c.bufSizeByte)
+	c.encoder = lz4.NewWriter(c.buf)
+	if err = c.encoder.Apply(lz4.CompressionLevelOption(lz4CompressLevels[opt.level])); err != nil {
+		return nil, errors.Wrap(err, "set lz4 level")
+	}
+
+	return c, nil
+}
+
+// Write write bytes via compressor
+func (c *LZ4Compressor) Write(d []byte) (int, error) {
+	return c.encoder.Write(d)
+}
+
+// WriteString write string via compressor
+func (c *LZ4Compressor) WriteString(d string) (int, error) {
+	return c.encoder.Write([]byte(d))
+}
+
+// Flush flush buffer bytes into bottom writer with lz4 end mark
+func (c *LZ4Compressor) Flush() (err error) {
+	if err = c.encoder.Close(); err != nil {
+		return err
+	}
+	if err = c.buf.Flush(); err != nil {
+		return err
+	}
+	c.encoder.Reset(c.buf)
+	return nil
+}
+
+// WriteFooter write lz4 end mark
+func (c *LZ4Compressor) WriteFooter() (err error) {
+	if err = c.encoder.Close(); err != nil {
+		return err
+	}
+	c.encoder.Reset(c.buf)
+	return nil
+}
+
+// BrotliCompressor compress by brotli with buf
+type BrotliCompressor struct {
+	*compressOption
+	buf     *bufio.Writer
+	encoder *brotli.Writer
+	writer  io.Writer
+}
+
+// NewBrotliCompressor create new BrotliCompressor
+//
+// level between 0 and 11, default to 6
+func NewBrotliCompressor(writer io.Writer, opts ...CompressOptFunc) (c *BrotliCompressor, err error) {
+	opt, err := newCompressOption(defaultBrotliCompressLevel, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opt.level < brotli.BestSpeed || opt.level > brotli.BestCompression {
+		return nil, errors.Errorf("brotli level should between 0 and 11, got %d", opt.level)
+	}
+
+	c = &BrotliCompressor{
+		writer:         writer,
+		compressOption: opt,
+	}
+	c.buf = bufio.NewWriterSize(c.writer, c.bufSizeByte)
+	c.encoder = brotli.NewWriterLevel(c.buf, opt.level)
+	return c, nil
+}
+
+// Write write bytes via compressor
+func (c *BrotliCompressor) Write(d []byte) (int, error) {
+	return c.encoder.Write(d)
+}
+
+// WriteString write string via compressor
+func (c *BrotliCompressor) WriteString(d string) (int, error) {
+	return c.encoder.Write([]byte(d))
+}
+
+// Flush flush buffer bytes into bottom writer with brotli stream end
+func (c *BrotliCompressor) Flush() (err error) {
+	if err = c.encoder.Close(); err != nil {
+		return err
+	}
+	if err = c.buf.Flush(); err != nil {
+		return err
+	}
+	c.encoder.Reset(c.buf)
+	return nil
+}
+
+// WriteFooter write brotli stream end
+func (c *BrotliCompressor) WriteFooter() (err error) {
+	if err = c.encoder.Close(); err != nil {
+		return err
+	}
+	c.encoder.Reset(c.buf)
+	return nil
+}
+
+// UnzipSymlinkPolicy how to deal with symlinks in zip
+type UnzipSymlinkPolicy int
+
+const (
+	// UnzipSymlinkSkip skip symlinks
+	UnzipSymlinkSkip UnzipSymlinkPolicy = iota
+	// UnzipSymlinkInDir create symlinks that point inside dest,
+	// return error for others
+	UnzipSymlinkInDir
+	// UnzipSymlinkError return error if there is any symlink
+	UnzipSymlinkError
+)
+
+// UnzipOverwritePolicy how to deal with existed files
+type UnzipOverwritePolicy int
+
+const (
+	// UnzipOverwriteAlways overwrite existed files
+	UnzipOverwriteAlways UnzipOverwritePolicy = iota
+	// UnzipOverwriteSkip skip existed files
+	UnzipOverwriteSkip
+	// UnzipOverwriteError return error if file already exists
+	UnzipOverwriteError
+)
+
+// UnzipProgress progress of extraction
+type UnzipProgress struct {
+	// Name name of current entry in zip
+	Name string
+	// Path extracted path of current entry
+	Path string
+	// Index index of current entry, start from 0
+	Index int
+	// Total number of entries in zip
+	Total int
+	// WrittenBytes total uncompressed bytes written
+	WrittenBytes int64
+}
+
+// UnzipResult result of extraction
+type UnzipResult struct {
+	// Files paths of extracted files, dirs and symlinks
+	Files []string
+	// Skipped names of entries skipped by filters or policies
+	Skipped []string
+	// WrittenBytes total uncompressed bytes written
+	WrittenBytes int64
+}
+
+type unzipOption struct {
+	includes, excludes []string
+	maxTotalSizeByte,
+	maxFileSizeByte int64
+	maxFiles  int
+	symlink   UnzipSymlinkPolicy
+	overwrite UnzipOverwritePolicy
+	progress  func(UnzipProgress)
+	fs        FS
+}
+
+// UnzipOptFunc options for unzip
+type UnzipOptFunc func(*unzipOption) error
+
+func newUnzipOption(opts []UnzipOptFunc) (*unzipOption, error) {
+	opt := &unzipOption{fs: OSFS}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	return opt, nil
+}
+
+// WithUnzipFS read zip file and extract into fsys, default to OSFS
+func WithUnzipFS(fsys FS) UnzipOptFunc {
+	return func(opt *unzipOption) error {
+		if fsys == nil {
+			return errors.Errorf("fs cannot be nil")
+		}
+
+		opt.fs = fsys
+		return nil
+	}
+}
+
+// WithUnzipInclude only extract entries that match any of patterns.
+//
+// pattern without `/` matches any element of entry path,
+// otherwise matches the whole path or its parent dirs, see `path.Match`.
+func WithUnzipInclude(patterns ...string) UnzipOptFunc {
+	return func(opt *unzipOption) error {
+		if err := checkArchivePatterns(patterns); err != nil {
+			return err
+		}
+
+		opt.includes = append(opt.includes, patterns...)
+		return nil
+	}
+}
+
+// WithUnzipExclude do not extract entries that match any of patterns,
+// pattern syntax is the same as `WithUnzipInclude`.
+func WithUnzipExclude(patterns ...string) UnzipOptFunc {
+	return func(opt *unzipOption) error {
+		if err := checkArchivePatterns(patterns); err != nil {
+			return err
+		}
+
+		opt.excludes = append(opt.excludes, patterns...)
+		return nil
+	}
+}
+
+// WithUnzipMaxTotalSizeByte limit total uncompressed bytes,
+// return ErrDecompressSizeExceeded if exceeded.
+func WithUnzipMaxTotalSizeByte(n int64) UnzipOptFunc {
+	return func(opt *unzipOption) error {
+		if n <= 0 {
+			return errors.Errorf("max size should greater than 0, got %d", n)
+		}
+
+		opt.maxTotalSizeByte = n
+		return nil
+	}
+}
+
+// WithUnzipMaxFileSizeByte limit uncompressed bytes of each file,
+// return ErrDecompressSizeExceeded if exceeded.
+func WithUnzipMaxFileSizeByte(n int64) UnzipOptFunc {
+	return func(opt *unzipOption) error {
+		if n <= 0 {
+			return errors.Errorf("max size should greater than 0, got %d", n)
+		}
+
+		opt.maxFileSizeByte = n
+		return nil
+	}
+}
+
+// WithUnzipMaxFiles limit number of entries in zip
+func WithUnzipMaxFiles(n int) UnzipOptFunc {
+	return func(opt *unzipOption) error {
+		if n <= 0 {
+			return errors.Errorf("max files should greater than 0, got %d", n)
+		}
+
+		opt.maxFiles = n
+		return nil
+	}
+}
+
+// WithUnzipSymlinkPolicy set how to deal with symlinks
+//
+// default to UnzipSymlinkSkip
+func WithUnzipSymlinkPolicy(policy UnzipSymlinkPolicy) UnzipOptFunc {
+	return func(opt *unzipOption) error {
+		switch policy {
+		case UnzipSymlinkSkip, UnzipSymlinkInDir, UnzipSymlinkError:
+		default:
+			return errors.Errorf("unknown symlink policy %d", policy)
+		}
+
+		opt.symlink = policy
+		return nil
+	}
+}
+
+// WithUnzipOverwritePolicy set how to deal with existed files
+//
+// default to UnzipOverwriteAlways
+func WithUnzipOverwritePolicy(policy UnzipOverwritePolicy) UnzipOptFunc {
+	return func(opt *unzipOption) error {
+		switch policy {
+		case UnzipOverwriteAlways, UnzipOverwriteSkip, UnzipOverwriteError:
+		default:
+			return errors.Errorf("unknown overwrite policy %d", policy)
+		}
+
+		opt.overwrite = policy
+		return nil
+	}
+}
+
+// WithUnzipProgress set callback that will be called after each entry extracted
+func WithUnzipProgress(progress func(UnzipProgress)) UnzipOptFunc {
+	return func(opt *unzipOption) error {
+		opt.progress = progress
+		return nil
+	}
+}
+
+func checkArchivePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid pattern `%s`", pattern)
+		}
+	}
+
+	return nil
+}
+
+// matchArchivePatterns check whether slash-separated name matches any of patterns
+func matchArchivePatterns(patterns []string, name string) bool {
+	name = strings.Trim(name, "/")
+	elems := strings.Split(name, "/")
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		if !strings.Contains(pattern, "/") {
+			for _, elem := range elems {
+				if ok, _ := path.Match(pattern, elem); ok {
+					return true
+				}
+			}
+
+			continue
+		}
+
+		for i := range elems {
+			if ok, _ := path.Match(pattern, strings.Join(elems[:i+1], "/")); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 // Unzip will decompress a zip archive, moving all files and folders
 // within the zip file (parameter 1) to an output directory (parameter 2).
 //
 // https://golangcode.com/unzip-files-in-go/
-func Unzip(src string, dest string) (filenames []string, err error) {
-	var r *zip.ReadCloser
-	if r, err = zip.OpenReader(src); err != nil {
+func Unzip(src string, dest string, opts ...UnzipOptFunc) (filenames []string, err error) {
+	opt, err := newUnzipOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := opt.fs.Open(src)
+	if err != nil {
 		return nil, errors.Wrap(err, "open src")
 	}
-	defer func() { _ = r.Close() }()
+	defer CloseQuietly(fp)
+
+	finfo, err := fp.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "get src stat")
+	}
+
+	result, err := ExtractZip(fp, finfo.Size(), dest, opts...)
+	if result != nil {
+		filenames = result.Files
+	}
 
-	for _, f := range r.File {
+	return filenames, err
+}
+
+// ExtractZip extract zip archive from reader into dest directory
+//
+// entries that point outside of dest, or be written through
+// any symlink under dest, will be rejected.
+// result contains entries extracted before error.
+func ExtractZip(reader io.ReaderAt, size int64, dest string, opts ...UnzipOptFunc) (result *UnzipResult, err error) {
+	opt, err := newUnzipOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := zip.NewReader(reader, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "open zip")
+	}
+	if opt.maxFiles > 0 && len(r.File) > opt.maxFiles {
+		return nil, errors.Errorf("too many files in zip, got %d, limit %d", len(r.File), opt.maxFiles)
+	}
+
+	dest = filepath.Clean(dest)
+	result = new(UnzipResult)
+	for i, f := range r.File {
 		// Store filename/path for returning and using later on
 		fpath := filepath.Join(dest, f.Name)
 
 		// Check for ZipSlip. More Info: https://snyk.io/research/zip-slip-vulnerability#go
-		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return filenames, errors.Errorf("illegal file path: %s", fpath)
+		// also refuse to write through symlinks created by previous entries
+		if err = checkArchivePath(opt.fs, dest, fpath, f.FileInfo().IsDir()); err != nil {
+			return result, errors.Wrapf(err, "illegal file path: %s", fpath)
+		}
+
+		if (len(opt.includes) != 0 && !matchArchivePatterns(opt.includes, f.Name)) ||
+			matchArchivePatterns(opt.excludes, f.Name) {
+			result.Skipped = append(result.Skipped, f.Name)
+			continue
+		}
+
+		extracted, err := opt.extractZipEntry(f, fpath, dest, result)
+		if err != nil {
+			return result, err
+		}
+		if !extracted {
+			result.Skipped = append(result.Skipped, f.Name)
+			continue
 		}
 
-		filenames = append(filenames, fpath)
+		result.Files = append(result.Files, fpath)
+		if opt.progress != nil {
+			opt.progress(UnzipProgress{
+				Name:         f.Name,
+				Path:         fpath,
+				Index:        i,
+				Total:        len(r.File),
+				WrittenBytes: result.WrittenBytes,
+			})
+		}
+	}
 
-		if f.FileInfo().IsDir() {
-			// Make Folder
-			if err = os.MkdirAll(fpath, os.ModePerm); err != nil {
-				return nil, errors.Wrapf(err, "create basedir: %s", fpath)
+	return result, nil
+}
+
+// extractZipEntry extract one entry, return false if skipped
+func (opt *unzipOption) extractZipEntry(f *zip.File, fpath, dest string, result *UnzipResult) (extracted bool, err error) {
+	if f.FileInfo().IsDir() {
+		// Make Folder
+		if err = opt.fs.MkdirAll(fpath, os.ModePerm); err != nil {
+			return false, errors.Wrapf(err, "create basedir: %s", fpath)
+		}
+
+		Logger.Debug("create basedir", zap.String("path", fpath))
+		return true, nil
+	}
+
+	if f.Mode()&os.ModeSymlink != 0 {
+		switch opt.symlink {
+		case UnzipSymlinkSkip:
+			Logger.Debug("skip symlink", zap.String("name", f.Name))
+			return false, nil
+		case UnzipSymlinkError:
+			return false, errors.Errorf("symlink is not allowed: %s", f.Name)
+		}
+	}
+
+	if finfo, err := opt.fs.Lstat(fpath); err == nil {
+		switch opt.overwrite {
+		case UnzipOverwriteSkip:
+			return false, nil
+		case UnzipOverwriteError:
+			return false, errors.Errorf("file already exists: %s", fpath)
+		}
+
+		// do not write through existed symlink
+		if finfo.Mode()&os.ModeSymlink != 0 {
+			if err = opt.fs.Remove(fpath); err != nil {
+				return false, errors.Wrapf(err, "remove existed symlink: %s", fpath)
 			}
+		}
+	}
 
-			Logger.Debug("create basedir", zap.String("path", fpath))
-			continue
+	// Make File
+	if err = opt.fs.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+		return false, errors.Wrapf(err, "mkdir: %s", fpath)
+	}
+	Logger.Debug("create basedir", zap.String("path", filepath.Dir(fpath)))
+
+	rc, err := f.Open()
+	if err != nil {
+		return false, errors.Wrapf(err, "read src file to write: %s", f.Name)
+	}
+	defer CloseQuietly(rc)
+
+	if f.Mode()&os.ModeSymlink != 0 {
+		return opt.extractZipSymlink(rc, f, fpath, dest)
+	}
+
+	// negative means no limit
+	limit := int64(-1)
+	if opt.maxFileSizeByte > 0 {
+		limit = opt.maxFileSizeByte
+	}
+	if opt.maxTotalSizeByte > 0 {
+		if remain := opt.maxTotalSizeByte - result.WrittenBytes; limit < 0 || remain < limit {
+			limit = remain
 		}
+	}
+	if limit >= 0 && f.UncompressedSize64 > uint64(limit) {
+		return false, errors.Wrapf(ErrDecompressSizeExceeded, "file `%s`", f.Name)
+	}
+
+	outFile, err := opt.fs.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|oNoFollow, f.Mode())
+	if err != nil {
+		return false, errors.Wrapf(err, "open file to write: %s", fpath)
+	}
+	Logger.Debug("create file", zap.String("path", fpath))
+	defer CloseQuietly(outFile)
+
+	// do not trust the size in header
+	var src io.Reader = rc
+	if limit >= 0 {
+		src = &limitDecompressReader{r: rc, n: limit}
+	}
+
+	n, err := io.Copy(outFile, src)
+	result.WrittenBytes += n
+	if err != nil {
+		return false, errors.Wrapf(err, "copy src `%s` to dest", f.Name)
+	}
+	if err = outFile.Close(); err != nil {
+		return false, errors.Wrapf(err, "close file: %s", fpath)
+	}
+
+	return true, nil
+}
+
+// extractZipSymlink create symlink allowed by UnzipSymlinkInDir
+func (opt *unzipOption) extractZipSymlink(rc io.Reader, f *zip.File, fpath, dest string) (extracted bool, err error) {
+	// content of symlink entry is the link target
+	link, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return false, errors.Wrapf(err, "read link of `%s`", f.Name)
+	}
 
-		// Make File
-		if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
-			return nil, errors.Wrapf(err, "mkdir: %s", fpath)
+	target := string(link)
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(fpath), target)
+	}
+	if err = checkArchivePath(opt.fs, dest, target, true); err != nil {
+		return false, errors.Wrapf(err, "illegal link `%s` -> `%s`", f.Name, string(link))
+	}
+
+	if err = opt.fs.Remove(fpath); err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrapf(err, "remove existed file: %s", fpath)
+	}
+	if err = opt.fs.Symlink(string(link), fpath); err != nil {
+		return false, errors.Wrapf(err, "create symlink: %s", fpath)
+	}
+
+	return true, nil
+}
+
+type zipOption struct {
+	excludes      []string
+	storeExts     map[string]bool
+	deterministic bool
+	modTime       time.Time
+	fs            FS
+}
+
+// ZipOptFunc options for zip
+type ZipOptFunc func(*zipOption) error
+
+func newZipOption(opts []ZipOptFunc) (*zipOption, error) {
+	opt := &zipOption{storeExts: map[string]bool{}, fs: OSFS}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
 		}
-		Logger.Debug("create basedir", zap.String("path", filepath.Dir(fpath)))
+	}
 
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return nil, errors.Wrapf(err, "open file to write: %s", fpath)
+	return opt, nil
+}
+
+// WithZipFS read files and create zip file in fsys, default to OSFS
+func WithZipFS(fsys FS) ZipOptFunc {
+	return func(opt *zipOption) error {
+		if fsys == nil {
+			return errors.Errorf("fs cannot be nil")
 		}
-		Logger.Debug("create file", zap.String("path", filepath.Dir(fpath)))
-		defer CloseQuietly(outFile)
 
-		rc, err := f.Open()
-		if err != nil {
-			return nil, errors.Wrapf(err, "read src file to write: %s", f.Name)
+		opt.fs = fsys
+		return nil
+	}
+}
+
+// WithZipExclude do not add files that match any of patterns,
+// like `.git` or `*.tmp`, pattern syntax is the same as `WithUnzipInclude`.
+func WithZipExclude(patterns ...string) ZipOptFunc {
+	return func(opt *zipOption) error {
+		if err := checkArchivePatterns(patterns); err != nil {
+			return err
 		}
-		defer CloseQuietly(rc)
 
-		if _, err = io.Copy(outFile, rc); err != nil {
-			return nil, errors.Wrap(err, "copy src to dest")
+		opt.excludes = append(opt.excludes, patterns...)
+		return nil
+	}
+}
+
+// WithZipStoreExtensions store files with these extensions without compression,
+// like `.jpg` or `.gz`, other files are compressed by deflate.
+func WithZipStoreExtensions(exts ...string) ZipOptFunc {
+	return func(opt *zipOption) error {
+		for _, ext := range exts {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+
+			opt.storeExts[strings.ToLower(ext)] = true
 		}
+
+		return nil
 	}
+}
+
+// WithZipDeterministic create reproducible archive,
+// all entries are sorted by name and use the same modTime.
+//
+// modTime default to 1980-01-01 (the minimum time of zip) if zero.
+func WithZipDeterministic(modTime time.Time) ZipOptFunc {
+	return func(opt *zipOption) error {
+		if modTime.IsZero() {
+			modTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+		}
 
-	return filenames, nil
+		opt.deterministic = true
+		opt.modTime = modTime.UTC()
+		return nil
+	}
 }
 
 // ZipFiles compresses one or many files into a single zip archive file.
@@ -281,44 +1082,85 @@ func Unzip(src string, dest string) (filenames []string, err error) {
 //            files can be directory.
 //
 // https://golangcode.com/create-zip-files-in-go/
-func ZipFiles(output string, files []string) (err error) {
-	var newZipFile *os.File
-	if newZipFile, err = os.Create(output); err != nil {
+func ZipFiles(output string, files []string, opts ...ZipOptFunc) (err error) {
+	opt, err := newZipOption(opts)
+	if err != nil {
+		return err
+	}
+
+	newZipFile, err := opt.fs.OpenFile(output, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
 		return err
 	}
 	defer CloseQuietly(newZipFile)
 
-	zipWriter := zip.NewWriter(newZipFile)
-	defer CloseQuietly(zipWriter)
+	if err = WriteZip(newZipFile, files, opts...); err != nil {
+		return err
+	}
+
+	return newZipFile.Close()
+}
+
+// WriteZip write zip archive of files into writer,
+// writer will not be closed.
+//
+// zip64 is used automatically for large files.
+func WriteZip(writer io.Writer, files []string, opts ...ZipOptFunc) (err error) {
+	opt, err := newZipOption(opts)
+	if err != nil {
+		return err
+	}
+
+	if opt.deterministic {
+		files = append([]string{}, files...)
+		sort.Strings(files)
+	}
 
+	zipWriter := zip.NewWriter(writer)
 	// Add files to zip
 	for _, file := range files {
-		if err = AddFileToZip(zipWriter, file, ""); err != nil {
+		if err = opt.addFileToZip(zipWriter, file, ""); err != nil {
 			return errors.Wrapf(err, "AddFileToZip: %s", file)
 		}
 	}
 
-	return nil
+	return zipWriter.Close()
 }
 
 // AddFileToZip add file tp zip.Writer
 //
 // https://golangcode.com/create-zip-files-in-go/
 func AddFileToZip(zipWriter *zip.Writer, filename, basedir string) error {
-	finfo, err := os.Stat(filename)
+	opt := &zipOption{storeExts: map[string]bool{}, fs: OSFS}
+	return opt.addFileToZip(zipWriter, filename, basedir)
+}
+
+func (opt *zipOption) addFileToZip(zipWriter *zip.Writer, filename, basedir string) error {
+	finfo, err := opt.fs.Stat(filename)
 	if err != nil {
 		return errors.Wrapf(err, "get file stat: %s", filename)
 	}
 
+	name := finfo.Name()
+	if basedir != "" {
+		name = filepath.Join(basedir, finfo.Name())
+	}
+	name = filepath.ToSlash(name)
+	if matchArchivePatterns(opt.excludes, name) {
+		Logger.Debug("skip excluded file", zap.String("file", filename))
+		return nil
+	}
+
 	if finfo.IsDir() {
-		fs, err := ioutil.ReadDir(filename)
+		// ReadDir returns entries sorted by filename
+		fs, err := opt.fs.ReadDir(filename)
 		if err != nil {
 			return errors.Wrapf(err, "list files in `%s`", filename)
 		}
 
 		for _, finfoInDir := range fs {
 			_, childDir := filepath.Split(finfoInDir.Name())
-			if err = AddFileToZip(zipWriter,
+			if err = opt.addFileToZip(zipWriter,
 				filepath.Join(filename, finfoInDir.Name()),
 				filepath.Join(basedir, finfo.Name()),
 			); err != nil {
@@ -329,7 +1171,7 @@ func AddFileToZip(zipWriter *zip.Writer, filename, basedir string) error {
 		return nil
 	}
 
-	fileToZip, err := os.Open(filename)
+	fileToZip, err := opt.fs.Open(filename)
 	if err != nil {
 		return errors.Wrapf(err, "open file: %s", filename)
 	}
@@ -342,13 +1184,17 @@ func AddFileToZip(zipWriter *zip.Writer, filename, basedir string) error {
 
 	// Using FileInfoHeader() above only uses the basename of the file. If we want
 	// to preserve the folder structure we can overwrite this with the full path.
-	if basedir != "" {
-		header.Name = filepath.Join(basedir, finfo.Name())
+	header.Name = name
+	if opt.deterministic {
+		header.Modified = opt.modTime
 	}
 
 	// Change to deflate to gain better compression
 	// see http://golang.org/pkg/archive/zip/#pkg-constants
 	header.Method = zip.Deflate
+	if opt.storeExts[strings.ToLower(filepath.Ext(filename))] {
+		header.Method = zip.Store
+	}
 
 	var writer io.Writer
 	if writer, err = zipWriter.CreateHeader(header); err != nil {
@@ -1,16 +1,21 @@
 package utils
 
 import (
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
 )
 
 // func TestZipDir(t *testing.T) {
@@ -577,3 +582,299 @@ func BenchmarkCompressor(b *testing.B) {
 		buf.Reset()
 	}
 }
+
+func TestNewCompressor(t *testing.T) {
+	for _, name := range []string{"gzip", "pgzip", "zstd", "s2", "snappy", "lz4", "brotli"} {
+		t.Run(name, func(t *testing.T) {
+			writer := &bytes.Buffer{}
+			c, err := NewCompressor(name, writer)
+			require.NoError(t, err)
+
+			members := []string{testCompressraw, "yoo"}
+			if name == "brotli" {
+				// brotli reader do not support concatenated streams
+				members = members[:1]
+			}
+			for _, v := range members {
+				_, err = c.WriteString(v)
+				require.NoError(t, err)
+				require.NoError(t, c.Flush())
+			}
+
+			format := CompressFormat(name)
+			if name == "pgzip" {
+				format = CompressFormatGzip
+			}
+			if format != CompressFormatBrotli {
+				require.Equal(t, format, DetectCompressFormat(writer.Bytes()))
+			}
+
+			d, err := NewDecompressorByFormat(format, writer)
+			require.NoError(t, err)
+			defer d.Close()
+			got, err := ioutil.ReadAll(d)
+			require.NoError(t, err)
+			require.Equal(t, strings.Join(members, ""), string(got))
+		})
+	}
+
+	_, err := NewCompressor("rar", &bytes.Buffer{})
+	require.Error(t, err)
+	_, err = NewCompressor("zstd", &bytes.Buffer{}, WithCompressLevel(23))
+	require.Error(t, err)
+	_, err = NewCompressor("s2", &bytes.Buffer{}, WithCompressLevel(0))
+	require.Error(t, err)
+	_, err = NewCompressor("lz4", &bytes.Buffer{}, WithCompressLevel(10))
+	require.Error(t, err)
+	_, err = NewCompressor("brotli", &bytes.Buffer{}, WithCompressLevel(12))
+	require.Error(t, err)
+}
+
+func TestZstdCompressorDict(t *testing.T) {
+	// trained by `zstd --train --maxdict=1024`
+	dict, err := ioutil.ReadFile(filepath.Join("testdata", "zstd.dict"))
+	require.NoError(t, err)
+
+	writer := &bytes.Buffer{}
+	c, err := NewZstdCompressor(writer, WithCompressZstdDict(dict), WithCompressLevel(19))
+	require.NoError(t, err)
+	_, err = c.WriteString(testCompressraw)
+	require.NoError(t, err)
+	require.NoError(t, c.Flush())
+
+	d, err := NewDecompressor(bytes.NewReader(writer.Bytes()), WithDecompressZstdDicts(dict))
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(d)
+	require.NoError(t, err)
+	require.Equal(t, testCompressraw, string(got))
+
+	// without dict
+	d, err = NewDecompressor(bytes.NewReader(writer.Bytes()))
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(d)
+	require.Error(t, err)
+
+	_, err = NewZstdCompressor(writer, WithCompressZstdDict(nil))
+	require.Error(t, err)
+}
+
+func testBuildZip(t *testing.T, entries map[string]string, symlinks map[string]string) *bytes.Reader {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(entries[name]))
+		require.NoError(t, err)
+	}
+	for name, target := range symlinks {
+		header := &zip.FileHeader{Name: name}
+		header.SetMode(os.ModeSymlink | 0777)
+		w, err := zw.CreateHeader(header)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(target))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestExtractZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unzip-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	entries := map[string]string{
+		"a.txt":        "yoo",
+		".git/config":  "git",
+		"child/b.tmp":  "tmp",
+		"child/c.txt":  "c",
+		"big/data.bin": strings.Repeat("x", 1000),
+	}
+
+	t.Run("filter", func(t *testing.T) {
+		r := testBuildZip(t, entries, nil)
+		dst := filepath.Join(dir, "filter")
+		var progress []UnzipProgress
+		result, err := ExtractZip(r, r.Size(), dst,
+			WithUnzipInclude("*.txt", "big/*"),
+			WithUnzipExclude(".git", "child/b.tmp"),
+			WithUnzipProgress(func(p UnzipProgress) { progress = append(progress, p) }),
+		)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{
+			filepath.Join(dst, "a.txt"),
+			filepath.Join(dst, "child", "c.txt"),
+			filepath.Join(dst, "big", "data.bin"),
+		}, result.Files)
+		require.ElementsMatch(t, []string{".git/config", "child/b.tmp"}, result.Skipped)
+		require.Equal(t, int64(1004), result.WrittenBytes)
+		require.Len(t, progress, 3)
+		require.Equal(t, int64(1004), progress[2].WrittenBytes)
+		require.Equal(t, 5, progress[2].Total)
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		r := testBuildZip(t, entries, nil)
+		_, err := ExtractZip(r, r.Size(), filepath.Join(dir, "limit-file"), WithUnzipMaxFileSizeByte(999))
+		require.Equal(t, ErrDecompressSizeExceeded, errors.Cause(err))
+
+		_, err = ExtractZip(r, r.Size(), filepath.Join(dir, "limit-total"), WithUnzipMaxTotalSizeByte(1009))
+		require.Equal(t, ErrDecompressSizeExceeded, errors.Cause(err))
+
+		_, err = ExtractZip(r, r.Size(), filepath.Join(dir, "limit-total"), WithUnzipMaxTotalSizeByte(1010))
+		require.NoError(t, err)
+
+		_, err = ExtractZip(r, r.Size(), filepath.Join(dir, "limit-count"), WithUnzipMaxFiles(4))
+		require.Error(t, err)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		r := testBuildZip(t, map[string]string{"a.txt": "new"}, nil)
+		dst := filepath.Join(dir, "overwrite")
+		require.NoError(t, os.MkdirAll(dst, os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "a.txt"), []byte("old"), 0644))
+
+		result, err := ExtractZip(r, r.Size(), dst, WithUnzipOverwritePolicy(UnzipOverwriteSkip))
+		require.NoError(t, err)
+		require.Equal(t, []string{"a.txt"}, result.Skipped)
+		_, err = ExtractZip(r, r.Size(), dst, WithUnzipOverwritePolicy(UnzipOverwriteError))
+		require.Error(t, err)
+		cnt, err := ioutil.ReadFile(filepath.Join(dst, "a.txt"))
+		require.NoError(t, err)
+		require.Equal(t, "old", string(cnt))
+
+		_, err = ExtractZip(r, r.Size(), dst)
+		require.NoError(t, err)
+		cnt, err = ioutil.ReadFile(filepath.Join(dst, "a.txt"))
+		require.NoError(t, err)
+		require.Equal(t, "new", string(cnt))
+	})
+
+	t.Run("symlink", func(t *testing.T) {
+		r := testBuildZip(t, map[string]string{"a.txt": "yoo"}, map[string]string{"link": "a.txt"})
+		dst := filepath.Join(dir, "symlink")
+		result, err := ExtractZip(r, r.Size(), dst)
+		require.NoError(t, err)
+		require.Equal(t, []string{"link"}, result.Skipped)
+
+		_, err = ExtractZip(r, r.Size(), dst, WithUnzipSymlinkPolicy(UnzipSymlinkError))
+		require.Error(t, err)
+
+		_, err = ExtractZip(r, r.Size(), dst, WithUnzipSymlinkPolicy(UnzipSymlinkInDir))
+		require.NoError(t, err)
+		link, err := os.Readlink(filepath.Join(dst, "link"))
+		require.NoError(t, err)
+		require.Equal(t, "a.txt", link)
+
+		r = testBuildZip(t, nil, map[string]string{"link": "../../etc/passwd"})
+		_, err = ExtractZip(r, r.Size(), dst, WithUnzipSymlinkPolicy(UnzipSymlinkInDir))
+		require.Error(t, err)
+	})
+
+	t.Run("zip slip", func(t *testing.T) {
+		r := testBuildZip(t, map[string]string{"../evil.txt": "evil"}, nil)
+		_, err := ExtractZip(r, r.Size(), filepath.Join(dir, "slip"))
+		require.Error(t, err)
+	})
+
+	t.Run("symlink chain", func(t *testing.T) {
+		// `a -> .` and `a/x -> ..` are both inside dest lexically,
+		// but `a/x/evil` will be written into parent of dest
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		for _, e := range []struct {
+			name, cnt string
+			link      bool
+		}{
+			{"a", ".", true},
+			{"a/x", "..", true},
+			{"a/x/evil", "evil", false},
+		} {
+			header := &zip.FileHeader{Name: e.name}
+			if e.link {
+				header.SetMode(os.ModeSymlink | 0777)
+			}
+			w, err := zw.CreateHeader(header)
+			require.NoError(t, err)
+			_, err = w.Write([]byte(e.cnt))
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+		r := bytes.NewReader(buf.Bytes())
+
+		chainDir := filepath.Join(dir, "chain")
+		_, err := ExtractZip(r, r.Size(), filepath.Join(chainDir, "dst"), WithUnzipSymlinkPolicy(UnzipSymlinkInDir))
+		require.Error(t, err)
+		_, err = os.Lstat(filepath.Join(chainDir, "evil"))
+		require.True(t, os.IsNotExist(err))
+
+		// do not write through symlink already in dest
+		dst := filepath.Join(chainDir, "existed")
+		require.NoError(t, os.MkdirAll(dst, os.ModePerm))
+		require.NoError(t, os.Symlink("..", filepath.Join(dst, "a")))
+		_, err = ExtractZip(r, r.Size(), dst)
+		require.Error(t, err)
+		_, err = os.Lstat(filepath.Join(chainDir, "x"))
+		require.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestWriteZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zip-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	for name, cnt := range map[string]string{
+		"a.txt":       "yoo",
+		"b.tmp":       "tmp",
+		"c.jpg":       "jpg",
+		".git/config": "git",
+		"child/d.txt": "d",
+	} {
+		fpath := filepath.Join(src, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fpath), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(fpath, []byte(cnt), 0644))
+	}
+
+	build := func() []byte {
+		buf := &bytes.Buffer{}
+		err := WriteZip(buf, []string{src},
+			WithZipExclude(".git", "*.tmp"),
+			WithZipStoreExtensions("jpg"),
+			WithZipDeterministic(time.Time{}),
+		)
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+
+	archive := build()
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+		require.True(t, f.Modified.Equal(time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)))
+		if f.Name == "src/c.jpg" {
+			require.Equal(t, zip.Store, f.Method)
+		} else {
+			require.Equal(t, zip.Deflate, f.Method)
+		}
+	}
+	require.Equal(t, []string{"src/a.txt", "src/c.jpg", "src/child/d.txt"}, names)
+
+	// reproducible
+	now := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(src, "a.txt"), now, now))
+	require.Equal(t, archive, build())
+
+	err = WriteZip(&bytes.Buffer{}, []string{src}, WithZipExclude("[a-"))
+	require.Error(t, err)
+}
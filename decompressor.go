@@ -0,0 +1,383 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPgzDecompressNBlock    = 16
+	defaultPgzDecompressBlockSize = 1 << 20
+	compressMagicPeekLen          = 10
+)
+
+var (
+	// ErrDecompressSizeExceeded decompressed data exceeds the max size
+	ErrDecompressSizeExceeded = errors.New("decompressed size exceeded")
+	// ErrUnknownCompressFormat cannot detect compress format from magic bytes
+	ErrUnknownCompressFormat = errors.New("unknown compress format")
+)
+
+// CompressFormat format of compressed data
+type CompressFormat string
+
+const (
+	// CompressFormatUnknown unknown format
+	CompressFormatUnknown CompressFormat = ""
+	// CompressFormatGzip gzip
+	CompressFormatGzip CompressFormat = "gzip"
+	// CompressFormatBzip2 bzip2
+	CompressFormatBzip2 CompressFormat = "bzip2"
+	// CompressFormatZstd zstd
+	CompressFormatZstd CompressFormat = "zstd"
+	// CompressFormatS2 s2 stream
+	CompressFormatS2 CompressFormat = "s2"
+	// CompressFormatSnappy snappy framing stream
+	CompressFormatSnappy CompressFormat = "snappy"
+	// CompressFormatLZ4 lz4 frame
+	CompressFormatLZ4 CompressFormat = "lz4"
+	// CompressFormatBrotli brotli, has no magic bytes,
+	// cannot be detected by `DetectCompressFormat`
+	CompressFormatBrotli CompressFormat = "brotli"
+)
+
+var compressMagics = []struct {
+	format CompressFormat
+	magic  []byte
+}{
+	{CompressFormatGzip, []byte{0x1f, 0x8b}},
+	{CompressFormatBzip2, []byte("BZh")},
+	{CompressFormatZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressFormatLZ4, []byte{0x04, 0x22, 0x4d, 0x18}},
+	{CompressFormatS2, []byte("\xff\x06\x00\x00S2sTwO")},
+	{CompressFormatSnappy, []byte("\xff\x06\x00\x00sNaPpY")},
+}
+
+// DetectCompressFormat detect compress format by magic bytes in header
+func DetectCompressFormat(header []byte) CompressFormat {
+	for _, m := range compressMagics {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.format
+		}
+	}
+
+	return CompressFormatUnknown
+}
+
+// DecompressorItf interface of decompressor
+type DecompressorItf interface {
+	Read([]byte) (int, error)
+	// Close release decompressor, will not close lower reader
+	Close() error
+}
+
+type decompressOption struct {
+	maxSizeByte int64
+	noMultistream,
+	parallel bool
+	nBlock, blockSizeByte int
+	dicts                 [][]byte
+}
+
+// DecompressOptFunc options for decompressor
+type DecompressOptFunc func(*decompressOption) error
+
+// WithDecompressMaxSizeByte limit the total decompressed bytes,
+// read will return ErrDecompressSizeExceeded if exceeded.
+//
+// 0 means no limit, default to 0
+func WithDecompressMaxSizeByte(n int64) DecompressOptFunc {
+	return func(opt *decompressOption) error {
+		if n < 0 {
+			return errors.Errorf("max size should greater than or equal to 0, got %d", n)
+		}
+
+		opt.maxSizeByte = n
+		return nil
+	}
+}
+
+// WithDecompressMultistream whether to read concatenated gzip members
+// or lz4 frames as one stream.
+//
+// default to true
+func WithDecompressMultistream(enable bool) DecompressOptFunc {
+	return func(opt *decompressOption) error {
+		opt.noMultistream = !enable
+		return nil
+	}
+}
+
+// WithDecompressParallel use pgzip to decode gzip in `NewDecompressor`
+func WithDecompressParallel(enable bool) DecompressOptFunc {
+	return func(opt *decompressOption) error {
+		opt.parallel = enable
+		return nil
+	}
+}
+
+// WithDecompressPGzipNBlocks set read-ahead blocks of pgzip decompressor
+func WithDecompressPGzipNBlocks(nBlock int) DecompressOptFunc {
+	return func(opt *decompressOption) error {
+		if nBlock <= 0 {
+			return errors.Errorf("nBlock must greater than 0, got %d", nBlock)
+		}
+
+		opt.nBlock = nBlock
+		return nil
+	}
+}
+
+// WithDecompressPGzipBlockSize set block size of pgzip decompressor
+func WithDecompressPGzipBlockSize(bytes int) DecompressOptFunc {
+	return func(opt *decompressOption) error {
+		if bytes <= 0 {
+			return errors.Errorf("block size must greater than 0, got %d", bytes)
+		}
+
+		opt.blockSizeByte = bytes
+		return nil
+	}
+}
+
+// WithDecompressZstdDicts add dictionaries for zstd decompressor
+func WithDecompressZstdDicts(dicts ...[]byte) DecompressOptFunc {
+	return func(opt *decompressOption) error {
+		opt.dicts = append(opt.dicts, dicts...)
+		return nil
+	}
+}
+
+func newDecompressOption(opts []DecompressOptFunc) (*decompressOption, error) {
+	opt := &decompressOption{
+		nBlock:        defaultPgzDecompressNBlock,
+		blockSizeByte: defaultPgzDecompressBlockSize,
+	}
+	for _, of := range opts {
+		if err := of(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	return opt, nil
+}
+
+// limitDecompressReader return ErrDecompressSizeExceeded
+// once more than n bytes are read
+type limitDecompressReader struct {
+	r io.Reader
+	n int64
+}
+
+func newLimitDecompressReader(r io.Reader, n int64) io.Reader {
+	if n <= 0 {
+		return r
+	}
+
+	return &limitDecompressReader{r: r, n: n}
+}
+
+func (l *limitDecompressReader) Read(p []byte) (n int, err error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err = l.r.Read(p)
+	if int64(n) > l.n {
+		n = int(l.n)
+		l.n = 0
+		return n, ErrDecompressSizeExceeded
+	}
+
+	l.n -= int64(n)
+	return n, err
+}
+
+// GZDecompressor decompress gzip stream
+type GZDecompressor struct {
+	*decompressOption
+	gzReader *gzip.Reader
+	reader   io.Reader
+}
+
+// NewGZDecompressor create new GZDecompressor
+func NewGZDecompressor(reader io.Reader, opts ...DecompressOptFunc) (d *GZDecompressor, err error) {
+	opt, err := newDecompressOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d = &GZDecompressor{decompressOption: opt}
+	if d.gzReader, err = gzip.NewReader(reader); err != nil {
+		return nil, errors.Wrap(err, "new gzip reader")
+	}
+	d.gzReader.Multistream(!opt.noMultistream)
+	d.reader = newLimitDecompressReader(d.gzReader, opt.maxSizeByte)
+
+	return d, nil
+}
+
+// Read read decompressed bytes
+func (d *GZDecompressor) Read(p []byte) (int, error) {
+	return d.reader.Read(p)
+}
+
+// Close close decompressor
+func (d *GZDecompressor) Close() error {
+	return d.gzReader.Close()
+}
+
+// PGZDecompressor decompress gzip stream by pgzip,
+// decoding is done in background goroutines with read-ahead blocks.
+type PGZDecompressor struct {
+	*decompressOption
+	gzReader *pgzip.Reader
+	reader   io.Reader
+}
+
+// NewPGZDecompressor create new PGZDecompressor
+func NewPGZDecompressor(reader io.Reader, opts ...DecompressOptFunc) (d *PGZDecompressor, err error) {
+	opt, err := newDecompressOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d = &PGZDecompressor{decompressOption: opt}
+	if d.gzReader, err = pgzip.NewReaderN(reader, opt.blockSizeByte, opt.nBlock); err != nil {
+		return nil, errors.Wrap(err, "new pgzip reader")
+	}
+	d.gzReader.Multistream(!opt.noMultistream)
+	d.reader = newLimitDecompressReader(d.gzReader, opt.maxSizeByte)
+
+	return d, nil
+}
+
+// Read read decompressed bytes
+func (d *PGZDecompressor) Read(p []byte) (int, error) {
+	return d.reader.Read(p)
+}
+
+// Close close decompressor and stop background goroutines
+func (d *PGZDecompressor) Close() error {
+	return d.gzReader.Close()
+}
+
+// readerDecompressor wrap decompressed reader
+type readerDecompressor struct {
+	io.Reader
+	closer func()
+}
+
+// Close release decompressor
+func (d *readerDecompressor) Close() error {
+	if d.closer != nil {
+		d.closer()
+	}
+
+	return nil
+}
+
+// lz4MultiFrameReader read concatenated lz4 frames
+type lz4MultiFrameReader struct {
+	multistream bool
+	src         *bufio.Reader
+	zr          *lz4.Reader
+}
+
+func newLZ4MultiFrameReader(reader io.Reader, multistream bool) *lz4MultiFrameReader {
+	src := bufio.NewReader(reader)
+	return &lz4MultiFrameReader{
+		multistream: multistream,
+		src:         src,
+		zr:          lz4.NewReader(src),
+	}
+}
+
+func (r *lz4MultiFrameReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = r.zr.Read(p)
+		if err != io.EOF || !r.multistream {
+			return n, err
+		}
+
+		// load next frame
+		if _, perr := r.src.Peek(1); perr != nil {
+			return n, err
+		}
+		r.zr.Reset(r.src)
+		if n != 0 {
+			return n, nil
+		}
+	}
+}
+
+// NewDecompressor create decompressor by detecting compress format
+// from magic bytes of reader
+//
+// gzip will be decoded by pgzip if `WithDecompressParallel`,
+// return ErrUnknownCompressFormat if format is unknown.
+func NewDecompressor(reader io.Reader, opts ...DecompressOptFunc) (DecompressorItf, error) {
+	buf := bufio.NewReader(reader)
+	header, err := buf.Peek(compressMagicPeekLen)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "read header")
+	}
+
+	format := DetectCompressFormat(header)
+	if format == CompressFormatUnknown {
+		return nil, ErrUnknownCompressFormat
+	}
+
+	return NewDecompressorByFormat(format, buf, opts...)
+}
+
+// NewDecompressorByFormat create decompressor by format
+//
+// concatenated streams are supported by gzip, zstd, s2, snappy and lz4,
+// brotli only support one stream.
+func NewDecompressorByFormat(format CompressFormat, reader io.Reader, opts ...DecompressOptFunc) (DecompressorItf, error) {
+	opt, err := newDecompressOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d := new(readerDecompressor)
+	switch format {
+	case CompressFormatGzip:
+		if opt.parallel {
+			return NewPGZDecompressor(reader, opts...)
+		}
+
+		return NewGZDecompressor(reader, opts...)
+	case CompressFormatBzip2:
+		d.Reader = bzip2.NewReader(reader)
+	case CompressFormatZstd:
+		zd, err := zstd.NewReader(reader, zstd.WithDecoderDicts(opt.dicts...))
+		if err != nil {
+			return nil, errors.Wrap(err, "new zstd reader")
+		}
+
+		d.Reader, d.closer = zd, zd.Close
+	case CompressFormatS2, CompressFormatSnappy:
+		d.Reader = s2.NewReader(reader)
+	case CompressFormatLZ4:
+		d.Reader = newLZ4MultiFrameReader(reader, !opt.noMultistream)
+	case CompressFormatBrotli:
+		d.Reader = brotli.NewReader(reader)
+	default:
+		return nil, ErrUnknownCompressFormat
+	}
+
+	d.Reader = newLimitDecompressReader(d.Reader, opt.maxSizeByte)
+	return d, nil
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func testGzipMembers(t *testing.T, members ...string) []byte {
+	buf := &bytes.Buffer{}
+	c, err := NewGZCompressor(buf)
+	require.NoError(t, err)
+	for _, m := range members {
+		_, err = c.WriteString(m)
+		require.NoError(t, err)
+		require.NoError(t, c.Flush())
+	}
+
+	return buf.Bytes()
+}
+
+func TestGZDecompressor(t *testing.T) {
+	raw := testGzipMembers(t, "hello, ", "world")
+
+	for name, newDecompressor := range map[string]func(opts ...DecompressOptFunc) (DecompressorItf, error){
+		"gz": func(opts ...DecompressOptFunc) (DecompressorItf, error) {
+			return NewGZDecompressor(bytes.NewReader(raw), opts...)
+		},
+		"pgz": func(opts ...DecompressOptFunc) (DecompressorItf, error) {
+			return NewPGZDecompressor(bytes.NewReader(raw), append(opts,
+				WithDecompressPGzipNBlocks(2),
+				WithDecompressPGzipBlockSize(1024),
+			)...)
+		},
+		"detect": func(opts ...DecompressOptFunc) (DecompressorItf, error) {
+			return NewDecompressor(bytes.NewReader(raw), opts...)
+		},
+		"detect parallel": func(opts ...DecompressOptFunc) (DecompressorItf, error) {
+			return NewDecompressor(bytes.NewReader(raw), append(opts, WithDecompressParallel(true))...)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// multistream
+			d, err := newDecompressor()
+			require.NoError(t, err)
+			got, err := ioutil.ReadAll(d)
+			require.NoError(t, err)
+			require.Equal(t, "hello, world", string(got))
+			require.NoError(t, d.Close())
+
+			// single member
+			d, err = newDecompressor(WithDecompressMultistream(false))
+			require.NoError(t, err)
+			got, err = ioutil.ReadAll(d)
+			require.NoError(t, err)
+			require.Equal(t, "hello, ", string(got))
+			require.NoError(t, d.Close())
+
+			// size limit
+			d, err = newDecompressor(WithDecompressMaxSizeByte(12))
+			require.NoError(t, err)
+			got, err = ioutil.ReadAll(d)
+			require.NoError(t, err)
+			require.Equal(t, "hello, world", string(got))
+
+			d, err = newDecompressor(WithDecompressMaxSizeByte(5))
+			require.NoError(t, err)
+			got, err = ioutil.ReadAll(d)
+			require.Equal(t, ErrDecompressSizeExceeded, errors.Cause(err))
+			require.Equal(t, "hello", string(got))
+		})
+	}
+}
+
+func TestNewDecompressor(t *testing.T) {
+	_, err := NewDecompressor(strings.NewReader("plain text"))
+	require.Equal(t, ErrUnknownCompressFormat, errors.Cause(err))
+
+	_, err = NewDecompressor(strings.NewReader(""))
+	require.Equal(t, ErrUnknownCompressFormat, errors.Cause(err))
+
+	_, err = NewDecompressor(strings.NewReader(""), WithDecompressMaxSizeByte(-1))
+	require.Error(t, err)
+
+	require.Equal(t, CompressFormatGzip, DetectCompressFormat([]byte{0x1f, 0x8b, 0x08}))
+	require.Equal(t, CompressFormatBzip2, DetectCompressFormat([]byte("BZh91AY")))
+	require.Equal(t, CompressFormatUnknown, DetectCompressFormat([]byte{0x1f}))
+}
@@ -0,0 +1,775 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDistributedLockTTL            = 10 * time.Second
+	defaultDistributedLockRetryInterval  = 100 * time.Millisecond
+	defaultDistributedLockReleaseTimeout = 5 * time.Second
+	// defaultMemoryDistributedLockPruneInterval interval to remove expired locks
+	defaultMemoryDistributedLockPruneInterval = time.Minute
+)
+
+var (
+	// ErrLockNotHeld lock is not held by owner, or its lease has expired
+	ErrLockNotHeld = errors.New("lock not held")
+
+	// errNoUpdate skip saving state in FileDistributedLockBackend
+	errNoUpdate = errors.New("no update")
+
+	distributedLockNameRegexp = regexp.MustCompile(`^[\w.-]+$`)
+)
+
+// DistributedLockLease lease of lock held by owner
+type DistributedLockLease struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	// Token fencing token, increases every time the lock is acquired,
+	// resources protected by lock should reject requests with older token.
+	Token     uint64    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DistributedLockBackend storage of leased locks
+//
+// lease expiration depends on the clock of backend,
+// clocks of all clients that share one file backend should be synchronized.
+type DistributedLockBackend interface {
+	// TryAcquire acquire lock if it is free or its lease has expired,
+	// return nil lease if lock is held by others.
+	TryAcquire(ctx context.Context, name, owner string, ttl time.Duration) (*DistributedLockLease, error)
+	// Renew extend lease to ttl from now,
+	// return ErrLockNotHeld if lock is not held by owner with token.
+	Renew(ctx context.Context, name, owner string, token uint64, ttl time.Duration) (*DistributedLockLease, error)
+	// Release release lock,
+	// return ErrLockNotHeld if lock is not held by owner with token.
+	Release(ctx context.Context, name, owner string, token uint64) error
+}
+
+// DistributedLock lock shared by processes or hosts
+type DistributedLock interface {
+	// Acquire block until acquired lock or ctx done,
+	// lease will be renewed automatically until ctx done or released.
+	Acquire(ctx context.Context, name string) (*LeasedLock, error)
+	// TryAcquire return nil if lock is held by others,
+	// lease will be renewed automatically until ctx done or released.
+	TryAcquire(ctx context.Context, name string) (*LeasedLock, error)
+}
+
+type distributedLockOption struct {
+	owner string
+	ttl,
+	renewInterval,
+	retryInterval time.Duration
+}
+
+// DistributedLockOptFunc options for DistributedLock
+type DistributedLockOptFunc func(*distributedLockOption) error
+
+// WithDistributedLockOwner set owner of lock,
+// default to `<hostname>-<pid>-<random>`.
+//
+// locks are not reentrant, lock held by owner cannot be acquired again by itself.
+func WithDistributedLockOwner(owner string) DistributedLockOptFunc {
+	return func(opt *distributedLockOption) error {
+		if owner == "" {
+			return errors.Errorf("owner cannot be empty")
+		}
+
+		opt.owner = owner
+		return nil
+	}
+}
+
+// WithDistributedLockTTL set lease duration of each acquire and renewal,
+// default to 10s.
+func WithDistributedLockTTL(ttl time.Duration) DistributedLockOptFunc {
+	return func(opt *distributedLockOption) error {
+		if ttl < 100*time.Millisecond {
+			return errors.Errorf("ttl should not less than 100ms, got %s", ttl)
+		}
+
+		opt.ttl = ttl
+		return nil
+	}
+}
+
+// WithDistributedLockRenewInterval set how often to renew lease,
+// default to 1/3 of ttl, should less than ttl.
+func WithDistributedLockRenewInterval(interval time.Duration) DistributedLockOptFunc {
+	return func(opt *distributedLockOption) error {
+		if interval <= 0 {
+			return errors.Errorf("renew interval should greater than 0, got %s", interval)
+		}
+
+		opt.renewInterval = interval
+		return nil
+	}
+}
+
+// WithDistributedLockRetryInterval set how often to retry when lock is held by others,
+// default to 100ms.
+func WithDistributedLockRetryInterval(interval time.Duration) DistributedLockOptFunc {
+	return func(opt *distributedLockOption) error {
+		if interval <= 0 {
+			return errors.Errorf("retry interval should greater than 0, got %s", interval)
+		}
+
+		opt.retryInterval = interval
+		return nil
+	}
+}
+
+type distributedLock struct {
+	*distributedLockOption
+	backend DistributedLockBackend
+}
+
+// NewDistributedLock create DistributedLock by backend
+func NewDistributedLock(backend DistributedLockBackend, opts ...DistributedLockOptFunc) (DistributedLock, error) {
+	if backend == nil {
+		return nil, errors.Errorf("backend cannot be nil")
+	}
+
+	opt := &distributedLockOption{
+		ttl:           defaultDistributedLockTTL,
+		retryInterval: defaultDistributedLockRetryInterval,
+	}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	if opt.owner == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, errors.Wrap(err, "get hostname")
+		}
+
+		opt.owner = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), RandomStringWithLength(8))
+	}
+	if opt.renewInterval == 0 {
+		opt.renewInterval = opt.ttl / 3
+	}
+	if opt.renewInterval >= opt.ttl {
+		return nil, errors.Errorf("renew interval `%s` should less than ttl `%s`", opt.renewInterval, opt.ttl)
+	}
+
+	return &distributedLock{
+		distributedLockOption: opt,
+		backend:               backend,
+	}, nil
+}
+
+func (d *distributedLock) Acquire(ctx context.Context, name string) (*LeasedLock, error) {
+	var timer *time.Timer
+	for {
+		l, err := d.TryAcquire(ctx, name)
+		if err != nil && ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "wait lock `%s`", name)
+		}
+		if err != nil || l != nil {
+			return l, err
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(d.retryInterval)
+			defer timer.Stop()
+		} else {
+			timer.Reset(d.retryInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "wait lock `%s`", name)
+		case <-timer.C:
+		}
+	}
+}
+
+func (d *distributedLock) TryAcquire(ctx context.Context, name string) (*LeasedLock, error) {
+	lease, err := d.backend.TryAcquire(ctx, name, d.owner, d.ttl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "acquire lock `%s`", name)
+	}
+	if lease == nil {
+		return nil, nil
+	}
+
+	l := &LeasedLock{
+		lock:      d,
+		name:      lease.Name,
+		owner:     lease.Owner,
+		token:     lease.Token,
+		expiresAt: lease.ExpiresAt,
+		stopped:   make(chan struct{}),
+	}
+	ctx, l.cancel = context.WithCancel(ctx)
+	go l.keepalive(ctx)
+	return l, nil
+}
+
+// LeasedLock lock acquired from DistributedLock
+type LeasedLock struct {
+	lock   *distributedLock
+	cancel context.CancelFunc
+	name,
+	owner string
+	token uint64
+
+	mu        sync.RWMutex
+	expiresAt time.Time
+	// err why lease is not renewed any more
+	err      error
+	released bool
+	stopped  chan struct{}
+}
+
+// Name name of lock
+func (l *LeasedLock) Name() string {
+	return l.name
+}
+
+// Token fencing token of lease
+func (l *LeasedLock) Token() uint64 {
+	return l.token
+}
+
+// Lease current lease of lock
+func (l *LeasedLock) Lease() DistributedLockLease {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return DistributedLockLease{
+		Name:      l.name,
+		Owner:     l.owner,
+		Token:     l.token,
+		ExpiresAt: l.expiresAt,
+	}
+}
+
+// Done closed when lock is released or lost
+func (l *LeasedLock) Done() <-chan struct{} {
+	return l.stopped
+}
+
+// Err return ErrLockNotHeld if lease is lost,
+// or ctx's error if lock is released by ctx done.
+//
+// return nil if lock is still held or released by Release.
+func (l *LeasedLock) Err() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.err
+}
+
+// Release stop renewal and release lock,
+// return ErrLockNotHeld if lease has been lost before.
+func (l *LeasedLock) Release() error {
+	l.mu.Lock()
+	l.released = true
+	l.mu.Unlock()
+	l.cancel()
+	<-l.stopped
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.err != nil && errors.Cause(l.err) == ErrLockNotHeld {
+		return l.err
+	}
+
+	return nil
+}
+
+func (l *LeasedLock) stop(err error) {
+	l.mu.Lock()
+	l.err = err
+	l.mu.Unlock()
+	close(l.stopped)
+}
+
+// keepalive renew lease until ctx done, then release lock
+func (l *LeasedLock) keepalive(ctx context.Context) {
+	ticker := time.NewTicker(l.lock.renewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			rctx, cancel := context.WithTimeout(context.Background(), defaultDistributedLockReleaseTimeout)
+			err := l.lock.backend.Release(rctx, l.name, l.owner, l.token)
+			cancel()
+			if err != nil {
+				Logger.Warn("release lock", zap.String("name", l.name), zap.Error(err))
+			}
+			if errors.Cause(err) == ErrLockNotHeld {
+				l.stop(errors.Wrapf(err, "release lock `%s`", l.name))
+				return
+			}
+
+			// ctx canceled by Release is not an error
+			l.mu.RLock()
+			released := l.released
+			l.mu.RUnlock()
+			if released {
+				l.stop(nil)
+			} else {
+				l.stop(ctx.Err())
+			}
+			return
+		case <-ticker.C:
+		}
+
+		lease, err := l.lock.backend.Renew(ctx, l.name, l.owner, l.token, l.lock.ttl)
+		if err == nil {
+			l.mu.Lock()
+			l.expiresAt = lease.ExpiresAt
+			l.mu.Unlock()
+			continue
+		}
+		if ctx.Err() != nil {
+			continue
+		}
+
+		l.mu.RLock()
+		expired := !Clock.GetUTCNow().Before(l.expiresAt)
+		l.mu.RUnlock()
+		if errors.Cause(err) == ErrLockNotHeld || expired {
+			Logger.Error("lost lock", zap.String("name", l.name), zap.Error(err))
+			l.stop(errors.Wrapf(ErrLockNotHeld, "renew lock `%s`: %v", l.name, err))
+			return
+		}
+
+		// retry until lease expired
+		Logger.Warn("renew lock", zap.String("name", l.name), zap.Error(err))
+	}
+}
+
+type distributedLockState struct {
+	Owner     string    `json:"owner"`
+	Token     uint64    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *distributedLockState) isHeldBy(owner string, token uint64, now time.Time) bool {
+	return s.Owner != "" && s.Owner == owner && s.Token == token && now.Before(s.ExpiresAt)
+}
+
+// tryAcquire update state if lock is free or expired
+func (s *distributedLockState) tryAcquire(name, owner string, ttl time.Duration) *DistributedLockLease {
+	now := Clock.GetUTCNow()
+	if s.Owner != "" && now.Before(s.ExpiresAt) {
+		return nil
+	}
+
+	s.Owner = owner
+	s.Token++
+	s.ExpiresAt = now.Add(ttl)
+	return s.lease(name)
+}
+
+func (s *distributedLockState) renew(name, owner string, token uint64, ttl time.Duration) (*DistributedLockLease, error) {
+	now := Clock.GetUTCNow()
+	if !s.isHeldBy(owner, token, now) {
+		return nil, ErrLockNotHeld
+	}
+
+	s.ExpiresAt = now.Add(ttl)
+	return s.lease(name), nil
+}
+
+func (s *distributedLockState) release(owner string, token uint64) error {
+	if !s.isHeldBy(owner, token, Clock.GetUTCNow()) {
+		return ErrLockNotHeld
+	}
+
+	// keep token to make sure it always increases
+	s.Owner = ""
+	s.ExpiresAt = time.Time{}
+	return nil
+}
+
+func (s *distributedLockState) lease(name string) *DistributedLockLease {
+	return &DistributedLockLease{
+		Name:      name,
+		Owner:     s.Owner,
+		Token:     s.Token,
+		ExpiresAt: s.ExpiresAt,
+	}
+}
+
+// MemoryDistributedLockBackend in-memory DistributedLockBackend,
+// only works in one process, can be used for tests or served by DistributedLockServer.
+//
+// released locks are removed immediately, expired locks are removed periodically.
+type MemoryDistributedLockBackend struct {
+	mu    sync.Mutex
+	locks map[string]*distributedLockState
+	// lastToken max token ever issued, new lock starts from it
+	// to make sure token always increases after lock removed
+	lastToken uint64
+	prunedAt  time.Time
+}
+
+// NewMemoryDistributedLockBackend new in-memory backend
+func NewMemoryDistributedLockBackend() *MemoryDistributedLockBackend {
+	return &MemoryDistributedLockBackend{
+		locks:    map[string]*distributedLockState{},
+		prunedAt: Clock.GetUTCNow(),
+	}
+}
+
+// prune remove expired locks, at most once per interval
+func (b *MemoryDistributedLockBackend) prune() {
+	now := Clock.GetUTCNow()
+	if now.Sub(b.prunedAt) < defaultMemoryDistributedLockPruneInterval {
+		return
+	}
+
+	b.prunedAt = now
+	for name, s := range b.locks {
+		if !now.Before(s.ExpiresAt) {
+			delete(b.locks, name)
+		}
+	}
+}
+
+// TryAcquire acquire lock if it is free or its lease has expired
+func (b *MemoryDistributedLockBackend) TryAcquire(_ context.Context, name, owner string, ttl time.Duration) (*DistributedLockLease, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune()
+
+	s, ok := b.locks[name]
+	if !ok {
+		s = &distributedLockState{Token: b.lastToken}
+	}
+
+	lease := s.tryAcquire(name, owner, ttl)
+	if lease != nil {
+		b.locks[name] = s
+		if lease.Token > b.lastToken {
+			b.lastToken = lease.Token
+		}
+	}
+
+	return lease, nil
+}
+
+// Renew extend lease to ttl from now
+func (b *MemoryDistributedLockBackend) Renew(_ context.Context, name, owner string, token uint64, ttl time.Duration) (*DistributedLockLease, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.locks[name]
+	if !ok {
+		return nil, ErrLockNotHeld
+	}
+
+	return s.renew(name, owner, token, ttl)
+}
+
+// Release release lock
+func (b *MemoryDistributedLockBackend) Release(_ context.Context, name, owner string, token uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.locks[name]
+	if !ok {
+		return ErrLockNotHeld
+	}
+	if err := s.release(owner, token); err != nil {
+		return err
+	}
+
+	delete(b.locks, name)
+	return nil
+}
+
+// FileDistributedLockBackend DistributedLockBackend stores leases in dir,
+// can be shared by processes on the same host or via network filesystem
+// that supports fcntl locks.
+//
+// for each lock, `<name>.lock` is locked by FLock when updating `<name>.lease`.
+type FileDistributedLockBackend struct {
+	// mu FLock does not exclude goroutines in the same process
+	mu  sync.Mutex
+	dir string
+}
+
+// NewFileDistributedLockBackend new backend stores leases in dir
+func NewFileDistributedLockBackend(dir string) (*FileDistributedLockBackend, error) {
+	if ok, err := IsDir(dir); err != nil {
+		return nil, errors.Wrapf(err, "get stat of `%s`", dir)
+	} else if !ok {
+		return nil, errors.Errorf("`%s` is not dir", dir)
+	}
+
+	return &FileDistributedLockBackend{
+		dir: dir,
+	}, nil
+}
+
+// update load state of lock, call fn, then save state if fn succeed
+func (b *FileDistributedLockBackend) update(ctx context.Context, name string, fn func(*distributedLockState) error) (err error) {
+	if !distributedLockNameRegexp.MatchString(name) || strings.Trim(name, ".") == "" {
+		return errors.Errorf("invalid lock name `%s`", name)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fl := NewFlock(filepath.Join(b.dir, name+".lock"))
+	if err = fl.LockCtx(ctx); err != nil {
+		return errors.Wrapf(err, "lock `%s`", name)
+	}
+	defer func() {
+		if uerr := fl.Unlock(); uerr != nil && err == nil {
+			err = errors.Wrapf(uerr, "unlock `%s`", name)
+		}
+	}()
+
+	fpath := filepath.Join(b.dir, name+".lease")
+	state := new(distributedLockState)
+	cnt, err := ioutil.ReadFile(fpath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return errors.Wrapf(err, "read `%s`", fpath)
+	default:
+		if err = json.Unmarshal(cnt, state); err != nil {
+			return errors.Wrapf(err, "unmarshal `%s`", fpath)
+		}
+	}
+
+	if err = fn(state); err != nil {
+		return err
+	}
+
+	if cnt, err = json.Marshal(state); err != nil {
+		return errors.Wrap(err, "marshal lease")
+	}
+	if err = WriteFileAtomic(fpath, cnt, 0644); err != nil {
+		return errors.Wrapf(err, "write `%s`", fpath)
+	}
+
+	return nil
+}
+
+// TryAcquire acquire lock if it is free or its lease has expired
+func (b *FileDistributedLockBackend) TryAcquire(ctx context.Context, name, owner string, ttl time.Duration) (lease *DistributedLockLease, err error) {
+	err = b.update(ctx, name, func(s *distributedLockState) error {
+		if lease = s.tryAcquire(name, owner, ttl); lease == nil {
+			// nothing changed, skip saving
+			return errNoUpdate
+		}
+
+		return nil
+	})
+	if err == errNoUpdate {
+		return nil, nil
+	}
+
+	return lease, err
+}
+
+// Renew extend lease to ttl from now
+func (b *FileDistributedLockBackend) Renew(ctx context.Context, name, owner string, token uint64, ttl time.Duration) (lease *DistributedLockLease, err error) {
+	err = b.update(ctx, name, func(s *distributedLockState) (err error) {
+		lease, err = s.renew(name, owner, token, ttl)
+		return err
+	})
+	return lease, err
+}
+
+// Release release lock
+func (b *FileDistributedLockBackend) Release(ctx context.Context, name, owner string, token uint64) error {
+	return b.update(ctx, name, func(s *distributedLockState) error {
+		return s.release(owner, token)
+	})
+}
+
+type distributedLockRequest struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	Token uint64 `json:"token,omitempty"`
+	// TTLMs ttl in milliseconds
+	TTLMs int64 `json:"ttl_ms,omitempty"`
+}
+
+type distributedLockResponse struct {
+	Lease *DistributedLockLease `json:"lease"`
+	Error string                `json:"error,omitempty"`
+}
+
+// NewDistributedLockServer serve backend by HTTP for HTTPDistributedLockBackend,
+// routes are `POST /acquire`, `POST /renew` and `POST /release`,
+// use `http.StripPrefix` to mount it under a prefix.
+//
+// ErrLockNotHeld is responded with status 409.
+func NewDistributedLockServer(backend DistributedLockBackend) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(path string, fn func(ctx context.Context, req *distributedLockRequest) (*DistributedLockLease, error)) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				writeDistributedLockResponse(w, http.StatusMethodNotAllowed, nil, errors.Errorf("method not allowed"))
+				return
+			}
+
+			req := new(distributedLockRequest)
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				writeDistributedLockResponse(w, http.StatusBadRequest, nil, errors.Wrap(err, "decode request"))
+				return
+			}
+			if req.Name == "" || req.Owner == "" {
+				writeDistributedLockResponse(w, http.StatusBadRequest, nil, errors.Errorf("name and owner are required"))
+				return
+			}
+
+			lease, err := fn(r.Context(), req)
+			switch {
+			case err == nil:
+				writeDistributedLockResponse(w, http.StatusOK, lease, nil)
+			case errors.Cause(err) == ErrLockNotHeld:
+				writeDistributedLockResponse(w, http.StatusConflict, nil, err)
+			default:
+				Logger.Error("handle lock request", zap.String("path", path), zap.String("name", req.Name), zap.Error(err))
+				writeDistributedLockResponse(w, http.StatusInternalServerError, nil, err)
+			}
+		})
+	}
+
+	handle("/acquire", func(ctx context.Context, req *distributedLockRequest) (*DistributedLockLease, error) {
+		if req.TTLMs <= 0 {
+			return nil, errors.Errorf("ttl should greater than 0")
+		}
+
+		return backend.TryAcquire(ctx, req.Name, req.Owner, time.Duration(req.TTLMs)*time.Millisecond)
+	})
+	handle("/renew", func(ctx context.Context, req *distributedLockRequest) (*DistributedLockLease, error) {
+		if req.TTLMs <= 0 {
+			return nil, errors.Errorf("ttl should greater than 0")
+		}
+
+		return backend.Renew(ctx, req.Name, req.Owner, req.Token, time.Duration(req.TTLMs)*time.Millisecond)
+	})
+	handle("/release", func(ctx context.Context, req *distributedLockRequest) (*DistributedLockLease, error) {
+		return nil, backend.Release(ctx, req.Name, req.Owner, req.Token)
+	})
+
+	return mux
+}
+
+func writeDistributedLockResponse(w http.ResponseWriter, status int, lease *DistributedLockLease, err error) {
+	resp := &distributedLockResponse{Lease: lease}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	w.Header().Set(HTTPHeaderContentType, HTTPHeaderContentTypeValJSON)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		Logger.Warn("write lock response", zap.Error(err))
+	}
+}
+
+// HTTPDistributedLockBackend DistributedLockBackend served by DistributedLockServer
+type HTTPDistributedLockBackend struct {
+	api string
+	cli *http.Client
+}
+
+// NewHTTPDistributedLockBackend new backend request DistributedLockServer at api,
+// like `http://127.0.0.1:8080/lock`.
+//
+// DistributedLockServer registers routes at root path, so if it is mounted under
+// a prefix like `/lock/`, wrap it by `http.StripPrefix("/lock", srv)`.
+func NewHTTPDistributedLockBackend(api string, opts ...HTTPClientOptFunc) (*HTTPDistributedLockBackend, error) {
+	cli, err := NewHTTPClient(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "new http client")
+	}
+
+	return &HTTPDistributedLockBackend{
+		api: strings.TrimSuffix(api, "/"),
+		cli: cli,
+	}, nil
+}
+
+func (b *HTTPDistributedLockBackend) request(ctx context.Context, path string, data *distributedLockRequest) (*DistributedLockLease, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal request")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, b.api+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(HTTPHeaderContentType, HTTPHeaderContentTypeValJSON)
+
+	r, err := b.cli.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "request `%s`", req.URL)
+	}
+	defer CloseQuietly(r.Body)
+
+	resp := new(distributedLockResponse)
+	if err = json.NewDecoder(r.Body).Decode(resp); err != nil {
+		return nil, errors.Wrapf(err, "decode response with status %d", r.StatusCode)
+	}
+
+	switch r.StatusCode {
+	case http.StatusOK:
+		return resp.Lease, nil
+	case http.StatusConflict:
+		return nil, errors.Wrap(ErrLockNotHeld, resp.Error)
+	default:
+		return nil, errors.Errorf("server responded status %d: %s", r.StatusCode, resp.Error)
+	}
+}
+
+// TryAcquire acquire lock if it is free or its lease has expired
+func (b *HTTPDistributedLockBackend) TryAcquire(ctx context.Context, name, owner string, ttl time.Duration) (*DistributedLockLease, error) {
+	return b.request(ctx, "/acquire", &distributedLockRequest{
+		Name:  name,
+		Owner: owner,
+		TTLMs: ttl.Milliseconds(),
+	})
+}
+
+// Renew extend lease to ttl from now
+func (b *HTTPDistributedLockBackend) Renew(ctx context.Context, name, owner string, token uint64, ttl time.Duration) (*DistributedLockLease, error) {
+	return b.request(ctx, "/renew", &distributedLockRequest{
+		Name:  name,
+		Owner: owner,
+		Token: token,
+		TTLMs: ttl.Milliseconds(),
+	})
+}
+
+// Release release lock
+func (b *HTTPDistributedLockBackend) Release(ctx context.Context, name, owner string, token uint64) error {
+	_, err := b.request(ctx, "/release", &distributedLockRequest{
+		Name:  name,
+		Owner: owner,
+		Token: token,
+	})
+	return err
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistributedLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributed-lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fileBackend, err := NewFileDistributedLockBackend(dir)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewDistributedLockServer(NewMemoryDistributedLockBackend()))
+	defer srv.Close()
+	httpBackend, err := NewHTTPDistributedLockBackend(srv.URL)
+	require.NoError(t, err)
+
+	for name, backend := range map[string]DistributedLockBackend{
+		"memory": NewMemoryDistributedLockBackend(),
+		"file":   fileBackend,
+		"http":   httpBackend,
+	} {
+		backend := backend
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			newLock := func(owner string) DistributedLock {
+				l, err := NewDistributedLock(backend,
+					WithDistributedLockOwner(owner),
+					WithDistributedLockTTL(300*time.Millisecond),
+					WithDistributedLockRetryInterval(10*time.Millisecond),
+				)
+				require.NoError(t, err)
+				return l
+			}
+			la, lb := newLock("a"), newLock("b")
+
+			a, err := la.Acquire(ctx, "job")
+			require.NoError(t, err)
+			require.Equal(t, "job", a.Name())
+
+			// not reentrant
+			l, err := la.TryAcquire(ctx, "job")
+			require.NoError(t, err)
+			require.Nil(t, l)
+
+			// lease is renewed automatically
+			time.Sleep(500 * time.Millisecond)
+			wctx, wcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			_, err = lb.Acquire(wctx, "job")
+			wcancel()
+			require.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+			require.True(t, a.Lease().ExpiresAt.After(Clock.GetUTCNow()))
+
+			require.NoError(t, a.Release())
+			require.NoError(t, a.Err())
+			<-a.Done()
+
+			// token increases
+			bctx, bcancel := context.WithCancel(ctx)
+			b, err := lb.Acquire(bctx, "job")
+			require.NoError(t, err)
+			require.Greater(t, b.Token(), a.Token())
+
+			// released when ctx done
+			bcancel()
+			<-b.Done()
+			require.Equal(t, context.Canceled, b.Err())
+			a, err = la.Acquire(ctx, "job")
+			require.NoError(t, err)
+			require.Greater(t, a.Token(), b.Token())
+
+			// lease lost
+			lease := a.Lease()
+			require.NoError(t, backend.Release(ctx, lease.Name, lease.Owner, lease.Token))
+			select {
+			case <-a.Done():
+			case <-time.After(time.Second):
+				t.Fatal("lost lease not detected")
+			}
+			require.Equal(t, ErrLockNotHeld, errors.Cause(a.Err()))
+			require.Equal(t, ErrLockNotHeld, errors.Cause(a.Release()))
+			require.Equal(t, ErrLockNotHeld,
+				errors.Cause(backend.Release(ctx, lease.Name, lease.Owner, lease.Token)))
+		})
+	}
+
+	t.Run("memory prune", func(t *testing.T) {
+		ctx := context.Background()
+		backend := NewMemoryDistributedLockBackend()
+		lease, err := backend.TryAcquire(ctx, "a", "x", time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, backend.Release(ctx, "a", "x", lease.Token))
+		require.Len(t, backend.locks, 0)
+
+		// token still increases after removed
+		lease2, err := backend.TryAcquire(ctx, "a", "x", 10*time.Millisecond)
+		require.NoError(t, err)
+		require.Greater(t, lease2.Token, lease.Token)
+
+		time.Sleep(50 * time.Millisecond)
+		backend.prunedAt = time.Time{}
+		_, err = backend.TryAcquire(ctx, "b", "x", time.Minute)
+		require.NoError(t, err)
+		require.Len(t, backend.locks, 1)
+		require.Equal(t, ErrLockNotHeld, errors.Cause(backend.Release(ctx, "a", "x", lease2.Token)))
+	})
+
+	t.Run("mounted under prefix", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.Handle("/lock/", http.StripPrefix("/lock", NewDistributedLockServer(NewMemoryDistributedLockBackend())))
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+
+		backend, err := NewHTTPDistributedLockBackend(srv.URL + "/lock/")
+		require.NoError(t, err)
+		lease, err := backend.TryAcquire(context.Background(), "job", "a", time.Second)
+		require.NoError(t, err)
+		require.NotNil(t, lease)
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		_, err := fileBackend.TryAcquire(context.Background(), "../job", "a", time.Second)
+		require.Error(t, err)
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/acquire")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+		_, err = httpBackend.TryAcquire(context.Background(), "job", "", time.Second)
+		require.Error(t, err)
+	})
+}
@@ -5,22 +5,31 @@
 // Contains some useful tools in different directories:
 //
 //   * `color.go`: colorful code
-//   * `compressor.go`: compress and extract dir/files
+//   * `compressor.go`: compress and extract dir/files, streaming compressors for gzip/pgzip/zstd/s2/snappy/lz4/brotli
 //   * `configserver.go`: load configs from file or config-server
+//   * `decompressor.go`: streaming decompressors for all compressors and bzip2, detect format by magic bytes
+//   * `distributed_lock.go`: leased distributed locks with fencing token, by memory, file or HTTP backend
 //   * `email.go`: SMTP email sdk
 //   * `encrypt.go`: some tools for encrypt and decrypt,
 //                   support AES, RSA, ECDSA, MD5, SHA128, SHA256
+//   * `filesystem.go`: abstract filesystem interface with os and in-memory implementations
 //   * `fs.go`: some tools to read, move, walk dir/files
+//   * `hash.go`: calculate multiple digests in one pass, support MD5, SHA1, SHA256, SHA512, xxhash, CRC32, HMAC
 //   * `http.go`: some tools to send http request
+//   * `janitor.go`: keep data dir under size, files or ttl limits by removing oldest files
 //   * `jwt.go`: some tools to generate and parse JWT
 //   * `logger.go`: enhanched zap logger
 //   * `math.go`: some math tools to deal with int, round
 //   * `net.go`: some tools to deal with tcp/udp
 //   * `random.go`: generate random string, int
+//   * `rotate_writer.go`: write data via compressor into files that roll over by size, records or interval
 //   * `settings.go`: read configs from file or config-server
 //   * `sort.go`: easier to sort
 //   * `sync.go`: some locks depends on atomic
+//   * `tar.go`: archive and extract tar files, support gzip/zstd compression
 //   * `throttle.go`: faster rate limiter
 //   * `time.go`: faster clock (if you do not enable vdso)
 //   * `utils`: some useful tools
+//   * `watcher.go`: watch files changed by inotify or polling, with debouncing
+//   * `worker_pool.go`: bounded goroutine pool with autoscaling, backpressure and graceful drain
 package utils
@@ -11,6 +11,7 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/pem"
 	"io"
@@ -394,3 +395,205 @@ func (w *AesReaderWrapper) Read(p []byte) (n int, err error) {
 
 	return n + 1, nil
 }
+
+const (
+	// defaultAesStreamChunkSize size of plaintext in each chunk of aes stream
+	defaultAesStreamChunkSize = 64 * 1024
+	// aesStreamHeaderLen flag (1 byte) + length of sealed chunk (4 bytes)
+	aesStreamHeaderLen = 5
+	aesStreamFlagFinal = 1
+)
+
+// newAesGCM create gcm by secret, same as EncryptByAes
+func newAesGCM(secret []byte) (cipher.AEAD, error) {
+	if len(secret) == 0 {
+		return nil, errors.Errorf("secret is empty")
+	}
+
+	c, err := aes.NewCipher(expandAesSecret(secret))
+	if err != nil {
+		return nil, errors.Wrap(err, "new aes cipher")
+	}
+
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "new gcm")
+	}
+
+	return gcm, nil
+}
+
+// aesStreamAdditionalData bind index and flag of chunk to its tag,
+// to detect reordered or truncated chunks.
+func aesStreamAdditionalData(idx uint64, flag byte) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, idx)
+	ad[8] = flag
+	return ad
+}
+
+// AesStreamWriter encrypt stream by aes-gcm in chunks,
+// uses the same key and cipher as EncryptByAes.
+//
+// each chunk is sealed with its own random nonce and tag,
+// the last chunk is marked as final when Close is called,
+// so truncated stream can be detected by AesStreamReader.
+type AesStreamWriter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	buf    []byte
+	idx    uint64
+	closed bool
+}
+
+// NewAesStreamWriter encrypt content written into w,
+// Close must be called to flush the final chunk,
+// w will not be closed.
+func NewAesStreamWriter(w io.Writer, secret []byte) (*AesStreamWriter, error) {
+	gcm, err := newAesGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AesStreamWriter{
+		w:   w,
+		gcm: gcm,
+		buf: make([]byte, 0, defaultAesStreamChunkSize),
+	}, nil
+}
+
+// Write encrypt and write chunks when buffer is full
+func (w *AesStreamWriter) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, errors.Errorf("write to closed writer")
+	}
+
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err = w.writeChunk(0); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+func (w *AesStreamWriter) writeChunk(flag byte) error {
+	nonce := make([]byte, w.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.Wrap(err, "load nonce")
+	}
+
+	chunk := make([]byte, aesStreamHeaderLen, aesStreamHeaderLen+len(nonce)+len(w.buf)+w.gcm.Overhead())
+	chunk = append(chunk, nonce...)
+	chunk = w.gcm.Seal(chunk, nonce, w.buf, aesStreamAdditionalData(w.idx, flag))
+	chunk[0] = flag
+	binary.BigEndian.PutUint32(chunk[1:aesStreamHeaderLen], uint32(len(chunk)-aesStreamHeaderLen))
+	if _, err := w.w.Write(chunk); err != nil {
+		return errors.Wrap(err, "write chunk")
+	}
+
+	w.idx++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close write the final chunk
+func (w *AesStreamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+	return w.writeChunk(aesStreamFlagFinal)
+}
+
+// AesStreamReader decrypt stream written by AesStreamWriter
+//
+// content of each chunk is returned only after it is authenticated,
+// return error if stream is tampered or truncated.
+type AesStreamReader struct {
+	r      io.Reader
+	gcm    cipher.AEAD
+	buf    []byte
+	idx    uint64
+	header [aesStreamHeaderLen]byte
+	final  bool
+}
+
+// NewAesStreamReader decrypt content read from r
+func NewAesStreamReader(r io.Reader, secret []byte) (*AesStreamReader, error) {
+	gcm, err := newAesGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AesStreamReader{
+		r:   r,
+		gcm: gcm,
+	}, nil
+}
+
+// Read decrypt chunks into p
+func (r *AesStreamReader) Read(p []byte) (n int, err error) {
+	for len(r.buf) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+
+		if err = r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *AesStreamReader) readChunk() error {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		if err == io.EOF {
+			return errors.Wrap(io.ErrUnexpectedEOF, "stream truncated")
+		}
+
+		return errors.Wrap(err, "read chunk header")
+	}
+
+	flag := r.header[0]
+	size := int(binary.BigEndian.Uint32(r.header[1:]))
+	nonceSize := r.gcm.NonceSize()
+	if flag&^aesStreamFlagFinal != 0 ||
+		size < nonceSize+r.gcm.Overhead() ||
+		size > nonceSize+r.gcm.Overhead()+defaultAesStreamChunkSize {
+		return errors.Errorf("invalid chunk header")
+	}
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(r.r, chunk); err != nil {
+		return errors.Wrap(err, "read chunk")
+	}
+
+	plaintext, err := r.gcm.Open(chunk[nonceSize:nonceSize], chunk[:nonceSize], chunk[nonceSize:],
+		aesStreamAdditionalData(r.idx, flag))
+	if err != nil {
+		return errors.Wrap(err, "gcm decrypt")
+	}
+
+	if flag == aesStreamFlagFinal {
+		if n, _ := r.r.Read(r.header[:1]); n != 0 {
+			return errors.Errorf("unexpected data after final chunk")
+		}
+		r.final = true
+	}
+
+	r.idx++
+	r.buf = plaintext
+	return nil
+}
@@ -14,6 +14,7 @@ import (
 	"testing"
 
 	"github.com/Laisky/zap"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -487,6 +488,68 @@ func TestNewAesReaderWrapper(t *testing.T) {
 	}
 }
 
+func TestAesStream(t *testing.T) {
+	secret := []byte("fjefil2j3i2lfj32fl")
+	encrypt := func(raw []byte) []byte {
+		var buf bytes.Buffer
+		w, err := NewAesStreamWriter(&buf, secret)
+		require.NoError(t, err)
+		// write in small pieces
+		for i := 0; i < len(raw); i += 1000 {
+			end := i + 1000
+			if end > len(raw) {
+				end = len(raw)
+			}
+			_, err = w.Write(raw[i:end])
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+	decrypt := func(cipher []byte, secret []byte) ([]byte, error) {
+		r, err := NewAesStreamReader(bytes.NewReader(cipher), secret)
+		require.NoError(t, err)
+		return ioutil.ReadAll(r)
+	}
+
+	for _, size := range []int{0, 1, defaultAesStreamChunkSize, 2*defaultAesStreamChunkSize + 3} {
+		raw := []byte(RandomStringWithLength(size))
+		got, err := decrypt(encrypt(raw), secret)
+		require.NoError(t, err)
+		require.Equal(t, raw, got)
+	}
+
+	raw := []byte(RandomStringWithLength(2*defaultAesStreamChunkSize + 3))
+	cipher := encrypt(raw)
+
+	_, err := decrypt(cipher, []byte("wrong secret"))
+	require.Error(t, err)
+
+	// truncated at chunk boundary
+	chunkLen := aesStreamHeaderLen + 12 + defaultAesStreamChunkSize + 16
+	_, err = decrypt(cipher[:2*chunkLen], secret)
+	require.Error(t, err)
+	_, err = decrypt(cipher[:len(cipher)-1], secret)
+	require.Error(t, err)
+
+	// reordered
+	reordered := append([]byte{}, cipher[chunkLen:2*chunkLen]...)
+	reordered = append(reordered, cipher[:chunkLen]...)
+	reordered = append(reordered, cipher[2*chunkLen:]...)
+	_, err = decrypt(reordered, secret)
+	require.Error(t, err)
+
+	// tampered
+	tampered := append([]byte{}, cipher...)
+	tampered[len(tampered)/2]++
+	_, err = decrypt(tampered, secret)
+	require.Error(t, err)
+
+	// trailing data
+	_, err = decrypt(append(append([]byte{}, cipher...), 'a'), secret)
+	require.Error(t, err)
+}
+
 func Test_expandAesSecret(t *testing.T) {
 	type args struct {
 		secret []byte
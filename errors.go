@@ -1,8 +1,43 @@
 package utils
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 // HTTPInvalidStatusError return error about status code
 func HTTPInvalidStatusError(statusCode int) error {
 	return errors.Errorf("got http invalid status code `%d`", statusCode)
 }
+
+// MultiError errors of multiple tasks
+type MultiError struct {
+	// Errors errors of failed tasks, indexed by task,
+	// nil means task succeed.
+	Errors []error
+}
+
+// NewMultiError return nil if all errs are nil
+func NewMultiError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return &MultiError{Errors: errs}
+		}
+	}
+
+	return nil
+}
+
+// Error messages of all failed tasks
+func (e *MultiError) Error() string {
+	var msgs []string
+	for i, err := range e.Errors {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("[%d] %s", i, err.Error()))
+		}
+	}
+
+	return fmt.Sprintf("%d of %d tasks failed: %s", len(msgs), len(e.Errors), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,733 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// File file opened by FS, *os.File implements it
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+// FS abstract filesystem used by fs helpers and archive functions,
+// methods have the same semantics as functions in `os`.
+//
+// OSFS is the default implementation, MemFS is an in-memory implementation.
+type FS interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	// ReadDir read entries in dir sorted by name, entries are not followed if symlinks
+	ReadDir(name string) ([]os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Link(oldname, newname string) error
+}
+
+// OSFS filesystem of operating system
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer CloseQuietly(fp)
+
+	fs, err := fp.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(fs, func(i, j int) bool {
+		return fs[i].Name() < fs[j].Name()
+	})
+	return fs, nil
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (osFS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (osFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+// walkFS walk files and dirs in root like `filepath.Walk`
+func walkFS(fsys FS, root string, fn filepath.WalkFunc) error {
+	finfo, err := fsys.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkFSEntry(fsys, root, finfo, fn)
+	}
+
+	if err == filepath.SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+func walkFSEntry(fsys FS, fpath string, finfo os.FileInfo, fn filepath.WalkFunc) error {
+	if !finfo.IsDir() {
+		return fn(fpath, finfo, nil)
+	}
+
+	fs, err := fsys.ReadDir(fpath)
+	err1 := fn(fpath, finfo, err)
+	// skip dir if failed to read it
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, child := range fs {
+		if err = walkFSEntry(fsys, filepath.Join(fpath, child.Name()), child, fn); err != nil {
+			if !child.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// =====================================
+// MemFS
+// =====================================
+
+const memFSMaxLinkDepth = 40
+
+// MemFS in-memory filesystem, all paths are slash-separated under `/`,
+// relative paths are relative to `/`.
+//
+// umask is not applied.
+type MemFS struct {
+	mu    sync.RWMutex
+	nodes map[string]*memFSNode
+}
+
+type memFSNode struct {
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+	// link target of symlink
+	link string
+}
+
+// NewMemFS create new empty MemFS
+func NewMemFS() *MemFS {
+	return &MemFS{
+		nodes: map[string]*memFSNode{
+			"/": {mode: os.ModeDir | 0755, modTime: Clock.GetUTCNow()},
+		},
+	}
+}
+
+func memFSClean(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+func memFSPathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve get real path of name by following symlinks, need lock
+func (m *MemFS) resolve(name string) (string, *memFSNode, error) {
+	hops := 0
+	return m.resolveHops(name, &hops)
+}
+
+// resolveHops resolve name, hops is the number of symlinks followed
+func (m *MemFS) resolveHops(name string, hops *int) (string, *memFSNode, error) {
+	p := memFSClean(name)
+	for {
+		// parents may be symlinks too
+		dir, base := path.Split(p)
+		if dir != "/" {
+			realDir, parent, err := m.resolveHops(dir, hops)
+			if err != nil {
+				return p, nil, err
+			}
+			if !parent.mode.IsDir() {
+				return p, nil, errors.New("not a directory")
+			}
+
+			p = path.Join(realDir, base)
+		}
+
+		node, ok := m.nodes[p]
+		if !ok {
+			return p, nil, os.ErrNotExist
+		}
+		if node.mode&os.ModeSymlink == 0 {
+			return p, node, nil
+		}
+
+		if *hops++; *hops > memFSMaxLinkDepth {
+			return p, nil, errors.New("too many levels of symbolic links")
+		}
+		if path.IsAbs(node.link) {
+			p = path.Clean(node.link)
+		} else {
+			p = path.Join(path.Dir(p), node.link)
+		}
+	}
+}
+
+// lresolve like resolve, but do not follow the last element, need lock
+func (m *MemFS) lresolve(name string) (string, *memFSNode, error) {
+	p := memFSClean(name)
+	if p == "/" {
+		return p, m.nodes[p], nil
+	}
+
+	dir, base := path.Split(p)
+	realDir, parent, err := m.resolve(dir)
+	if err != nil {
+		return p, nil, err
+	}
+	if !parent.mode.IsDir() {
+		return p, nil, errors.New("not a directory")
+	}
+
+	p = path.Join(realDir, base)
+	node, ok := m.nodes[p]
+	if !ok {
+		return p, nil, os.ErrNotExist
+	}
+
+	return p, node, nil
+}
+
+// Open open file for reading
+func (m *MemFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile open file by flag, create file with perm if not exists
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	resolve := m.resolve
+	if oNoFollow != 0 && flag&oNoFollow != 0 {
+		resolve = m.lresolve
+	}
+
+	p, node, err := resolve(name)
+	switch {
+	case err == nil:
+		if node.mode&os.ModeSymlink != 0 {
+			return nil, memFSPathError("open", name, errors.New("too many levels of symbolic links"))
+		}
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, memFSPathError("open", name, os.ErrExist)
+		}
+		if node.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, memFSPathError("open", name, errors.New("is a directory"))
+		}
+		if flag&os.O_TRUNC != 0 {
+			node.data = nil
+			node.modTime = Clock.GetUTCNow()
+		}
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+		parent, ok := m.nodes[path.Dir(p)]
+		if !ok || !parent.mode.IsDir() {
+			return nil, memFSPathError("open", name, os.ErrNotExist)
+		}
+
+		node = &memFSNode{mode: perm.Perm(), modTime: Clock.GetUTCNow()}
+		m.nodes[p] = node
+	default:
+		return nil, memFSPathError("open", name, err)
+	}
+
+	f := &memFSFile{fs: m, name: name, base: path.Base(p), node: node, flag: flag}
+	if flag&os.O_APPEND != 0 {
+		f.offset = int64(len(node.data))
+	}
+
+	return f, nil
+}
+
+// Stat get file info, follow symlinks
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, node, err := m.resolve(name)
+	if err != nil {
+		return nil, memFSPathError("stat", name, err)
+	}
+
+	return node.info(path.Base(p)), nil
+}
+
+// Lstat get file info, do not follow symlink
+func (m *MemFS) Lstat(name string) (os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, node, err := m.lresolve(name)
+	if err != nil {
+		return nil, memFSPathError("lstat", name, err)
+	}
+
+	return node.info(path.Base(p)), nil
+}
+
+// children list paths of entries in dir, need lock
+func (m *MemFS) children(dir string) (paths []string) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for p := range m.nodes {
+		if p != "/" && strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+			paths = append(paths, p)
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// ReadDir read entries in dir sorted by name
+func (m *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, node, err := m.resolve(name)
+	if err != nil {
+		return nil, memFSPathError("readdir", name, err)
+	}
+	if !node.mode.IsDir() {
+		return nil, memFSPathError("readdir", name, errors.New("not a directory"))
+	}
+
+	var fs []os.FileInfo
+	for _, child := range m.children(p) {
+		fs = append(fs, m.nodes[child].info(path.Base(child)))
+	}
+
+	return fs, nil
+}
+
+// MkdirAll create dir and all parents
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := memFSClean(name)
+	if _, node, err := m.resolve(p); err == nil {
+		if !node.mode.IsDir() {
+			return memFSPathError("mkdir", name, errors.New("not a directory"))
+		}
+
+		return nil
+	}
+
+	dir := "/"
+	for _, elem := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+		realDir, _, err := m.resolve(dir)
+		if err != nil {
+			return memFSPathError("mkdir", name, err)
+		}
+
+		dir = path.Join(realDir, elem)
+		if _, node, err := m.resolve(dir); err == nil {
+			if !node.mode.IsDir() {
+				return memFSPathError("mkdir", name, errors.New("not a directory"))
+			}
+
+			continue
+		}
+
+		m.nodes[dir] = &memFSNode{mode: os.ModeDir | perm.Perm(), modTime: Clock.GetUTCNow()}
+	}
+
+	return nil
+}
+
+// Remove remove file, symlink or empty dir
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, node, err := m.lresolve(name)
+	if err != nil {
+		return memFSPathError("remove", name, err)
+	}
+	if p == "/" {
+		return memFSPathError("remove", name, errors.New("cannot remove root"))
+	}
+	if node.mode.IsDir() && len(m.children(p)) != 0 {
+		return memFSPathError("remove", name, errors.New("directory not empty"))
+	}
+
+	delete(m.nodes, p)
+	return nil
+}
+
+// Rename move oldpath to newpath, replace newpath if it is not a dir
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldp, node, err := m.lresolve(oldpath)
+	if err != nil {
+		return memFSPathError("rename", oldpath, err)
+	}
+
+	newp, existed, err := m.lresolve(newpath)
+	if newp == oldp {
+		return nil
+	}
+
+	switch {
+	case err == nil:
+		if existed.mode.IsDir() {
+			return memFSPathError("rename", newpath, os.ErrExist)
+		}
+	case !os.IsNotExist(err):
+		return memFSPathError("rename", newpath, err)
+	}
+	if parent, ok := m.nodes[path.Dir(newp)]; !ok || !parent.mode.IsDir() {
+		return memFSPathError("rename", newpath, os.ErrNotExist)
+	}
+	if node.mode.IsDir() && isPathInDir(newp, oldp) {
+		return memFSPathError("rename", newpath, errors.New("invalid argument"))
+	}
+
+	m.nodes[newp] = node
+	delete(m.nodes, oldp)
+	if node.mode.IsDir() {
+		for p, child := range m.nodes {
+			if strings.HasPrefix(p, oldp+"/") {
+				m.nodes[newp+p[len(oldp):]] = child
+				delete(m.nodes, p)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Chmod change permission bits of file, follow symlinks
+func (m *MemFS) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, node, err := m.resolve(name)
+	if err != nil {
+		return memFSPathError("chmod", name, err)
+	}
+
+	node.mode = node.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+// Chtimes change mtime of file, atime is ignored
+func (m *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, node, err := m.resolve(name)
+	if err != nil {
+		return memFSPathError("chtimes", name, err)
+	}
+
+	node.modTime = mtime
+	return nil
+}
+
+// Symlink create newname as symlink to oldname
+func (m *MemFS) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.addNode("symlink", newname, &memFSNode{
+		mode:    os.ModeSymlink | 0777,
+		modTime: Clock.GetUTCNow(),
+		link:    filepath.ToSlash(oldname),
+	})
+}
+
+// Readlink get target of symlink
+func (m *MemFS) Readlink(name string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, node, err := m.lresolve(name)
+	if err != nil {
+		return "", memFSPathError("readlink", name, err)
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", memFSPathError("readlink", name, errors.New("invalid argument"))
+	}
+
+	return node.link, nil
+}
+
+// Link create newname as hard link to oldname
+func (m *MemFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, node, err := m.lresolve(oldname)
+	if err != nil {
+		return memFSPathError("link", oldname, err)
+	}
+	if node.mode.IsDir() {
+		return memFSPathError("link", oldname, errors.New("operation not permitted"))
+	}
+
+	return m.addNode("link", newname, node)
+}
+
+// addNode add node at name, name must not exist, need lock
+func (m *MemFS) addNode(op, name string, node *memFSNode) error {
+	p, _, err := m.lresolve(name)
+	switch {
+	case err == nil:
+		return memFSPathError(op, name, os.ErrExist)
+	case !os.IsNotExist(err):
+		return memFSPathError(op, name, err)
+	}
+	if parent, ok := m.nodes[path.Dir(p)]; !ok || !parent.mode.IsDir() {
+		return memFSPathError(op, name, os.ErrNotExist)
+	}
+
+	m.nodes[p] = node
+	return nil
+}
+
+func (n *memFSNode) info(name string) os.FileInfo {
+	size := int64(len(n.data))
+	if n.mode&os.ModeSymlink != 0 {
+		size = int64(len(n.link))
+	}
+
+	return &memFSFileInfo{
+		name:    name,
+		size:    size,
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+type memFSFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFSFileInfo) Name() string       { return i.name }
+func (i *memFSFileInfo) Size() int64        { return i.size }
+func (i *memFSFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFSFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFSFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFSFileInfo) Sys() interface{}   { return nil }
+
+type memFSFile struct {
+	fs         *MemFS
+	name, base string
+	node       *memFSNode
+	flag       int
+	offset     int64
+	closed     bool
+}
+
+func (f *memFSFile) Name() string {
+	return f.name
+}
+
+func (f *memFSFile) checkRead() error {
+	if f.closed {
+		return memFSPathError("read", f.name, os.ErrClosed)
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return memFSPathError("read", f.name, os.ErrPermission)
+	}
+	if f.node.mode.IsDir() {
+		return memFSPathError("read", f.name, errors.New("is a directory"))
+	}
+
+	return nil
+}
+
+// Read update offset, so need write lock
+func (f *memFSFile) Read(p []byte) (n int, err error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err = f.checkRead(); err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n = copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFSFile) ReadAt(p []byte, off int64) (n int, err error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
+	if err = f.checkRead(); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, memFSPathError("readat", f.name, errors.New("negative offset"))
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n = copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *memFSFile) Write(p []byte) (n int, err error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, memFSPathError("write", f.name, os.ErrClosed)
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, memFSPathError("write", f.name, os.ErrPermission)
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+
+	if end := f.offset + int64(len(p)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+
+	n = copy(f.node.data[f.offset:], p)
+	f.offset += int64(n)
+	f.node.modTime = Clock.GetUTCNow()
+	return n, nil
+}
+
+func (f *memFSFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, memFSPathError("seek", f.name, os.ErrClosed)
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, memFSPathError("seek", f.name, errors.Errorf("invalid whence %d", whence))
+	}
+	if offset < 0 {
+		return 0, memFSPathError("seek", f.name, errors.New("negative offset"))
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFSFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return memFSPathError("close", f.name, os.ErrClosed)
+	}
+
+	f.closed = true
+	return nil
+}
+
+func (f *memFSFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
+	return f.node.info(f.base), nil
+}
+
+func (f *memFSFile) Sync() error {
+	return nil
+}
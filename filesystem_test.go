@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFS(t *testing.T) {
+	fsys := NewMemFS()
+
+	require.NoError(t, fsys.MkdirAll("/a/b", 0755))
+	fp, err := fsys.OpenFile("/a/b/f.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	require.NoError(t, err)
+	_, err = fp.Write([]byte("hello world"))
+	require.NoError(t, err)
+	_, err = fp.Seek(6, io.SeekStart)
+	require.NoError(t, err)
+	cnt, err := ioutil.ReadAll(fp)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(cnt))
+	require.NoError(t, fp.Close())
+
+	finfo, err := fsys.Stat("a/b/f.txt")
+	require.NoError(t, err)
+	require.Equal(t, "f.txt", finfo.Name())
+	require.Equal(t, int64(11), finfo.Size())
+	require.Equal(t, os.FileMode(0640), finfo.Mode())
+
+	// append
+	fp, err = fsys.OpenFile("/a/b/f.txt", os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = fp.Write([]byte("!"))
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+
+	// errors
+	_, err = fsys.Open("/notexist")
+	require.True(t, os.IsNotExist(err))
+	_, err = fsys.OpenFile("/a/b/f.txt", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	require.True(t, os.IsExist(err))
+	_, err = fsys.OpenFile("/notexist/f.txt", os.O_CREATE|os.O_WRONLY, 0600)
+	require.True(t, os.IsNotExist(err))
+	require.Error(t, fsys.Remove("/a"))
+
+	// symlink & hard link
+	require.NoError(t, fsys.Symlink("b", "/a/link"))
+	link, err := fsys.Readlink("/a/link")
+	require.NoError(t, err)
+	require.Equal(t, "b", link)
+	finfo, err = fsys.Lstat("/a/link")
+	require.NoError(t, err)
+	require.True(t, finfo.Mode()&os.ModeSymlink != 0)
+	finfo, err = fsys.Stat("/a/link/f.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(12), finfo.Size())
+	require.NoError(t, fsys.Link("/a/b/f.txt", "/a/hard"))
+	finfo, err = fsys.Stat("/a/hard")
+	require.NoError(t, err)
+	require.Equal(t, int64(12), finfo.Size())
+
+	fs, err := fsys.ReadDir("/a")
+	require.NoError(t, err)
+	require.Len(t, fs, 3)
+	require.Equal(t, "b", fs[0].Name())
+	require.Equal(t, "hard", fs[1].Name())
+	require.Equal(t, "link", fs[2].Name())
+
+	// rename dir with children
+	require.NoError(t, fsys.Rename("/a/b", "/a/c"))
+	_, err = fsys.Stat("/a/b/f.txt")
+	require.True(t, os.IsNotExist(err))
+	_, err = fsys.Stat("/a/c/f.txt")
+	require.NoError(t, err)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, fsys.Chtimes("/a/c/f.txt", mtime, mtime))
+	require.NoError(t, fsys.Chmod("/a/c/f.txt", 0600))
+	finfo, err = fsys.Stat("/a/c/f.txt")
+	require.NoError(t, err)
+	require.True(t, mtime.Equal(finfo.ModTime()))
+	require.Equal(t, os.FileMode(0600), finfo.Mode())
+
+	require.NoError(t, fsys.Remove("/a/c/f.txt"))
+	require.NoError(t, fsys.Remove("/a/c"))
+
+	// symlink loop
+	require.NoError(t, fsys.Symlink("/loop2", "/loop1"))
+	require.NoError(t, fsys.Symlink("/loop1", "/loop2"))
+	_, err = fsys.Stat("/loop1")
+	require.Error(t, err)
+
+	// share file between goroutines
+	fp, err = fsys.OpenFile("/shared", os.O_RDWR|os.O_CREATE, 0600)
+	require.NoError(t, err)
+	_, err = fp.Write([]byte("hello world"))
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 100; k++ {
+				_, _ = fp.Seek(0, io.SeekStart)
+				_, _ = fp.Read(make([]byte, 4))
+			}
+			_ = fp.Close()
+		}()
+	}
+	wg.Wait()
+	require.Error(t, fp.Close())
+}
+
+func TestFSHelpers(t *testing.T) {
+	fsys := NewMemFS()
+	require.NoError(t, fsys.MkdirAll("/src/child", 0755))
+	for name, cnt := range map[string]string{
+		"/src/a.txt":       "yoo",
+		"/src/child/b.txt": "hello",
+	} {
+		fp, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+		require.NoError(t, err)
+		_, err = fp.Write([]byte(cnt))
+		require.NoError(t, err)
+		require.NoError(t, fp.Close())
+	}
+
+	ok, err := IsDirFS(fsys, "/src")
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = IsFileFS(fsys, "/src/a.txt")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	size, err := DirSizeFS(fsys, "/src")
+	require.NoError(t, err)
+	require.Equal(t, int64(8), size)
+
+	files, err := ListFilesInDirFS(fsys, "/src")
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join("/src", "a.txt")}, files)
+
+	err = CopyFile("/src/a.txt", "/dst/a.txt", WithCopyFileFS(fsys), WithCopyFilePreserveMode())
+	require.NoError(t, err)
+	finfo, err := fsys.Stat("/dst/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), finfo.Size())
+	require.Equal(t, os.FileMode(0644), finfo.Mode())
+	fs, err := fsys.ReadDir("/dst")
+	require.NoError(t, err)
+	require.Len(t, fs, 1)
+
+	// archives
+	require.NoError(t, ZipFiles("/src.zip", []string{"/src"}, WithZipFS(fsys)))
+	filenames, err := Unzip("/src.zip", "/unzip", WithUnzipFS(fsys))
+	require.NoError(t, err)
+	require.Len(t, filenames, 2)
+
+	require.NoError(t, TarFiles("/src.tar.gz", []string{"/src"},
+		WithTarFS(fsys),
+		WithTarCompress(CompressFormatGzip),
+	))
+	filenames, err = Untar("/src.tar.gz", "/untar", WithTarFS(fsys))
+	require.NoError(t, err)
+	require.Len(t, filenames, 4)
+
+	for _, fpath := range []string{"/unzip/src/child/b.txt", "/untar/src/child/b.txt"} {
+		fp, err := fsys.Open(fpath)
+		require.NoError(t, err)
+		cnt, err := ioutil.ReadAll(fp)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(cnt))
+		require.NoError(t, fp.Close())
+	}
+
+	// nothing written to disk
+	_, err = os.Stat("/src.zip")
+	require.True(t, os.IsNotExist(err))
+}
@@ -1,21 +1,45 @@
 package utils
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/Laisky/zap"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
-// MoveFile move file from src to dst by copy
+// MoveFile move file from src to dst
 //
+// try `rename` first, fallback to copy & delete if failed.
 // sometimes move file by `rename` not work.
 // for example, you can not move file between docker volumes by `rename`.
+//
+// mode, ownership and times will be preserved when fallback to copy.
 func MoveFile(src, dst string) (err error) {
-	if err = CopyFile(src, dst); err != nil {
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return errors.Wrapf(err, "create dir `%s`", dst)
+	}
+
+	if err = os.Rename(src, dst); err == nil {
+		return syncDir(filepath.Dir(dst))
+	}
+	if _, statErr := os.Lstat(src); statErr != nil {
+		return errors.Wrapf(err, "rename file `%s`", src)
+	}
+	Logger.Debug("rename failed, fallback to copy", zap.String("src", src), zap.Error(err))
+
+	if err = CopyFile(src, dst,
+		WithCopyFilePreserveMode(),
+		WithCopyFilePreserveOwner(),
+		WithCopyFilePreserveTimes(),
+	); err != nil {
 		return err
 	}
 
@@ -23,12 +47,17 @@ func MoveFile(src, dst string) (err error) {
 		return errors.Wrapf(err, "remove file `%s`", src)
 	}
 
-	return nil
+	return syncDir(filepath.Dir(src))
 }
 
 // IsDir is path exists as dir
 func IsDir(path string) (bool, error) {
-	st, err := os.Stat(path)
+	return IsDirFS(OSFS, path)
+}
+
+// IsDirFS is path exists as dir in fsys
+func IsDirFS(fsys FS, path string) (bool, error) {
+	st, err := fsys.Stat(path)
 	if err != nil {
 		return false, err
 	}
@@ -52,39 +81,238 @@ func IsDirWritable(dir string) (err error) {
 
 // IsFile is path exists as file
 func IsFile(path string) (bool, error) {
-	isdir, err := IsDir(path)
+	return IsFileFS(OSFS, path)
+}
+
+// IsFileFS is path exists as file in fsys
+func IsFileFS(fsys FS, path string) (bool, error) {
+	isdir, err := IsDirFS(fsys, path)
 	return !isdir, err
 }
 
+type copyFileOption struct {
+	fs                 FS
+	mode, owner, times bool
+}
+
+// CopyFileOptFunc options for CopyFile
+type CopyFileOptFunc func(*copyFileOption) error
+
+// WithCopyFileFS copy file in fsys, default to OSFS
+func WithCopyFileFS(fsys FS) CopyFileOptFunc {
+	return func(opt *copyFileOption) error {
+		if fsys == nil {
+			return errors.Errorf("fs cannot be nil")
+		}
+
+		opt.fs = fsys
+		return nil
+	}
+}
+
+// WithCopyFilePreserveMode set mode of dst the same as src
+func WithCopyFilePreserveMode() CopyFileOptFunc {
+	return func(opt *copyFileOption) error {
+		opt.mode = true
+		return nil
+	}
+}
+
+// WithCopyFilePreserveOwner set uid & gid of dst the same as src,
+// usually requires root. do nothing on windows or not OSFS.
+func WithCopyFilePreserveOwner() CopyFileOptFunc {
+	return func(opt *copyFileOption) error {
+		opt.owner = true
+		return nil
+	}
+}
+
+// WithCopyFilePreserveTimes set mtime of dst the same as src
+func WithCopyFilePreserveTimes() CopyFileOptFunc {
+	return func(opt *copyFileOption) error {
+		opt.times = true
+		return nil
+	}
+}
+
 // CopyFile copy file content from src to dst
-func CopyFile(src, dst string) (err error) {
-	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
-		return errors.Wrapf(err, "create dir `%s`", dst)
+//
+// dst is written atomically by `WriteFileAtomicFromReader`,
+// will not leave truncated dst if crashed during copy.
+func CopyFile(src, dst string, opts ...CopyFileOptFunc) (err error) {
+	opt := &copyFileOption{fs: OSFS}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return errors.Wrap(err, "set option")
+		}
 	}
 
-	srcFp, err := os.Open(src)
+	srcFp, err := opt.fs.Open(src)
 	if err != nil {
 		return errors.Wrapf(err, "open file `%s`", src)
 	}
+	defer CloseQuietly(srcFp)
 
-	dstFp, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	finfo, err := srcFp.Stat()
 	if err != nil {
-		return errors.Wrapf(err, "open file `%s`", dst)
+		return errors.Wrapf(err, "get stat of `%s`", src)
+	}
+	if !finfo.Mode().IsRegular() {
+		return errors.Errorf("`%s` is not regular file", src)
+	}
+
+	perm := os.ModePerm
+	if opt.mode {
+		perm = finfo.Mode().Perm()
 	}
 
 	var n int64
-	if n, err = io.Copy(dstFp, srcFp); err != nil {
-		return errors.Wrap(err, "copy file")
+	if err = writeFileAtomic(opt.fs, dst, perm, func(fp File) (err error) {
+		if n, err = io.Copy(fp, srcFp); err != nil {
+			return errors.Wrap(err, "copy file")
+		}
+
+		if opt.mode {
+			// mode of new file is masked by umask
+			if err = opt.fs.Chmod(fp.Name(), perm); err != nil {
+				return errors.Wrapf(err, "chmod `%s`", fp.Name())
+			}
+		}
+		if osFp, ok := fp.(*os.File); ok && opt.owner {
+			if err = chownAsFileInfo(osFp, finfo); err != nil {
+				return errors.Wrapf(err, "chown `%s`", fp.Name())
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return err
 	}
-	Logger.Debug("copy file", zap.String("dst", dst), zap.Int64("len", n))
 
+	if opt.times {
+		if err = opt.fs.Chtimes(dst, finfo.ModTime(), finfo.ModTime()); err != nil {
+			return errors.Wrapf(err, "set times of `%s`", dst)
+		}
+	}
+
+	Logger.Debug("copy file", zap.String("dst", dst), zap.Int64("len", n))
 	return nil
 }
 
+// WriteFileAtomic write data to file atomically,
+// file will be either the old content or the new content even if crashed.
+//
+// data is written to temp file in the same dir, then fsync and rename to fpath,
+// perm is used to create new file (before umask).
+func WriteFileAtomic(fpath string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(OSFS, fpath, perm, func(fp File) error {
+		if _, err := fp.Write(data); err != nil {
+			return errors.Wrap(err, "write data")
+		}
+
+		return nil
+	})
+}
+
+// WriteFileAtomicFromReader write content of reader to file atomically,
+// see `WriteFileAtomic`.
+func WriteFileAtomicFromReader(fpath string, reader io.Reader, perm os.FileMode) error {
+	return writeFileAtomic(OSFS, fpath, perm, func(fp File) error {
+		if _, err := io.Copy(fp, reader); err != nil {
+			return errors.Wrap(err, "copy data")
+		}
+
+		return nil
+	})
+}
+
+// ReplaceFile replace dst by src atomically,
+// src and dst must be in the same filesystem.
+//
+// src is fsynced before rename, and dir of dst is fsynced after rename.
+func ReplaceFile(src, dst string) (err error) {
+	fp, err := os.OpenFile(src, os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", src)
+	}
+	defer CloseQuietly(fp)
+
+	if err = fp.Sync(); err != nil {
+		return errors.Wrapf(err, "sync file `%s`", src)
+	}
+	if err = fp.Close(); err != nil {
+		return errors.Wrapf(err, "close file `%s`", src)
+	}
+
+	if err = os.Rename(src, dst); err != nil {
+		return errors.Wrapf(err, "rename `%s` to `%s`", src, dst)
+	}
+
+	return syncDir(filepath.Dir(dst))
+}
+
+// writeFileAtomic create temp file in the same dir of fpath,
+// write by writer, then fsync and rename temp file to fpath.
+//
+// temp file will be removed if any error occurred.
+func writeFileAtomic(fsys FS, fpath string, perm os.FileMode, writer func(File) error) (err error) {
+	dir := filepath.Dir(fpath)
+	if err = fsys.MkdirAll(dir, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "create dir `%s`", dir)
+	}
+
+	var fp File
+	for i := 0; ; i++ {
+		tmpPath := filepath.Join(dir, "."+filepath.Base(fpath)+"."+RandomStringWithLength(8)+".tmp")
+		if fp, err = fsys.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm); err == nil {
+			break
+		}
+		if !os.IsExist(err) || i >= 10 {
+			return errors.Wrapf(err, "create temp file in `%s`", dir)
+		}
+	}
+	defer func() {
+		CloseQuietly(fp)
+		if err != nil {
+			_ = fsys.Remove(fp.Name())
+		}
+	}()
+
+	if err = writer(fp); err != nil {
+		return err
+	}
+	if err = fp.Sync(); err != nil {
+		return errors.Wrapf(err, "sync file `%s`", fp.Name())
+	}
+	if err = fp.Close(); err != nil {
+		return errors.Wrapf(err, "close file `%s`", fp.Name())
+	}
+
+	if err = fsys.Rename(fp.Name(), fpath); err != nil {
+		return errors.Wrapf(err, "rename `%s` to `%s`", fp.Name(), fpath)
+	}
+
+	return syncFSDir(fsys, dir)
+}
+
+// syncFSDir fsync dir if fsys is OSFS
+func syncFSDir(fsys FS, dir string) error {
+	if fsys != OSFS {
+		return nil
+	}
+
+	return syncDir(dir)
+}
+
 // DirSize calculate directory size.
 // https://stackoverflow.com/a/32482941/2368737
 func DirSize(path string) (size int64, err error) {
-	err = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+	return DirSizeFS(OSFS, path)
+}
+
+// DirSizeFS calculate directory size in fsys
+func DirSizeFS(fsys FS, path string) (size int64, err error) {
+	err = walkFS(fsys, path, func(_ string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -99,7 +327,12 @@ func DirSize(path string) (size int64, err error) {
 
 // ListFilesInDir list files in dir
 func ListFilesInDir(dir string) (files []string, err error) {
-	fs, err := ioutil.ReadDir(dir)
+	return ListFilesInDirFS(OSFS, dir)
+}
+
+// ListFilesInDirFS list files in dir of fsys
+func ListFilesInDirFS(fsys FS, dir string) (files []string, err error) {
+	fs, err := fsys.ReadDir(dir)
 	if err != nil {
 		return nil, errors.Wrapf(err, "read dir `%s`", dir)
 	}
@@ -114,3 +347,421 @@ func ListFilesInDir(dir string) (files []string, err error) {
 
 	return
 }
+
+type walkOption struct {
+	includes, excludes []string
+	maxDepth           int
+	concurrency        int
+}
+
+// WalkOptFunc options for WalkDir
+type WalkOptFunc func(*walkOption) error
+
+// WithWalkInclude only walk files that match any of patterns,
+// dirs are not affected. pattern syntax is the same as `WithUnzipInclude`.
+func WithWalkInclude(patterns ...string) WalkOptFunc {
+	return func(opt *walkOption) error {
+		if err := checkArchivePatterns(patterns); err != nil {
+			return err
+		}
+
+		opt.includes = append(opt.includes, patterns...)
+		return nil
+	}
+}
+
+// WithWalkExclude skip files and dirs that match any of patterns,
+// pattern syntax is the same as `WithUnzipInclude`.
+func WithWalkExclude(patterns ...string) WalkOptFunc {
+	return func(opt *walkOption) error {
+		if err := checkArchivePatterns(patterns); err != nil {
+			return err
+		}
+
+		opt.excludes = append(opt.excludes, patterns...)
+		return nil
+	}
+}
+
+// WithWalkMaxDepth only walk entries at most n levels below root,
+// entries directly in root are at level 1.
+func WithWalkMaxDepth(n int) WalkOptFunc {
+	return func(opt *walkOption) error {
+		if n <= 0 {
+			return errors.Errorf("max depth must greater than 0, got %d", n)
+		}
+
+		opt.maxDepth = n
+		return nil
+	}
+}
+
+// WithWalkConcurrency call fn in n goroutines, default to 1
+func WithWalkConcurrency(n int) WalkOptFunc {
+	return func(opt *walkOption) error {
+		if n <= 0 {
+			return errors.Errorf("concurrency must greater than 0, got %d", n)
+		}
+
+		opt.concurrency = n
+		return nil
+	}
+}
+
+// WalkDir walk all files and dirs in root recursively (root itself excluded),
+// symlinks are not followed.
+//
+// fn of files may be called concurrently if `WithWalkConcurrency` is set,
+// fn of dirs is always called before any entry in it.
+// walk will stop at the first error returned by fn.
+func WalkDir(root string, fn func(fpath string, finfo os.FileInfo) error, opts ...WalkOptFunc) (err error) {
+	opt := &walkOption{concurrency: 1}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return errors.Wrap(err, "set option")
+		}
+	}
+
+	root = filepath.Clean(root)
+	pool := make(chan struct{}, opt.concurrency)
+	g, ctx := errgroup.WithContext(context.Background())
+	err = filepath.Walk(root, func(fpath string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fpath == root {
+			return nil
+		}
+
+		name, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return errors.Wrapf(err, "get relative path of `%s`", fpath)
+		}
+		name = filepath.ToSlash(name)
+
+		if matchArchivePatterns(opt.excludes, name) {
+			if finfo.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+		if !finfo.IsDir() &&
+			len(opt.includes) != 0 &&
+			!matchArchivePatterns(opt.includes, name) {
+			return nil
+		}
+
+		// stop dispatching if any fn failed
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		if finfo.IsDir() {
+			// handle dir before dispatching its children
+			if err = fn(fpath, finfo); err != nil {
+				return err
+			}
+
+			if opt.maxDepth > 0 &&
+				strings.Count(name, "/")+1 >= opt.maxDepth {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		select {
+		case pool <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		g.Go(func() error {
+			defer func() { <-pool }()
+			return fn(fpath, finfo)
+		})
+
+		return nil
+	})
+
+	// error from fn is more meaningful than canceled walk
+	if gerr := g.Wait(); gerr != nil {
+		return gerr
+	}
+
+	return err
+}
+
+type syncDirOption struct {
+	walkOpts []WalkOptFunc
+	hash     HashType
+	delete   bool
+	// force copy all files even not changed
+	force bool
+}
+
+// SyncDirOptFunc options for SyncDir and CopyDir
+type SyncDirOptFunc func(*syncDirOption) error
+
+// WithSyncDirWalkOptions set filters and concurrency, see `WalkDir`.
+//
+// excluded files in dst will not be deleted by `WithSyncDirDelete`.
+func WithSyncDirWalkOptions(opts ...WalkOptFunc) SyncDirOptFunc {
+	return func(opt *syncDirOption) error {
+		opt.walkOpts = append(opt.walkOpts, opts...)
+		return nil
+	}
+}
+
+// WithSyncDirCompareHash compare files by size and hash of content,
+// default to compare by size and mtime.
+func WithSyncDirCompareHash(algo HashType) SyncDirOptFunc {
+	return func(opt *syncDirOption) error {
+		if _, err := NewHasher(algo); err != nil {
+			return err
+		}
+
+		opt.hash = normalizeHashType(algo)
+		return nil
+	}
+}
+
+// WithSyncDirDelete delete files and dirs in dst that not exist in src
+func WithSyncDirDelete() SyncDirOptFunc {
+	return func(opt *syncDirOption) error {
+		opt.delete = true
+		return nil
+	}
+}
+
+// SyncDirResult result of SyncDir,
+// all paths are relative to src or dst in slash-separated.
+type SyncDirResult struct {
+	mu sync.Mutex
+	// Copied files, dirs and symlinks copied into dst
+	Copied []string
+	// Skipped files and symlinks not changed
+	Skipped []string
+	// Deleted files and dirs deleted from dst
+	Deleted []string
+}
+
+func (r *SyncDirResult) add(list *[]string, name string) {
+	r.mu.Lock()
+	*list = append(*list, name)
+	r.mu.Unlock()
+}
+
+// CopyDir copy all files, dirs and symlinks in src into dst recursively,
+// mode and mtime of files are preserved, files are written atomically.
+func CopyDir(src, dst string, opts ...SyncDirOptFunc) (err error) {
+	opts = append(opts, func(opt *syncDirOption) error {
+		opt.force = true
+		return nil
+	})
+
+	_, err = SyncDir(src, dst, opts...)
+	return err
+}
+
+// SyncDir make dst the same as src like rsync,
+// only copy files that changed (by size and mtime, or by hash).
+//
+// mode and mtime of files are preserved, files are written atomically.
+// result contains entries synced before error.
+func SyncDir(src, dst string, opts ...SyncDirOptFunc) (result *SyncDirResult, err error) {
+	opt := new(syncDirOption)
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	src = filepath.Clean(src)
+	dst = filepath.Clean(dst)
+	result = new(SyncDirResult)
+	if err = WalkDir(src, func(fpath string, finfo os.FileInfo) error {
+		name, err := filepath.Rel(src, fpath)
+		if err != nil {
+			return errors.Wrapf(err, "get relative path of `%s`", fpath)
+		}
+
+		copied, err := opt.syncEntry(fpath, filepath.Join(dst, name), finfo)
+		if err != nil {
+			return errors.Wrapf(err, "sync `%s`", fpath)
+		}
+
+		if copied {
+			result.add(&result.Copied, filepath.ToSlash(name))
+		} else {
+			result.add(&result.Skipped, filepath.ToSlash(name))
+		}
+
+		return nil
+	}, opt.walkOpts...); err != nil {
+		return result, err
+	}
+
+	if opt.delete {
+		if err = opt.deleteExtras(src, dst, result); err != nil {
+			return result, err
+		}
+	}
+
+	Logger.Debug("sync dir",
+		zap.String("src", src),
+		zap.String("dst", dst),
+		zap.Int("copied", len(result.Copied)),
+		zap.Int("skipped", len(result.Skipped)),
+		zap.Int("deleted", len(result.Deleted)))
+	return result, nil
+}
+
+// syncEntry copy src to dst if changed, return false if skipped
+func (opt *syncDirOption) syncEntry(src, dst string, finfo os.FileInfo) (copied bool, err error) {
+	switch {
+	case finfo.IsDir():
+		if err = os.MkdirAll(dst, finfo.Mode().Perm()|0700); err != nil {
+			return false, errors.Wrapf(err, "create dir `%s`", dst)
+		}
+
+		return true, nil
+	case finfo.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return false, errors.Wrapf(err, "read link `%s`", src)
+		}
+
+		if !opt.force {
+			if dstLink, err := os.Readlink(dst); err == nil && dstLink == link {
+				return false, nil
+			}
+		}
+
+		if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return false, errors.Wrapf(err, "create dir `%s`", dst)
+		}
+		if err = os.RemoveAll(dst); err != nil {
+			return false, errors.Wrapf(err, "remove `%s`", dst)
+		}
+		if err = os.Symlink(link, dst); err != nil {
+			return false, errors.Wrapf(err, "create symlink `%s`", dst)
+		}
+
+		return true, nil
+	case finfo.Mode().IsRegular():
+		if !opt.force {
+			if changed, err := opt.isFileChanged(src, dst, finfo); err != nil {
+				return false, err
+			} else if !changed {
+				return false, nil
+			}
+		}
+
+		if dstInfo, err := os.Lstat(dst); err == nil && !dstInfo.Mode().IsRegular() {
+			if err = os.RemoveAll(dst); err != nil {
+				return false, errors.Wrapf(err, "remove `%s`", dst)
+			}
+		}
+
+		if err = CopyFile(src, dst,
+			WithCopyFilePreserveMode(),
+			WithCopyFilePreserveTimes(),
+		); err != nil {
+			return false, err
+		}
+
+		return true, nil
+	default:
+		Logger.Debug("skip unsupported file", zap.String("file", src))
+		return false, nil
+	}
+}
+
+func (opt *syncDirOption) isFileChanged(src, dst string, finfo os.FileInfo) (bool, error) {
+	dstInfo, err := os.Lstat(dst)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "get stat of `%s`", dst)
+	}
+
+	if !dstInfo.Mode().IsRegular() ||
+		dstInfo.Size() != finfo.Size() {
+		return true, nil
+	}
+
+	if opt.hash == "" {
+		return !dstInfo.ModTime().Equal(finfo.ModTime()), nil
+	}
+
+	srcDigests, err := HashFile(src, opt.hash)
+	if err != nil {
+		return false, errors.Wrapf(err, "hash file `%s`", src)
+	}
+	dstDigests, err := HashFile(dst, opt.hash)
+	if err != nil {
+		return false, errors.Wrapf(err, "hash file `%s`", dst)
+	}
+
+	return srcDigests[opt.hash] != dstDigests[opt.hash], nil
+}
+
+// deleteExtras delete files and symlinks in dst that not exist in src,
+// then delete empty dirs in dst that not exist in src.
+func (opt *syncDirOption) deleteExtras(src, dst string, result *SyncDirResult) error {
+	var (
+		mu   sync.Mutex
+		dirs []string
+	)
+	if err := WalkDir(dst, func(fpath string, finfo os.FileInfo) error {
+		name, err := filepath.Rel(dst, fpath)
+		if err != nil {
+			return errors.Wrapf(err, "get relative path of `%s`", fpath)
+		}
+
+		if _, err = os.Lstat(filepath.Join(src, name)); err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "get stat of `%s`", filepath.Join(src, name))
+		}
+
+		if finfo.IsDir() {
+			mu.Lock()
+			dirs = append(dirs, fpath)
+			mu.Unlock()
+			return nil
+		}
+
+		if err = os.Remove(fpath); err != nil {
+			return errors.Wrapf(err, "remove `%s`", fpath)
+		}
+
+		result.add(&result.Deleted, filepath.ToSlash(name))
+		return nil
+	}, opt.walkOpts...); err != nil {
+		return errors.Wrap(err, "delete extra files")
+	}
+
+	// remove children before parents
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		fs, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return errors.Wrapf(err, "read dir `%s`", dir)
+		}
+		// dir may contain files filtered out
+		if len(fs) != 0 {
+			continue
+		}
+
+		if err = os.Remove(dir); err != nil {
+			return errors.Wrapf(err, "remove dir `%s`", dir)
+		}
+
+		name, _ := filepath.Rel(dst, dir)
+		result.add(&result.Deleted, filepath.ToSlash(name))
+	}
+
+	return nil
+}
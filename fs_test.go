@@ -2,10 +2,18 @@ package utils
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Laisky/zap"
 	"github.com/stretchr/testify/require"
@@ -206,3 +214,218 @@ func TestListFilesInDir(t *testing.T) {
 		require.Len(t, files, 0)
 	}
 }
+
+func TestCopyFileWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCopyFileWithOptions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	require.NoError(t, ioutil.WriteFile(src, []byte("hello"), 0600))
+	require.NoError(t, os.Chmod(src, 0640))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.Chtimes(src, mtime, mtime))
+
+	// overwrite longer file should not leave garbage
+	dst := filepath.Join(dir, "sub", "dst")
+	require.NoError(t, os.MkdirAll(filepath.Dir(dst), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(dst, []byte("long long content"), 0600))
+
+	err = CopyFile(src, dst,
+		WithCopyFilePreserveMode(),
+		WithCopyFilePreserveTimes(),
+	)
+	require.NoError(t, err)
+
+	cnt, err := ioutil.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(cnt))
+
+	finfo, err := os.Stat(dst)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), finfo.Mode().Perm())
+	require.True(t, mtime.Equal(finfo.ModTime()))
+
+	// no temp file left
+	fs, err := ioutil.ReadDir(filepath.Dir(dst))
+	require.NoError(t, err)
+	require.Len(t, fs, 1)
+
+	err = CopyFile(dir, filepath.Join(dir, "dir-copy"))
+	require.Error(t, err)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWriteFileAtomic")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "a", "file")
+	require.NoError(t, WriteFileAtomic(fpath, []byte("v1"), 0600))
+	require.NoError(t, WriteFileAtomicFromReader(fpath, strings.NewReader("v2"), 0600))
+
+	cnt, err := ioutil.ReadFile(fpath)
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(cnt))
+
+	// failed write should keep old content
+	pr, pw := io.Pipe()
+	require.NoError(t, pw.CloseWithError(errors.New("broken")))
+	err = WriteFileAtomicFromReader(fpath, pr, 0600)
+	require.Error(t, err)
+	cnt, err = ioutil.ReadFile(fpath)
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(cnt))
+
+	fs, err := ioutil.ReadDir(filepath.Dir(fpath))
+	require.NoError(t, err)
+	require.Len(t, fs, 1)
+
+	// replace
+	tmp := filepath.Join(dir, "a", "tmp")
+	require.NoError(t, ioutil.WriteFile(tmp, []byte("v3"), 0600))
+	require.NoError(t, ReplaceFile(tmp, fpath))
+	cnt, err = ioutil.ReadFile(fpath)
+	require.NoError(t, err)
+	require.Equal(t, "v3", string(cnt))
+	_, err = os.Stat(tmp)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestWalkDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWalkDir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.txt", "b.tmp", "d1/c.txt", "d1/d2/d.txt", ".git/config"} {
+		fpath := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fpath), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(fpath, []byte(name), 0600))
+	}
+
+	walk := func(opts ...WalkOptFunc) []string {
+		var (
+			mu    sync.Mutex
+			files []string
+		)
+		err := WalkDir(dir, func(fpath string, finfo os.FileInfo) error {
+			name, err := filepath.Rel(dir, fpath)
+			require.NoError(t, err)
+
+			mu.Lock()
+			files = append(files, filepath.ToSlash(name))
+			mu.Unlock()
+			return nil
+		}, opts...)
+		require.NoError(t, err)
+
+		sort.Strings(files)
+		return files
+	}
+
+	require.Equal(t, []string{".git", ".git/config", "a.txt", "b.tmp", "d1", "d1/c.txt", "d1/d2", "d1/d2/d.txt"}, walk())
+	require.Equal(t, []string{"a.txt", "d1", "d1/c.txt", "d1/d2", "d1/d2/d.txt"},
+		walk(WithWalkExclude(".git", "*.tmp"), WithWalkConcurrency(4)))
+	require.Equal(t, []string{".git", "a.txt", "d1", "d1/c.txt", "d1/d2", "d1/d2/d.txt"},
+		walk(WithWalkInclude("*.txt")))
+	require.Equal(t, []string{".git", "a.txt", "b.tmp", "d1"}, walk(WithWalkMaxDepth(1)))
+
+	err = WalkDir(dir, func(fpath string, finfo os.FileInfo) error {
+		return errors.New("stop")
+	}, WithWalkConcurrency(2))
+	require.EqualError(t, err, "stop")
+
+	t.Run("dir before children", func(t *testing.T) {
+		var (
+			mu   sync.Mutex
+			dirs = map[string]bool{dir: true}
+		)
+		err := WalkDir(dir, func(fpath string, finfo os.FileInfo) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if !dirs[filepath.Dir(fpath)] {
+				return errors.New("parent of " + fpath + " not handled")
+			}
+			if finfo.IsDir() {
+				dirs[fpath] = true
+			}
+
+			return nil
+		}, WithWalkConcurrency(4))
+		require.NoError(t, err)
+	})
+
+	t.Run("stop dispatching after error", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "TestWalkDir")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(i)), nil, 0600))
+		}
+
+		var called int32
+		err = WalkDir(dir, func(fpath string, finfo os.FileInfo) error {
+			atomic.AddInt32(&called, 1)
+			time.Sleep(time.Millisecond)
+			return errors.New("stop")
+		}, WithWalkConcurrency(2))
+		require.EqualError(t, err, "stop")
+		require.Less(t, int(atomic.LoadInt32(&called)), 10)
+	})
+}
+
+func TestSyncDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSyncDir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, name := range []string{"a.txt", "d1/b.txt", "d1/d2/c.txt"} {
+		fpath := filepath.Join(src, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fpath), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(fpath, []byte(name), 0640))
+	}
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(src, "link")))
+
+	require.NoError(t, CopyDir(src, dst))
+	cnt, err := ioutil.ReadFile(filepath.Join(dst, "d1", "d2", "c.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "d1/d2/c.txt", string(cnt))
+	link, err := os.Readlink(filepath.Join(dst, "link"))
+	require.NoError(t, err)
+	require.Equal(t, "a.txt", link)
+
+	// nothing changed
+	result, err := SyncDir(src, dst)
+	require.NoError(t, err)
+	require.Len(t, result.Skipped, 4)
+	for _, name := range result.Copied {
+		fi, err := os.Stat(filepath.Join(src, name))
+		require.NoError(t, err)
+		require.True(t, fi.IsDir(), name)
+	}
+
+	// change file and add extras
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("new"), 0640))
+	require.NoError(t, os.MkdirAll(filepath.Join(dst, "extra"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "extra", "e.txt"), []byte("e"), 0640))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "keep.tmp"), []byte("e"), 0640))
+
+	result, err = SyncDir(src, dst,
+		WithSyncDirCompareHash(HashTypeSha256),
+		WithSyncDirDelete(),
+		WithSyncDirWalkOptions(WithWalkExclude("*.tmp"), WithWalkConcurrency(4)),
+	)
+	require.NoError(t, err)
+	require.Contains(t, result.Copied, "a.txt")
+	require.ElementsMatch(t, []string{"extra", "extra/e.txt"}, result.Deleted)
+
+	cnt, err = ioutil.ReadFile(filepath.Join(dst, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(cnt))
+	_, err = os.Stat(filepath.Join(dst, "extra"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dst, "keep.tmp"))
+	require.NoError(t, err)
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// oNoFollow open flag to not follow symlink
+const oNoFollow = syscall.O_NOFOLLOW
+
+// syncDir fsync dir to persist entries changed by create or rename
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "open dir `%s`", dir)
+	}
+	defer CloseQuietly(fp)
+
+	if err = fp.Sync(); err != nil {
+		return errors.Wrapf(err, "sync dir `%s`", dir)
+	}
+
+	return nil
+}
+
+// chownAsFileInfo set uid & gid of fp the same as finfo
+func chownAsFileInfo(fp *os.File, finfo os.FileInfo) error {
+	st, ok := finfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	return fp.Chown(int(st.Uid), int(st.Gid))
+}
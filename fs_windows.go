@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"os"
+)
+
+// oNoFollow windows does not support O_NOFOLLOW
+const oNoFollow = 0
+
+// syncDir do nothing, windows does not support fsync dir
+func syncDir(dir string) error {
+	return nil
+}
+
+// chownAsFileInfo do nothing, windows does not support chown
+func chownAsFileInfo(fp *os.File, finfo os.FileInfo) error {
+	return nil
+}
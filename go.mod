@@ -7,13 +7,16 @@ require (
 	github.com/Laisky/go-chaining v0.0.0-20180507092046-43dcdc5a21be
 	github.com/Laisky/graphql v1.0.5
 	github.com/Laisky/zap v1.19.3-0.20211118020215-b17f220cebee
+	github.com/andybalholm/brotli v1.0.4
 	github.com/cespare/xxhash v1.1.0
 	github.com/form3tech-oss/jwt-go v3.2.3+incompatible
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gammazero/deque v0.1.0
 	github.com/google/go-cpy v0.0.0-20211218193943-a9c933c06932
 	github.com/json-iterator/go v1.1.11
-	github.com/klauspost/compress v1.13.3 // indirect
+	github.com/klauspost/compress v1.13.3
 	github.com/klauspost/pgzip v1.2.5
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/pflag v1.0.5
@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
+)
+
+// HashType name of hash algorithm
+type HashType string
+
+const (
+	// HashTypeMD5 md5
+	HashTypeMD5 HashType = "md5"
+	// HashTypeSha1 sha1
+	HashTypeSha1 HashType = "sha1"
+	// HashTypeSha256 sha256
+	HashTypeSha256 HashType = "sha256"
+	// HashTypeSha512 sha512
+	HashTypeSha512 HashType = "sha512"
+	// HashTypeXxhash xxhash64
+	HashTypeXxhash HashType = "xxhash"
+	// HashTypeCRC32 crc32 in IEEE
+	HashTypeCRC32 HashType = "crc32"
+)
+
+const hashDelimiter = ":"
+
+var hashers = struct {
+	sync.RWMutex
+	m map[HashType]func() hash.Hash
+}{
+	m: map[HashType]func() hash.Hash{
+		HashTypeMD5:    md5.New,
+		HashTypeSha1:   sha1.New,
+		HashTypeSha256: sha256.New,
+		HashTypeSha512: sha512.New,
+		HashTypeXxhash: func() hash.Hash { return xxhash.New() },
+		HashTypeCRC32:  func() hash.Hash { return crc32.NewIEEE() },
+	},
+}
+
+// normalizeHashType algorithm names are case-insensitive
+func normalizeHashType(name HashType) HashType {
+	return HashType(strings.ToLower(string(name)))
+}
+
+// RegisterHasher register new hash algorithm,
+// will overwrite the registered one with the same name
+func RegisterHasher(name HashType, newHasher func() hash.Hash) {
+	hashers.Lock()
+	hashers.m[normalizeHashType(name)] = newHasher
+	hashers.Unlock()
+}
+
+// NewHasher create new hasher by registered algorithm name
+func NewHasher(name HashType) (hash.Hash, error) {
+	hashers.RLock()
+	newHasher, ok := hashers.m[normalizeHashType(name)]
+	hashers.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unknown hasher `%s`", name)
+	}
+
+	return newHasher(), nil
+}
+
+// HashReader calculate multiple digests of reader in one pass
+//
+// return hex digest for each algorithm, keyed by lower case algorithm name
+func HashReader(reader io.Reader, algos ...HashType) (digests map[HashType]string, err error) {
+	if len(algos) == 0 {
+		return nil, errors.Errorf("algos cannot be empty")
+	}
+
+	hs := make(map[HashType]hash.Hash, len(algos))
+	writers := make([]io.Writer, 0, len(algos))
+	for _, algo := range algos {
+		algo = normalizeHashType(algo)
+		if _, ok := hs[algo]; ok {
+			continue
+		}
+
+		h, err := NewHasher(algo)
+		if err != nil {
+			return nil, err
+		}
+
+		hs[algo] = h
+		writers = append(writers, h)
+	}
+
+	if _, err = io.Copy(io.MultiWriter(writers...), reader); err != nil {
+		return nil, errors.Wrap(err, "read content")
+	}
+
+	digests = make(map[HashType]string, len(hs))
+	for algo, h := range hs {
+		digests[algo] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return digests, nil
+}
+
+// HashFile calculate multiple digests of file in one pass
+func HashFile(fpath string, algos ...HashType) (digests map[HashType]string, err error) {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer CloseQuietly(fp)
+
+	return HashReader(fp, algos...)
+}
+
+// ParseHashString parse hashed string like `sha256:xxxx` to algorithm and hex digest
+func ParseHashString(hashed string) (algo HashType, digest string, err error) {
+	hs := strings.SplitN(hashed, hashDelimiter, 2)
+	if len(hs) != 2 {
+		return "", "", errors.Errorf("unknown hashed format, expect is `sha256:xxxx`, but got `%s`", hashed)
+	}
+
+	algo = HashType(strings.ToLower(strings.TrimSpace(hs[0])))
+	digest = strings.ToLower(strings.TrimSpace(hs[1]))
+	if algo == "" || digest == "" {
+		return "", "", errors.Errorf("unknown hashed format, expect is `sha256:xxxx`, but got `%s`", hashed)
+	}
+
+	return algo, digest, nil
+}
+
+// ValidateReaderHashes validate reader content with multiple hashed strings in one pass
+//
+// Args:
+//   * reader: content to check
+//   * hashes: hashed strings, like `sha256:xxxx`, `md5:xxxx`
+func ValidateReaderHashes(reader io.Reader, hashes ...string) error {
+	if len(hashes) == 0 {
+		return errors.Errorf("hashes cannot be empty")
+	}
+
+	expects := make(map[HashType]string, len(hashes))
+	algos := make([]HashType, 0, len(hashes))
+	for _, hashed := range hashes {
+		algo, digest, err := ParseHashString(hashed)
+		if err != nil {
+			return err
+		}
+
+		if d, ok := expects[algo]; ok && d != digest {
+			return errors.Errorf("conflict digests for `%s`", algo)
+		}
+
+		expects[algo] = digest
+		algos = append(algos, algo)
+	}
+
+	digests, err := HashReader(reader, algos...)
+	if err != nil {
+		return err
+	}
+
+	for algo, expect := range expects {
+		if digests[algo] != expect {
+			return errors.Errorf("%s hash `%s` not match expect `%s`", algo, digests[algo], expect)
+		}
+	}
+
+	return nil
+}
+
+// ValidateFileHashes validate file content with multiple hashed strings in one pass
+//
+// Args:
+//   * filepath: file path to check
+//   * hashes: hashed strings, like `sha256:xxxx`, `md5:xxxx`
+func ValidateFileHashes(filepath string, hashes ...string) error {
+	fp, err := os.Open(filepath)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", filepath)
+	}
+	defer CloseQuietly(fp)
+
+	return ValidateReaderHashes(fp, hashes...)
+}
+
+// NewHMAC create new hmac hasher by registered algorithm name
+func NewHMAC(algo HashType, key []byte) (hash.Hash, error) {
+	if _, err := NewHasher(algo); err != nil {
+		return nil, err
+	}
+
+	return hmac.New(func() hash.Hash {
+		h, _ := NewHasher(algo)
+		return h
+	}, key), nil
+}
+
+// HMACReader calculate hmac of reader, return hex digest
+func HMACReader(algo HashType, key []byte, reader io.Reader) (string, error) {
+	h, err := NewHMAC(algo, key)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = io.Copy(h, reader); err != nil {
+		return "", errors.Wrap(err, "read content")
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HMACString calculate hmac of string, return hex digest
+func HMACString(algo HashType, key []byte, val string) (string, error) {
+	return HMACReader(algo, key, strings.NewReader(val))
+}
+
+// ValidateHMAC check whether hex digest is the hmac of reader,
+// compare in constant time
+func ValidateHMAC(algo HashType, key []byte, reader io.Reader, digest string) (bool, error) {
+	expect, err := hex.DecodeString(strings.TrimSpace(digest))
+	if err != nil {
+		return false, errors.Wrapf(err, "decode digest `%s`", digest)
+	}
+
+	h, err := NewHMAC(algo, key)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err = io.Copy(h, reader); err != nil {
+		return false, errors.Wrap(err, "read content")
+	}
+
+	return hmac.Equal(h.Sum(nil), expect), nil
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Laisky/zap"
+	"github.com/cespare/xxhash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashReader(t *testing.T) {
+	digests, err := HashReader(strings.NewReader(testhashraw),
+		HashTypeMD5, HashTypeSha1, HashTypeSha256, HashTypeSha512, HashTypeXxhash, HashTypeCRC32,
+		HashTypeSha256,
+	)
+	require.NoError(t, err)
+	require.Len(t, digests, 6)
+	require.Equal(t, HashSHA128String(testhashraw), digests[HashTypeSha1])
+	require.Equal(t, HashSHA256String(testhashraw), digests[HashTypeSha256])
+	require.Equal(t, fmt.Sprintf("%016x", xxhash.Sum64String(testhashraw)), digests[HashTypeXxhash])
+	require.Len(t, digests[HashTypeCRC32], 8)
+	require.Len(t, digests[HashTypeSha512], 128)
+
+	_, err = HashReader(strings.NewReader(testhashraw))
+	require.Error(t, err)
+
+	_, err = HashReader(strings.NewReader(testhashraw), "sha254")
+	require.Error(t, err)
+
+	// algorithm names are case-insensitive
+	digests, err = HashReader(strings.NewReader(testhashraw), "SHA256", HashTypeSha256)
+	require.NoError(t, err)
+	require.Equal(t, map[HashType]string{
+		HashTypeSha256: HashSHA256String(testhashraw),
+	}, digests)
+}
+
+func TestRegisterHasher(t *testing.T) {
+	_, err := NewHasher("adler32")
+	require.Error(t, err)
+
+	RegisterHasher("ADLER32", func() hash.Hash { return adler32.New() })
+	h, err := NewHasher("adler32")
+	require.NoError(t, err)
+	_, err = h.Write([]byte(testhashraw))
+	require.NoError(t, err)
+
+	digests, err := HashReader(strings.NewReader(testhashraw), "adler32")
+	require.NoError(t, err)
+	require.Len(t, digests["adler32"], 8)
+}
+
+func TestValidateFileHashes(t *testing.T) {
+	fp, err := ioutil.TempFile("", "go-utils-*")
+	require.NoError(t, err)
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+
+	content := []byte("jijf32ijr923e890dsfuodsafjlj;f9o2ur9re")
+	_, err = fp.Write(content)
+	require.NoError(t, err)
+
+	digests, err := HashFile(fp.Name(), HashTypeSha512, HashTypeCRC32)
+	require.NoError(t, err)
+
+	err = ValidateFileHashes(fp.Name(),
+		"sha256:aea7e26c0e0b12ad210a8a0e45c379d0325b567afdd4b357158059b0ef03ae67",
+		"MD5: 794E37EEA6B3DF6E6EBA69EB02F9B8C7",
+		"sha512:"+digests[HashTypeSha512],
+		"crc32:"+digests[HashTypeCRC32],
+	)
+	require.NoError(t, err)
+
+	err = ValidateFileHash(fp.Name(), "sha512:"+digests[HashTypeSha512])
+	require.NoError(t, err)
+
+	err = ValidateFileHashes(fp.Name(),
+		"sha256:aea7e26c0e0b12ad210a8a0e45c379d0325b567afdd4b357158059b0ef03ae67",
+		"md5:123",
+	)
+	require.Error(t, err)
+
+	err = ValidateFileHashes(fp.Name(), "md5:123", "md5:456")
+	require.Error(t, err)
+
+	err = ValidateFileHashes(fp.Name())
+	require.Error(t, err)
+
+	err = ValidateFileHashes(fp.Name(), "sha256")
+	require.Error(t, err)
+}
+
+func TestHMAC(t *testing.T) {
+	key := []byte("secret")
+	got, err := HMACString(HashTypeSha256, key, "hello")
+	require.NoError(t, err)
+	require.Equal(t, "88aab3ede8d3adf94d26ab90d3bafd4a2083070c3bcce9c014ee04a443847c0b", got)
+
+	ok, err := ValidateHMAC(HashTypeSha256, key, bytes.NewReader([]byte("hello")), got)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = ValidateHMAC(HashTypeSha256, []byte("another"), bytes.NewReader([]byte("hello")), got)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = ValidateHMAC(HashTypeSha256, key, bytes.NewReader([]byte("hello")), "zzz")
+	require.Error(t, err)
+
+	_, err = HMACString("sha254", key, "hello")
+	require.Error(t, err)
+}
+
+func ExampleHashReader() {
+	digests, err := HashReader(strings.NewReader("hello"), HashTypeMD5, HashTypeSha256)
+	if err != nil {
+		Logger.Error("hash", zap.Error(err))
+		return
+	}
+
+	Logger.Info("hash",
+		zap.String("md5", digests[HashTypeMD5]),
+		zap.String("sha256", digests[HashTypeSha256]),
+	)
+}
@@ -0,0 +1,338 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const defaultDirJanitorInterval = time.Minute
+
+// DirJanitorRemoveReason why file is removed by DirJanitor
+type DirJanitorRemoveReason string
+
+const (
+	// DirJanitorRemoveByTTL file is older than ttl
+	DirJanitorRemoveByTTL DirJanitorRemoveReason = "ttl"
+	// DirJanitorRemoveBySize total size exceeds max size
+	DirJanitorRemoveBySize DirJanitorRemoveReason = "size"
+	// DirJanitorRemoveByFiles number of files exceeds max files
+	DirJanitorRemoveByFiles DirJanitorRemoveReason = "files"
+)
+
+// DirJanitorRemovedFile file removed by DirJanitor
+type DirJanitorRemovedFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Reason  DirJanitorRemoveReason
+}
+
+// DirJanitorReport result of one cleanup
+type DirJanitorReport struct {
+	// Removed files removed, oldest first
+	Removed []DirJanitorRemovedFile
+	// RemovedBytes total size of removed files
+	RemovedBytes int64
+	// TotalBytes total size of files in dir after cleanup
+	TotalBytes int64
+	// TotalFiles number of files in dir after cleanup
+	TotalFiles int
+}
+
+type dirJanitorOption struct {
+	maxSizeByte        int64
+	maxFiles           int
+	ttl                time.Duration
+	interval           time.Duration
+	includes, excludes []string
+	fs                 FS
+	callback           func(*DirJanitorReport)
+}
+
+// DirJanitorOptFunc options for DirJanitor
+type DirJanitorOptFunc func(*dirJanitorOption) error
+
+// WithDirJanitorMaxSizeByte remove oldest files until total size of dir not exceeds n
+func WithDirJanitorMaxSizeByte(n int64) DirJanitorOptFunc {
+	return func(opt *dirJanitorOption) error {
+		if n <= 0 {
+			return errors.Errorf("max size should greater than 0, got %d", n)
+		}
+
+		opt.maxSizeByte = n
+		return nil
+	}
+}
+
+// WithDirJanitorMaxFiles remove oldest files until number of files in dir not exceeds n
+func WithDirJanitorMaxFiles(n int) DirJanitorOptFunc {
+	return func(opt *dirJanitorOption) error {
+		if n <= 0 {
+			return errors.Errorf("max files should greater than 0, got %d", n)
+		}
+
+		opt.maxFiles = n
+		return nil
+	}
+}
+
+// WithDirJanitorTTL remove files that mtime older than ttl
+func WithDirJanitorTTL(ttl time.Duration) DirJanitorOptFunc {
+	return func(opt *dirJanitorOption) error {
+		if ttl <= 0 {
+			return errors.Errorf("ttl should greater than 0, got %s", ttl)
+		}
+
+		opt.ttl = ttl
+		return nil
+	}
+}
+
+// WithDirJanitorInterval cleanup every interval, default to 1min
+func WithDirJanitorInterval(interval time.Duration) DirJanitorOptFunc {
+	return func(opt *dirJanitorOption) error {
+		if interval <= 0 {
+			return errors.Errorf("interval should greater than 0, got %s", interval)
+		}
+
+		opt.interval = interval
+		return nil
+	}
+}
+
+// WithDirJanitorInclude only remove files that match any of patterns,
+// pattern syntax is the same as `WithUnzipInclude`.
+//
+// files not matched are still counted in size and files limits.
+func WithDirJanitorInclude(patterns ...string) DirJanitorOptFunc {
+	return func(opt *dirJanitorOption) error {
+		if err := checkArchivePatterns(patterns); err != nil {
+			return err
+		}
+
+		opt.includes = append(opt.includes, patterns...)
+		return nil
+	}
+}
+
+// WithDirJanitorExclude never remove files (or files in dirs) that match any of patterns,
+// pattern syntax is the same as `WithUnzipInclude`.
+//
+// files excluded are still counted in size and files limits.
+func WithDirJanitorExclude(patterns ...string) DirJanitorOptFunc {
+	return func(opt *dirJanitorOption) error {
+		if err := checkArchivePatterns(patterns); err != nil {
+			return err
+		}
+
+		opt.excludes = append(opt.excludes, patterns...)
+		return nil
+	}
+}
+
+// WithDirJanitorFS manage dir in fsys, default to OSFS
+func WithDirJanitorFS(fsys FS) DirJanitorOptFunc {
+	return func(opt *dirJanitorOption) error {
+		if fsys == nil {
+			return errors.Errorf("fs cannot be nil")
+		}
+
+		opt.fs = fsys
+		return nil
+	}
+}
+
+// WithDirJanitorCallback set callback that will be called
+// with report after each cleanup that removed any file.
+//
+// callback is called synchronously, should not block too long.
+func WithDirJanitorCallback(callback func(*DirJanitorReport)) DirJanitorOptFunc {
+	return func(opt *dirJanitorOption) error {
+		opt.callback = callback
+		return nil
+	}
+}
+
+// DirJanitor keep dir under size or files limits,
+// and remove files older than ttl, oldest files are removed first.
+type DirJanitor struct {
+	*dirJanitorOption
+	mu  sync.Mutex
+	dir string
+}
+
+type dirJanitorFile struct {
+	path      string
+	size      int64
+	modTime   time.Time
+	removable bool
+}
+
+// NewDirJanitor create new DirJanitor,
+// cleanup dir every interval in background until ctx done.
+//
+// at least one of max size, max files and ttl should be set.
+func NewDirJanitor(ctx context.Context, dir string, opts ...DirJanitorOptFunc) (j *DirJanitor, err error) {
+	opt := &dirJanitorOption{
+		interval: defaultDirJanitorInterval,
+		fs:       OSFS,
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	if opt.maxSizeByte == 0 && opt.maxFiles == 0 && opt.ttl == 0 {
+		return nil, errors.Errorf("one of max size, max files and ttl should be set")
+	}
+	if ok, err := IsDirFS(opt.fs, dir); err != nil {
+		return nil, errors.Wrapf(err, "get stat of `%s`", dir)
+	} else if !ok {
+		return nil, errors.Errorf("`%s` is not dir", dir)
+	}
+
+	j = &DirJanitor{
+		dirJanitorOption: opt,
+		dir:              filepath.Clean(dir),
+	}
+	go j.run(ctx)
+	return j, nil
+}
+
+func (j *DirJanitor) run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := j.Clean(); err != nil {
+			Logger.Error("cleanup dir", zap.String("dir", j.dir), zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// listFiles list all regular files in dir, sorted by mtime
+func (j *DirJanitor) listFiles() (files []*dirJanitorFile, err error) {
+	err = walkFS(j.fs, j.dir, func(fpath string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			// file may be removed by others during walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+		if !finfo.Mode().IsRegular() {
+			return nil
+		}
+
+		name, err := filepath.Rel(j.dir, fpath)
+		if err != nil {
+			return errors.Wrapf(err, "get relative path of `%s`", fpath)
+		}
+		name = filepath.ToSlash(name)
+
+		// pattern also matches parent dirs of name
+		excluded := matchArchivePatterns(j.excludes, name)
+		files = append(files, &dirJanitorFile{
+			path:    fpath,
+			size:    finfo.Size(),
+			modTime: finfo.ModTime(),
+			removable: !excluded &&
+				(len(j.includes) == 0 || matchArchivePatterns(j.includes, name)),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "walk dir `%s`", j.dir)
+	}
+
+	sort.SliceStable(files, func(i, k int) bool {
+		return files[i].modTime.Before(files[k].modTime)
+	})
+	return files, nil
+}
+
+// Clean cleanup dir immediately,
+// try to remove all files that should be removed even if some failed,
+// report is returned with the first error.
+func (j *DirJanitor) Clean() (report *DirJanitorReport, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	files, err := j.listFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	report = new(DirJanitorReport)
+	for _, f := range files {
+		report.TotalBytes += f.size
+		report.TotalFiles++
+	}
+
+	remove := func(f *dirJanitorFile, reason DirJanitorRemoveReason) {
+		if rerr := j.fs.Remove(f.path); rerr != nil && !os.IsNotExist(rerr) {
+			Logger.Warn("remove file", zap.String("file", f.path), zap.Error(rerr))
+			if err == nil {
+				err = errors.Wrapf(rerr, "remove file `%s`", f.path)
+			}
+
+			return
+		}
+
+		f.removable = false
+		report.TotalBytes -= f.size
+		report.TotalFiles--
+		report.RemovedBytes += f.size
+		report.Removed = append(report.Removed, DirJanitorRemovedFile{
+			Path:    f.path,
+			Size:    f.size,
+			ModTime: f.modTime,
+			Reason:  reason,
+		})
+	}
+
+	now := Clock.GetUTCNow()
+	for _, f := range files {
+		if !f.removable {
+			continue
+		}
+
+		switch {
+		case j.ttl > 0 && now.Sub(f.modTime) > j.ttl:
+			remove(f, DirJanitorRemoveByTTL)
+		case j.maxSizeByte > 0 && report.TotalBytes > j.maxSizeByte:
+			remove(f, DirJanitorRemoveBySize)
+		case j.maxFiles > 0 && report.TotalFiles > j.maxFiles:
+			remove(f, DirJanitorRemoveByFiles)
+		}
+	}
+
+	if len(report.Removed) != 0 {
+		Logger.Info("cleanup dir",
+			zap.String("dir", j.dir),
+			zap.Int("removed", len(report.Removed)),
+			zap.Int64("removed_bytes", report.RemovedBytes),
+			zap.Int64("total_bytes", report.TotalBytes),
+			zap.Int("total_files", report.TotalFiles))
+		if j.callback != nil {
+			j.callback(report)
+		}
+	}
+
+	return report, err
+}
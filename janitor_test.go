@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirJanitor(t *testing.T) {
+	fsys := NewMemFS()
+	require.NoError(t, fsys.MkdirAll("/spool/keep", 0755))
+
+	now := Clock.GetUTCNow()
+	for name, age := range map[string]time.Duration{
+		"/spool/expired.dat":  3 * time.Hour,
+		"/spool/1.dat":        50 * time.Minute,
+		"/spool/2.dat":        40 * time.Minute,
+		"/spool/3.log":        30 * time.Minute,
+		"/spool/4.dat":        20 * time.Minute,
+		"/spool/keep/old.dat": 5 * time.Hour,
+	} {
+		fp, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+		require.NoError(t, err)
+		_, err = fp.Write(make([]byte, 10))
+		require.NoError(t, err)
+		require.NoError(t, fp.Close())
+		require.NoError(t, fsys.Chtimes(name, now.Add(-age), now.Add(-age)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reports := make(chan *DirJanitorReport, 1)
+	j, err := NewDirJanitor(ctx, "/spool",
+		WithDirJanitorFS(fsys),
+		WithDirJanitorTTL(time.Hour),
+		WithDirJanitorMaxSizeByte(35),
+		WithDirJanitorInclude("*.dat"),
+		WithDirJanitorExclude("keep"),
+		WithDirJanitorInterval(time.Hour),
+		WithDirJanitorCallback(func(r *DirJanitorReport) {
+			reports <- r
+		}),
+	)
+	require.NoError(t, err)
+
+	var report *DirJanitorReport
+	select {
+	case report = <-reports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait report timeout")
+	}
+
+	// 3.log & keep/old.dat are counted but never removed
+	require.Len(t, report.Removed, 3)
+	require.Equal(t, "/spool/expired.dat", report.Removed[0].Path)
+	require.Equal(t, DirJanitorRemoveByTTL, report.Removed[0].Reason)
+	require.Equal(t, "/spool/1.dat", report.Removed[1].Path)
+	require.Equal(t, DirJanitorRemoveBySize, report.Removed[1].Reason)
+	require.Equal(t, "/spool/2.dat", report.Removed[2].Path)
+	require.Equal(t, int64(30), report.RemovedBytes)
+	require.Equal(t, int64(30), report.TotalBytes)
+	require.Equal(t, 3, report.TotalFiles)
+
+	files, err := ListFilesInDirFS(fsys, "/spool")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	// nothing to remove
+	report, err = j.Clean()
+	require.NoError(t, err)
+	require.Len(t, report.Removed, 0)
+
+	_, err = NewDirJanitor(ctx, "/spool", WithDirJanitorFS(fsys))
+	require.Error(t, err)
+}
@@ -0,0 +1,474 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	// JWKKeyTypeRSA RSA key
+	JWKKeyTypeRSA = "RSA"
+	// JWKKeyTypeEC elliptic curve key
+	JWKKeyTypeEC = "EC"
+	// JWKKeyTypeOKP octet key pair, like Ed25519
+	JWKKeyTypeOKP = "OKP"
+	// JWKKeyTypeOct symmetric key
+	JWKKeyTypeOct = "oct"
+
+	defaultJWKSRefreshInterval    = time.Hour
+	defaultJWKSMinRefreshInterval = time.Minute
+	defaultJWKSFetchTimeout       = 10 * time.Second
+	// defaultJWKSMaxSizeByte max size of remote JWKS document
+	defaultJWKSMaxSizeByte = 1024 * 1024
+)
+
+var jwkB64 = base64.RawURLEncoding
+
+// JWK json web key
+//
+// https://datatracker.ietf.org/doc/html/rfc7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// Crv curve of EC/OKP key
+	Crv string `json:"crv,omitempty"`
+	// X, Y coordinates of EC key, OKP key only has X
+	X string `json:"x,omitempty"`
+	Y string `json:"y,omitempty"`
+
+	// N, E modulus and exponent of RSA key
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// K symmetric key
+	K string `json:"k,omitempty"`
+}
+
+// NewJWK create JWK from public key or symmetric key
+//
+// support *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey and []byte,
+// private keys will be converted to their public keys.
+func NewJWK(key interface{}, kid string) (*JWK, error) {
+	jwk := &JWK{Kid: kid}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return NewJWK(&k.PublicKey, kid)
+	case *ecdsa.PrivateKey:
+		return NewJWK(&k.PublicKey, kid)
+	case ed25519.PrivateKey:
+		return NewJWK(k.Public(), kid)
+	case *rsa.PublicKey:
+		jwk.Kty = JWKKeyTypeRSA
+		jwk.N = jwkB64.EncodeToString(k.N.Bytes())
+		jwk.E = jwkB64.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = JWKKeyTypeEC
+		jwk.Crv = k.Curve.Params().Name
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk.X = jwkB64.EncodeToString(padBigBytes(k.X, size))
+		jwk.Y = jwkB64.EncodeToString(padBigBytes(k.Y, size))
+	case ed25519.PublicKey:
+		jwk.Kty = JWKKeyTypeOKP
+		jwk.Crv = "Ed25519"
+		jwk.X = jwkB64.EncodeToString(k)
+	case []byte:
+		jwk.Kty = JWKKeyTypeOct
+		jwk.K = jwkB64.EncodeToString(k)
+	default:
+		return nil, errors.Errorf("unsupported key type %T", key)
+	}
+
+	return jwk, nil
+}
+
+func padBigBytes(b *big.Int, size int) []byte {
+	bs := b.Bytes()
+	if len(bs) >= size {
+		return bs
+	}
+
+	return append(make([]byte, size-len(bs)), bs...)
+}
+
+// Key convert JWK to key that can be used to verify signature
+//
+// return *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or []byte
+func (k *JWK) Key() (interface{}, error) {
+	switch k.Kty {
+	case JWKKeyTypeRSA:
+		n, err := jwkB64.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode `n`")
+		}
+		e, err := jwkB64.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode `e`")
+		}
+		if len(n) == 0 || len(e) == 0 {
+			return nil, errors.Errorf("`n` and `e` cannot be empty")
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case JWKKeyTypeEC:
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve `%s`", k.Crv)
+		}
+
+		x, err := jwkB64.DecodeString(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode `x`")
+		}
+		y, err := jwkB64.DecodeString(k.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode `y`")
+		}
+
+		pubKey := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(pubKey.X, pubKey.Y) {
+			return nil, errors.Errorf("point is not on curve `%s`", k.Crv)
+		}
+
+		return pubKey, nil
+	case JWKKeyTypeOKP:
+		if k.Crv != "Ed25519" {
+			return nil, errors.Errorf("unsupported curve `%s`", k.Crv)
+		}
+
+		x, err := jwkB64.DecodeString(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode `x`")
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.Errorf("invalid ed25519 public key size %d", len(x))
+		}
+
+		return ed25519.PublicKey(x), nil
+	case JWKKeyTypeOct:
+		secret, err := jwkB64.DecodeString(k.K)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode `k`")
+		}
+		if len(secret) == 0 {
+			return nil, errors.Errorf("`k` cannot be empty")
+		}
+
+		return secret, nil
+	default:
+		return nil, errors.Errorf("unsupported key type `%s`", k.Kty)
+	}
+}
+
+// JWKS json web key set
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// ParseJWKS parse JWKS document
+func ParseJWKS(cnt []byte) (*JWKS, error) {
+	jwks := new(JWKS)
+	if err := JSON.Unmarshal(cnt, jwks); err != nil {
+		return nil, errors.Wrap(err, "unmarshal jwks")
+	}
+
+	return jwks, nil
+}
+
+// Get get JWK by kid
+func (s *JWKS) Get(kid string) (*JWK, bool) {
+	for _, k := range s.Keys {
+		if k.Kid == kid {
+			return k, true
+		}
+	}
+
+	return nil, false
+}
+
+type jwksEntry struct {
+	jwk *JWK
+	key interface{}
+}
+
+// JWKSProvider load JWKS from file or http url,
+// cache keys in memory and refresh periodically.
+type JWKSProvider struct {
+	source string
+	refreshInterval,
+	minRefreshInterval time.Duration
+	httpClient *http.Client
+
+	// refreshMu make sure only one refresh for unknown kid at the same time
+	refreshMu sync.Mutex
+
+	mu          sync.RWMutex
+	keys        map[string]*jwksEntry
+	etag string
+	// lastAttempt time of last refresh, no matter succeed or not
+	lastAttempt time.Time
+}
+
+// JWKSProviderOptFunc options for JWKSProvider
+type JWKSProviderOptFunc func(*JWKSProvider) error
+
+// WithJWKSRefreshInterval set how often to refresh JWKS in background
+//
+// default to 1h
+func WithJWKSRefreshInterval(interval time.Duration) JWKSProviderOptFunc {
+	return func(p *JWKSProvider) error {
+		if interval <= 0 {
+			return errors.Errorf("interval should greater than 0, got %s", interval)
+		}
+
+		p.refreshInterval = interval
+		return nil
+	}
+}
+
+// WithJWKSMinRefreshInterval set the minimal interval between two refreshing
+// triggered by unknown kid, to prevent from flooding the JWKS server
+//
+// default to 1m
+func WithJWKSMinRefreshInterval(interval time.Duration) JWKSProviderOptFunc {
+	return func(p *JWKSProvider) error {
+		if interval < 0 {
+			return errors.Errorf("interval should greater than or equal to 0, got %s", interval)
+		}
+
+		p.minRefreshInterval = interval
+		return nil
+	}
+}
+
+// WithJWKSHTTPClient set http client to fetch JWKS
+func WithJWKSHTTPClient(cli *http.Client) JWKSProviderOptFunc {
+	return func(p *JWKSProvider) error {
+		if cli == nil {
+			return errors.Errorf("http client cannot be nil")
+		}
+
+		p.httpClient = cli
+		return nil
+	}
+}
+
+// NewJWKSProvider create new JWKSProvider
+//
+// Args:
+//   * source: file path or http(s) url of JWKS document
+//
+// will load JWKS immediately, then refresh in background until ctx done.
+func NewJWKSProvider(ctx context.Context, source string, opts ...JWKSProviderOptFunc) (p *JWKSProvider, err error) {
+	p = &JWKSProvider{
+		source:             source,
+		refreshInterval:    defaultJWKSRefreshInterval,
+		minRefreshInterval: defaultJWKSMinRefreshInterval,
+		httpClient:         httpClient,
+		keys:               map[string]*jwksEntry{},
+	}
+	for _, optf := range opts {
+		if err = optf(p); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	if err = p.Refresh(ctx); err != nil {
+		return nil, errors.Wrap(err, "load jwks")
+	}
+
+	go p.runRefresh(ctx)
+	return p, nil
+}
+
+func (p *JWKSProvider) runRefresh(ctx context.Context) {
+	ticker := time.NewTicker(p.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := p.Refresh(ctx); err != nil {
+			Logger.Error("refresh jwks", zap.Error(err), zap.String("source", p.source))
+		}
+	}
+}
+
+func (p *JWKSProvider) isHTTP() bool {
+	return strings.HasPrefix(p.source, "http://") ||
+		strings.HasPrefix(p.source, "https://")
+}
+
+// fetch load JWKS document, return nil content if not modified
+func (p *JWKSProvider) fetch(ctx context.Context) (cnt []byte, etag string, err error) {
+	if !p.isHTTP() {
+		if cnt, err = ioutil.ReadFile(p.source); err != nil {
+			return nil, "", errors.Wrapf(err, "read file `%s`", p.source)
+		}
+
+		return cnt, "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultJWKSFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, p.source, nil)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+
+	p.mu.RLock()
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	p.mu.RUnlock()
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "request `%s`", p.source)
+	}
+	defer CloseQuietly(resp.Body)
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, "", nil
+	}
+	if err = CheckResp(resp); err != nil {
+		return nil, "", errors.Wrapf(err, "request `%s`", p.source)
+	}
+
+	if cnt, err = ioutil.ReadAll(io.LimitReader(resp.Body, defaultJWKSMaxSizeByte+1)); err != nil {
+		return nil, "", errors.Wrap(err, "read response body")
+	}
+	if len(cnt) > defaultJWKSMaxSizeByte {
+		return nil, "", errors.Errorf("jwks document exceeds %d bytes", defaultJWKSMaxSizeByte)
+	}
+
+	return cnt, resp.Header.Get("ETag"), nil
+}
+
+// Refresh reload JWKS immediately
+func (p *JWKSProvider) Refresh(ctx context.Context) error {
+	p.mu.Lock()
+	p.lastAttempt = Clock.GetUTCNow()
+	p.mu.Unlock()
+
+	cnt, etag, err := p.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	if cnt == nil {
+		// not modified
+		return nil
+	}
+
+	jwks, err := ParseJWKS(cnt)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*jwksEntry, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.Key()
+		if err != nil {
+			Logger.Warn("skip invalid jwk", zap.Error(err), zap.String("kid", jwk.Kid))
+			continue
+		}
+
+		keys[jwk.Kid] = &jwksEntry{jwk: jwk, key: key}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.etag = etag
+	p.mu.Unlock()
+
+	Logger.Debug("refreshed jwks", zap.String("source", p.source), zap.Int("n_keys", len(keys)))
+	return nil
+}
+
+// GetKey get key by kid
+//
+// will refresh JWKS if kid not found,
+// at most once every `minRefreshInterval` even if refresh failed,
+// concurrent callers share the same refresh.
+func (p *JWKSProvider) GetKey(kid string) (jwk *JWK, key interface{}, err error) {
+	if ent, ok := p.getKey(kid); ok {
+		return ent.jwk, ent.key, nil
+	}
+
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+
+	// may be refreshed by other callers
+	p.mu.RLock()
+	ent, ok := p.keys[kid]
+	lastAttempt := p.lastAttempt
+	p.mu.RUnlock()
+	if ok {
+		return ent.jwk, ent.key, nil
+	}
+
+	if Clock.GetUTCNow().Sub(lastAttempt) < p.minRefreshInterval {
+		return nil, nil, errors.Errorf("unknown kid `%s`", kid)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultJWKSFetchTimeout)
+	defer cancel()
+	if err = p.Refresh(ctx); err != nil {
+		return nil, nil, errors.Wrap(err, "refresh jwks")
+	}
+
+	if ent, ok = p.getKey(kid); !ok {
+		return nil, nil, errors.Errorf("unknown kid `%s`", kid)
+	}
+
+	return ent.jwk, ent.key, nil
+}
+
+func (p *JWKSProvider) getKey(kid string) (*jwksEntry, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ent, ok := p.keys[kid]
+	return ent, ok
+}
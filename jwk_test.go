@@ -0,0 +1,264 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWK_Key(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	esKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for _, key := range []interface{}{
+		&rsaKey.PublicKey,
+		&esKey.PublicKey,
+		edPub,
+		secret,
+	} {
+		jwk, err := NewJWK(key, "kid")
+		require.NoError(t, err)
+
+		got, err := jwk.Key()
+		require.NoError(t, err)
+		require.Equal(t, key, got)
+	}
+
+	_, err = NewJWK("123", "kid")
+	require.Error(t, err)
+
+	_, err = (&JWK{Kty: JWKKeyTypeEC, Crv: "P-256", X: "AQ", Y: "AQ"}).Key()
+	require.Error(t, err)
+
+	_, err = (&JWK{Kty: "unknown"}).Key()
+	require.Error(t, err)
+}
+
+func testNewJWKSDocument(t *testing.T, keys map[string]interface{}) []byte {
+	jwks := new(JWKS)
+	for kid, key := range keys {
+		jwk, err := NewJWK(key, kid)
+		require.NoError(t, err)
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	cnt, err := JSON.Marshal(jwks)
+	require.NoError(t, err)
+	return cnt
+}
+
+func TestJWTWithJWKSFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "TestJWTWithJWKSFile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	esPub, err := DecodeECDSAPublicKey(es256PubByte)
+	require.NoError(t, err)
+
+	fpath := filepath.Join(dir, "jwks.json")
+	err = ioutil.WriteFile(fpath, testNewJWKSDocument(t, map[string]interface{}{
+		"es": esPub,
+		"hs": secret,
+	}), 0644)
+	require.NoError(t, err)
+
+	jwks, err := NewJWKSProvider(ctx, fpath, WithJWKSMinRefreshInterval(0))
+	require.NoError(t, err)
+
+	verifier, err := NewJWT(
+		WithJWTSignMethod(SignMethodES256),
+		WithJWTAllowedSignMethods(SignMethodES256, SignMethodHS256),
+		WithJWTJWKS(jwks),
+	)
+	require.NoError(t, err)
+
+	jwtES256, err := NewJWT(
+		WithJWTSignMethod(SignMethodES256),
+		WithJWTPriKeyByte(es256PriByte),
+		WithJWTKeyID("es"),
+	)
+	require.NoError(t, err)
+
+	claims := &jwt.StandardClaims{Subject: "laisky"}
+	token, err := jwtES256.Sign(claims)
+	require.NoError(t, err)
+
+	got := new(jwt.StandardClaims)
+	err = verifier.ParseClaims(token, got)
+	require.NoError(t, err)
+	require.Equal(t, "laisky", got.Subject)
+
+	// overwrite kid
+	token, err = jwtES256.Sign(claims, WithJWTDivideKeyID("not-exists"))
+	require.NoError(t, err)
+	err = verifier.ParseClaims(token, got)
+	require.Error(t, err)
+
+	// no kid
+	token, err = jwtES256.Sign(claims, WithJWTDivideKeyID(""))
+	require.NoError(t, err)
+	err = verifier.ParseClaims(token, got)
+	require.Error(t, err)
+
+	// alg confusion: hs256 token signed by ecdsa public key
+	jwtConfusion, err := NewJWT(
+		WithJWTSignMethod(SignMethodHS256),
+		WithJWTSecretByte(es256PubByte),
+		WithJWTKeyID("es"),
+	)
+	require.NoError(t, err)
+	token, err = jwtConfusion.Sign(claims)
+	require.NoError(t, err)
+	err = verifier.ParseClaims(token, got)
+	require.Error(t, err)
+
+	// symmetric key in jwks
+	jwtHS256, err := NewJWT(
+		WithJWTSignMethod(SignMethodHS256),
+		WithJWTSecretByte(secret),
+		WithJWTKeyID("hs"),
+	)
+	require.NoError(t, err)
+	token, err = jwtHS256.Sign(claims)
+	require.NoError(t, err)
+	err = verifier.ParseClaims(token, got)
+	require.NoError(t, err)
+
+	// refresh on unknown kid
+	err = ioutil.WriteFile(fpath, testNewJWKSDocument(t, map[string]interface{}{
+		"es-new": esPub,
+	}), 0644)
+	require.NoError(t, err)
+	token, err = jwtES256.Sign(claims, WithJWTDivideKeyID("es-new"))
+	require.NoError(t, err)
+	err = verifier.ParseClaims(token, got)
+	require.NoError(t, err)
+}
+
+func TestJWKSProviderHTTP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	esPub, err := DecodeECDSAPublicKey(es256PubByte)
+	require.NoError(t, err)
+	doc := testNewJWKSDocument(t, map[string]interface{}{"es": esPub})
+
+	var nFetched, nNotModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/404" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&nNotModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		atomic.AddInt32(&nFetched, 1)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(doc)
+	}))
+	defer srv.Close()
+
+	jwks, err := NewJWKSProvider(ctx, srv.URL,
+		WithJWKSRefreshInterval(50*time.Millisecond),
+		WithJWKSMinRefreshInterval(time.Hour),
+	)
+	require.NoError(t, err)
+
+	jwk, key, err := jwks.GetKey("es")
+	require.NoError(t, err)
+	require.Equal(t, JWKKeyTypeEC, jwk.Kty)
+	require.Equal(t, esPub, key)
+
+	// do not refresh too often for unknown kid
+	_, _, err = jwks.GetKey("unknown")
+	require.Error(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&nFetched))
+	require.True(t, atomic.LoadInt32(&nNotModified) > 0)
+
+	_, _, err = jwks.GetKey("es")
+	require.NoError(t, err)
+
+	_, err = NewJWKSProvider(ctx, srv.URL+"/404")
+	require.Error(t, err)
+
+	t.Run("unknown kid when source down", func(t *testing.T) {
+		var down int32
+		var nRequested int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&nRequested, 1)
+			if atomic.LoadInt32(&down) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			_, _ = w.Write(doc)
+		}))
+		defer srv.Close()
+
+		jwks, err := NewJWKSProvider(ctx, srv.URL,
+			WithJWKSMinRefreshInterval(100*time.Millisecond),
+		)
+		require.NoError(t, err)
+		atomic.StoreInt32(&down, 1)
+		time.Sleep(150 * time.Millisecond)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, _, err := jwks.GetKey(strconv.Itoa(i))
+				require.Error(t, err)
+			}(i)
+		}
+		wg.Wait()
+
+		// failed refresh also limits the rate
+		_, _, err = jwks.GetKey("unknown")
+		require.Error(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(&nRequested))
+	})
+
+	t.Run("document too large", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(bytes.Repeat([]byte(" "), defaultJWKSMaxSizeByte+1))
+		}))
+		defer srv.Close()
+
+		_, err := NewJWKSProvider(ctx, srv.URL)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "exceeds")
+	})
+
+	_, err = NewJWKSProvider(ctx, srv.URL, WithJWKSRefreshInterval(0))
+	require.Error(t, err)
+}
@@ -1,6 +1,14 @@
 package utils
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
 	"github.com/form3tech-oss/jwt-go"
 	"github.com/pkg/errors"
 )
@@ -8,24 +16,95 @@ import (
 var (
 	// SignMethodHS256 use HS256 for jwt
 	SignMethodHS256 = jwt.SigningMethodHS256
+	// SignMethodHS384 use HS384 for jwt
+	SignMethodHS384 = jwt.SigningMethodHS384
+	// SignMethodHS512 use HS512 for jwt
+	SignMethodHS512 = jwt.SigningMethodHS512
 	// SignMethodES256 use ES256 for jwt
 	SignMethodES256 = jwt.SigningMethodES256
+	// SignMethodES384 use ES384 for jwt
+	SignMethodES384 = jwt.SigningMethodES384
+	// SignMethodES512 use ES512 for jwt
+	SignMethodES512 = jwt.SigningMethodES512
+	// SignMethodRS256 use RS256 for jwt
 	SignMethodRS256 = jwt.SigningMethodRS256
+	// SignMethodRS384 use RS384 for jwt
+	SignMethodRS384 = jwt.SigningMethodRS384
+	// SignMethodRS512 use RS512 for jwt
+	SignMethodRS512 = jwt.SigningMethodRS512
+	// SignMethodPS256 use PS256 for jwt
+	SignMethodPS256 = jwt.SigningMethodPS256
+	// SignMethodEdDSA use EdDSA(Ed25519) for jwt
+	SignMethodEdDSA = &SigningMethodEdDSA{}
 
 	defaultSignMethod = SignMethodHS256
 )
 
+func init() {
+	jwt.RegisterSigningMethod(SignMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SignMethodEdDSA
+	})
+}
+
+// SigningMethodEdDSA implements the EdDSA signing method for jwt,
+// only support Ed25519
+type SigningMethodEdDSA struct{}
+
+// Alg return the alg identifier `EdDSA`
+func (m *SigningMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Verify verify signature by ed25519.PublicKey
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pubKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pubKey, []byte(signingString), sig) {
+		return errors.New("ed25519 verification failed")
+	}
+
+	return nil
+}
+
+// Sign sign by ed25519.PrivateKey
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(priKey, []byte(signingString))), nil
+}
+
+const jwtHeaderKid = "kid"
+
 // ParseJWTTokenWithoutValidate parse and get payload without validate jwt token
 func ParseJWTTokenWithoutValidate(token string, payload jwt.Claims) (err error) {
 	_, _, err = new(jwt.Parser).ParseUnverified(token, payload)
 	return err
 }
 
-// JWT is token utils that support HS256/ES256
+// JWT is token utils that support HS256/384/512, RS256/384/512, PS256, ES256/384/512 and EdDSA
 type JWT struct {
 	secret,
 	priKey, pubKey []byte
 	signingMethod jwt.SigningMethod
+	// allowedMethods algs that allowed in parsing,
+	// default to signingMethod only
+	allowedMethods []string
+	// kid key id emitted in header when signing
+	kid  string
+	jwks *JWKSProvider
+	// revocation check `jti` in parsing
+	revocation JWTRevocationStore
 }
 
 // JWTOptFunc options to setup JWT
@@ -39,6 +118,29 @@ func WithJWTSignMethod(method jwt.SigningMethod) JWTOptFunc {
 	}
 }
 
+// WithJWTAllowedSignMethods set signing methods that allowed in parsing
+//
+// default to the method set by `WithJWTSignMethod` only.
+// token signed by other methods will be rejected, to prevent from alg confusion.
+func WithJWTAllowedSignMethods(methods ...jwt.SigningMethod) JWTOptFunc {
+	return func(e *JWT) error {
+		if len(methods) == 0 {
+			return errors.Errorf("methods cannot be empty")
+		}
+
+		e.allowedMethods = nil
+		for _, m := range methods {
+			if m == nil {
+				return errors.Errorf("method cannot be nil")
+			}
+
+			e.allowedMethods = append(e.allowedMethods, m.Alg())
+		}
+
+		return nil
+	}
+}
+
 // WithJWTSecretByte set jwt symmetric signning key
 func WithJWTSecretByte(secret []byte) JWTOptFunc {
 	return func(e *JWT) error {
@@ -63,9 +165,54 @@ func WithJWTPubKeyByte(pubkey []byte) JWTOptFunc {
 	}
 }
 
+// WithJWTKeyID set `kid` that will be emitted in header when signing
+func WithJWTKeyID(kid string) JWTOptFunc {
+	return func(e *JWT) error {
+		e.kid = kid
+		return nil
+	}
+}
+
+// WithJWTJWKS verify token by the key in JWKS that matches token's `kid`
+//
+// will ignore public key and secret in parsing.
+func WithJWTJWKS(jwks *JWKSProvider) JWTOptFunc {
+	return func(e *JWT) error {
+		if jwks == nil {
+			return errors.Errorf("jwks cannot be nil")
+		}
+
+		e.jwks = jwks
+		return nil
+	}
+}
+
+// WithJWTRevocationStore reject token whose `jti` is revoked in parsing
+func WithJWTRevocationStore(store JWTRevocationStore) JWTOptFunc {
+	return func(e *JWT) error {
+		if store == nil {
+			return errors.Errorf("store cannot be nil")
+		}
+
+		e.revocation = store
+		return nil
+	}
+}
+
 type jwtDivideOpt struct {
 	priKey, pubKey,
 	secret []byte
+	kid string
+
+	// claims validation in parsing
+	issuer         string
+	audiences      []string
+	requiredClaims []string
+	leeway,
+	maxAge time.Duration
+	revocation JWTRevocationStore
+	// skipClaims only verify signature in parsing
+	skipClaims bool
 }
 
 // JWTDiviceOptFunc options to use separate secret for every user in parsing/signing
@@ -95,6 +242,80 @@ func WithJWTDividePubKey(pubKey []byte) JWTDiviceOptFunc {
 	}
 }
 
+// WithJWTDivideKeyID set `kid` for each signning
+func WithJWTDivideKeyID(kid string) JWTDiviceOptFunc {
+	return func(opt *jwtDivideOpt) error {
+		opt.kid = kid
+		return nil
+	}
+}
+
+// WithJWTExpectIssuer validate `iss` equals to issuer in parsing
+func WithJWTExpectIssuer(issuer string) JWTDiviceOptFunc {
+	return func(opt *jwtDivideOpt) error {
+		if issuer == "" {
+			return errors.Errorf("issuer cannot be empty")
+		}
+
+		opt.issuer = issuer
+		return nil
+	}
+}
+
+// WithJWTExpectAudience validate `aud` contains any of audiences in parsing
+func WithJWTExpectAudience(audiences ...string) JWTDiviceOptFunc {
+	return func(opt *jwtDivideOpt) error {
+		if len(audiences) == 0 {
+			return errors.Errorf("audiences cannot be empty")
+		}
+
+		opt.audiences = audiences
+		return nil
+	}
+}
+
+// WithJWTLeeway set clock skew tolerance for `exp`, `nbf`, `iat` in parsing
+func WithJWTLeeway(leeway time.Duration) JWTDiviceOptFunc {
+	return func(opt *jwtDivideOpt) error {
+		if leeway < 0 {
+			return errors.Errorf("leeway should greater than or equal to 0, got %s", leeway)
+		}
+
+		opt.leeway = leeway
+		return nil
+	}
+}
+
+// WithJWTRequiredClaims validate claims exist in parsing
+func WithJWTRequiredClaims(names ...string) JWTDiviceOptFunc {
+	return func(opt *jwtDivideOpt) error {
+		opt.requiredClaims = append(opt.requiredClaims, names...)
+		return nil
+	}
+}
+
+// withoutJWTRevocation skip checking revocation in parsing,
+// signature and other claims are still validated.
+func withoutJWTRevocation() JWTDiviceOptFunc {
+	return func(opt *jwtDivideOpt) error {
+		opt.revocation = nil
+		return nil
+	}
+}
+
+// WithJWTMaxAge validate token is issued (`iat`) within maxAge in parsing,
+// `iat` will be required.
+func WithJWTMaxAge(maxAge time.Duration) JWTDiviceOptFunc {
+	return func(opt *jwtDivideOpt) error {
+		if maxAge <= 0 {
+			return errors.Errorf("maxAge should greater than 0, got %s", maxAge)
+		}
+
+		opt.maxAge = maxAge
+		return nil
+	}
+}
+
 // NewJWT create new JWT utils
 func NewJWT(opts ...JWTOptFunc) (e *JWT, err error) {
 	e = &JWT{
@@ -107,151 +328,485 @@ func NewJWT(opts ...JWTOptFunc) (e *JWT, err error) {
 		}
 	}
 
-	return
-}
-
-// Sign sign claims to token
-func (e *JWT) Sign(claims jwt.Claims, opts ...JWTDiviceOptFunc) (string, error) {
-	switch e.signingMethod {
-	case SignMethodHS256:
-		return e.SignByHS256(claims, opts...)
-	case SignMethodES256:
-		return e.SignByES256(claims, opts...)
+	if e.signingMethod == nil {
+		return nil, errors.Errorf("signing method cannot be nil")
+	}
+	if len(e.allowedMethods) == 0 {
+		e.allowedMethods = []string{e.signingMethod.Alg()}
 	}
 
-	return "", errors.Errorf("unknown signmethod `%s`", e.signingMethod)
+	return
 }
 
-// SignByHS256 signing claims by HS256
-func (e *JWT) SignByHS256(claims jwt.Claims, opts ...JWTDiviceOptFunc) (string, error) {
+func (e *JWT) divideOpt(opts ...JWTDiviceOptFunc) (*jwtDivideOpt, error) {
 	opt := &jwtDivideOpt{
-		secret: e.secret,
+		secret:     e.secret,
+		pubKey:     e.pubKey,
+		priKey:     e.priKey,
+		kid:        e.kid,
+		revocation: e.revocation,
 	}
 	for _, optf := range opts {
 		if err := optf(opt); err != nil {
-			return "", errors.Wrap(err, "apply optf")
+			return nil, errors.Wrap(err, "apply optf")
 		}
 	}
 
-	token := jwt.NewWithClaims(SignMethodHS256, claims)
-	return token.SignedString(opt.secret)
+	return opt, nil
+}
+
+// Sign sign claims to token by the method set by `WithJWTSignMethod`
+func (e *JWT) Sign(claims jwt.Claims, opts ...JWTDiviceOptFunc) (string, error) {
+	return e.signByMethod(e.signingMethod, claims, opts...)
+}
+
+// SignByHS256 signing claims by HS256
+func (e *JWT) SignByHS256(claims jwt.Claims, opts ...JWTDiviceOptFunc) (string, error) {
+	return e.signByMethod(SignMethodHS256, claims, opts...)
 }
 
 // SignByES256 signing claims by ES256
 func (e *JWT) SignByES256(claims jwt.Claims, opts ...JWTDiviceOptFunc) (string, error) {
-	opt := &jwtDivideOpt{
-		pubKey: e.pubKey,
-		priKey: e.priKey,
+	return e.signByMethod(SignMethodES256, claims, opts...)
+}
+
+// SignByRS256 signing claims by RS256
+func (e *JWT) SignByRS256(claims jwt.Claims, opts ...JWTDiviceOptFunc) (string, error) {
+	return e.signByMethod(SignMethodRS256, claims, opts...)
+}
+
+func (e *JWT) signByMethod(method jwt.SigningMethod, claims jwt.Claims, opts ...JWTDiviceOptFunc) (string, error) {
+	opt, err := e.divideOpt(opts...)
+	if err != nil {
+		return "", err
 	}
-	for _, optf := range opts {
-		if err := optf(opt); err != nil {
-			return "", errors.Wrap(err, "apply optf")
+
+	key, err := jwtSignKey(method, opt)
+	if err != nil {
+		return "", errors.Wrapf(err, "load %s signing key", method.Alg())
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	setJWTKeyID(token, opt.kid)
+	return token.SignedString(key)
+}
+
+func setJWTKeyID(token *jwt.Token, kid string) {
+	if kid != "" {
+		token.Header[jwtHeaderKid] = kid
+	}
+}
+
+// jwtSignKey load signing key for method
+func jwtSignKey(method jwt.SigningMethod, opt *jwtDivideOpt) (interface{}, error) {
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(opt.secret) == 0 {
+			return nil, errors.New("secret is empty")
 		}
+
+		return opt.secret, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return jwt.ParseRSAPrivateKeyFromPEM(opt.priKey)
+	case *jwt.SigningMethodECDSA:
+		return jwt.ParseECPrivateKeyFromPEM(opt.priKey)
+	case *SigningMethodEdDSA:
+		return parseEd25519PrivateKeyFromPEM(opt.priKey)
+	default:
+		return nil, errors.Errorf("unknown sign method `%s`", method.Alg())
 	}
+}
+
+// jwtVerifyKey load verifying key for method,
+// will use the public key of private key if public key is empty
+func jwtVerifyKey(method jwt.SigningMethod, opt *jwtDivideOpt) (interface{}, error) {
+	if _, ok := method.(*jwt.SigningMethodHMAC); !ok && len(opt.pubKey) == 0 {
+		priKey, err := jwtSignKey(method, opt)
+		if err != nil {
+			return nil, errors.Wrap(err, "public key is empty, try to load private key")
+		}
 
-	token := jwt.NewWithClaims(SignMethodES256, claims)
-	priKey, err := jwt.ParseECPrivateKeyFromPEM(opt.priKey)
+		switch k := priKey.(type) {
+		case *rsa.PrivateKey:
+			return &k.PublicKey, nil
+		case *ecdsa.PrivateKey:
+			return &k.PublicKey, nil
+		case ed25519.PrivateKey:
+			return k.Public(), nil
+		}
+	}
+
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(opt.secret) == 0 {
+			return nil, errors.New("secret is empty")
+		}
+
+		return opt.secret, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return parseRSAPublicKeyFromPEM(opt.pubKey)
+	case *jwt.SigningMethodECDSA:
+		return jwt.ParseECPublicKeyFromPEM(opt.pubKey)
+	case *SigningMethodEdDSA:
+		return parseEd25519PublicKeyFromPEM(opt.pubKey)
+	default:
+		return nil, errors.Errorf("unknown sign method `%s`", method.Alg())
+	}
+}
+
+// parseRSAPublicKeyFromPEM parse PKIX, certificate or PKCS1 public key
+func parseRSAPublicKeyFromPEM(pemEncoded []byte) (*rsa.PublicKey, error) {
+	pubKey, err := jwt.ParseRSAPublicKeyFromPEM(pemEncoded)
+	if err == nil {
+		return pubKey, nil
+	}
+
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+	if pubKey, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+		return nil, errors.Wrap(err, "parse rsa public key")
+	}
+
+	return pubKey, nil
+}
+
+func parseEd25519PrivateKeyFromPEM(pemEncoded []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse pkcs8 private key")
+	}
+
+	priKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("key is not ed25519 private key")
+	}
+
+	return priKey, nil
+}
+
+func parseEd25519PublicKeyFromPEM(pemEncoded []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		return "", errors.Wrap(err, "parse private key")
+		if cert, cerr := x509.ParseCertificate(block.Bytes); cerr == nil {
+			key = cert.PublicKey
+		} else {
+			return nil, errors.Wrap(err, "parse pkix public key")
+		}
 	}
 
-	return token.SignedString(priKey)
+	pubKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("key is not ed25519 public key")
+	}
+
+	return pubKey, nil
 }
 
 // ParseClaims parse token to claims
+//
+// only accept token signed by the methods set by `WithJWTAllowedSignMethods`,
+// default to the method set by `WithJWTSignMethod`.
+//
+// if JWKS is set by `WithJWTJWKS`, will verify token by the key matches token's `kid`.
+//
+// `exp`, `nbf` and `iat` are validated by package `Clock`,
+// and can be tolerated by `WithJWTLeeway`.
+// `claimsPtr.Valid()` will be invoked for custom validation,
+// but its errors about `exp`, `nbf` and `iat` are ignored.
 func (e *JWT) ParseClaims(token string, claimsPtr jwt.Claims, opts ...JWTDiviceOptFunc) error {
 	if !IsPtr(claimsPtr) {
 		return errors.New("claimsPtr must be a pointer")
 	}
 
-	switch e.signingMethod {
-	case SignMethodHS256:
-		return e.ParseClaimsByHS256(token, claimsPtr, opts...)
-	case SignMethodES256:
-		return e.ParseClaimsByES256(token, claimsPtr, opts...)
-	default:
-		return errors.Errorf("unknown sign method `%s`", e.signingMethod)
+	if e.jwks != nil {
+		return e.ParseClaimsByJWKS(token, claimsPtr, opts...)
 	}
+
+	return e.parseClaimsByMethods(e.allowedMethods, token, claimsPtr, opts...)
+}
+
+// VerifySignature verify signature of token by the same keys and methods as ParseClaims,
+// claims are not validated.
+func (e *JWT) VerifySignature(token string) error {
+	return e.ParseClaims(token, &jwt.MapClaims{}, func(opt *jwtDivideOpt) error {
+		opt.skipClaims = true
+		return nil
+	})
 }
 
 // ParseClaimsByHS256 parse token to claims by HS256
 func (e *JWT) ParseClaimsByHS256(token string, claimsPtr jwt.Claims, opts ...JWTDiviceOptFunc) error {
-	opt := &jwtDivideOpt{
-		secret: e.secret,
+	return errors.Wrap(
+		e.parseClaimsByMethods([]string{SignMethodHS256.Alg()}, token, claimsPtr, opts...),
+		"parse token by hs256")
+}
+
+// ParseClaimsByES256 parse token to claims by ES256
+func (e *JWT) ParseClaimsByES256(token string, claimsPtr jwt.Claims, opts ...JWTDiviceOptFunc) error {
+	return errors.Wrap(
+		e.parseClaimsByMethods([]string{SignMethodES256.Alg()}, token, claimsPtr, opts...),
+		"parse token by es256")
+}
+
+// ParseClaimsByRS256 parse token to claims by rs256
+func (e *JWT) ParseClaimsByRS256(token string, claimsPtr jwt.Claims, opts ...JWTDiviceOptFunc) error {
+	return errors.Wrap(
+		e.parseClaimsByMethods([]string{SignMethodRS256.Alg()}, token, claimsPtr, opts...),
+		"parse token by rs256")
+}
+
+func (e *JWT) parseClaimsByMethods(algs []string, token string, claimsPtr jwt.Claims, opts ...JWTDiviceOptFunc) error {
+	opt, err := e.divideOpt(opts...)
+	if err != nil {
+		return err
 	}
-	for _, optf := range opts {
-		if err := optf(opt); err != nil {
-			return errors.Wrap(err, "apply optf")
+
+	parser := &jwt.Parser{
+		ValidMethods:         algs,
+		SkipClaimsValidation: true,
+	}
+	if _, err = parser.ParseWithClaims(token, claimsPtr, func(token *jwt.Token) (interface{}, error) {
+		key, err := jwtVerifyKey(token.Method, opt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load %s verifying key", token.Method.Alg())
 		}
+		if err = checkJWTMethodKey(token.Method, key); err != nil {
+			return nil, err
+		}
+
+		return key, nil
+	}); err != nil {
+		return errors.Wrap(err, "parse token")
+	}
+
+	if opt.skipClaims {
+		return nil
+	}
+	if err = validateJWTClaims(token, opt); err != nil {
+		return err
+	}
+
+	return validateCustomJWTClaims(claimsPtr)
+}
+
+// ParseClaimsByJWKS parse token to claims by the key in JWKS that matches token's `kid`
+func (e *JWT) ParseClaimsByJWKS(token string, claimsPtr jwt.Claims, opts ...JWTDiviceOptFunc) error {
+	if e.jwks == nil {
+		return errors.New("jwks is not set")
+	}
+
+	opt, err := e.divideOpt(opts...)
+	if err != nil {
+		return err
 	}
 
-	if _, err := jwt.ParseWithClaims(token, claimsPtr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.Errorf("unexpected signing method: %v", token.Header["alg"])
+	parser := &jwt.Parser{
+		ValidMethods:         e.allowedMethods,
+		SkipClaimsValidation: true,
+	}
+	if _, err := parser.ParseWithClaims(token, claimsPtr, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header[jwtHeaderKid].(string)
+		if kid == "" {
+			return nil, errors.New("token has no kid")
 		}
-		return opt.secret, nil
+
+		jwk, key, err := e.jwks.GetKey(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		if jwk.Alg != "" && jwk.Alg != token.Method.Alg() {
+			return nil, errors.Errorf("token alg `%s` not match key alg `%s`", token.Method.Alg(), jwk.Alg)
+		}
+		if err = checkJWTMethodKey(token.Method, key); err != nil {
+			return nil, err
+		}
+
+		return key, nil
 	}); err != nil {
-		return errors.Wrap(err, "parse token by hs256")
+		return errors.Wrap(err, "parse token by jwks")
 	}
 
-	return nil
+	if opt.skipClaims {
+		return nil
+	}
+	if err = validateJWTClaims(token, opt); err != nil {
+		return err
+	}
+
+	return validateCustomJWTClaims(claimsPtr)
 }
 
-// ParseClaimsByES256 parse token to claims by ES256
-func (e *JWT) ParseClaimsByES256(token string, claimsPtr jwt.Claims, opts ...JWTDiviceOptFunc) error {
-	opt := &jwtDivideOpt{
-		pubKey: e.pubKey,
-		priKey: e.priKey,
+// jwtTimeValidationErrors errors of time claims returned by `Valid()`,
+// time claims are validated by validateJWTClaims instead.
+const jwtTimeValidationErrors = jwt.ValidationErrorExpired |
+	jwt.ValidationErrorIssuedAt |
+	jwt.ValidationErrorNotValidYet
+
+// validateCustomJWTClaims invoke `claims.Valid()`,
+// ignore errors only about time claims
+func validateCustomJWTClaims(claims jwt.Claims) error {
+	err := claims.Valid()
+	if err == nil {
+		return nil
 	}
-	for _, optf := range opts {
-		if err := optf(opt); err != nil {
-			return errors.Wrap(err, "apply optf")
-		}
+
+	if verr, ok := err.(*jwt.ValidationError); ok &&
+		verr.Errors&^jwtTimeValidationErrors == 0 {
+		return nil
+	}
+
+	return errors.Wrap(err, "validate claims")
+}
+
+// validateJWTClaims validate standard claims of verified token
+func validateJWTClaims(token string, opt *jwtDivideOpt) error {
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{UseJSONNumber: true}
+	if _, _, err := parser.ParseUnverified(token, claims); err != nil {
+		return errors.Wrap(err, "parse claims")
+	}
+
+	now := Clock.GetUTCNow()
+	iat, hasIat, err := jwtTimeClaim(claims, "iat")
+	if err != nil {
+		return err
+	} else if hasIat && now.Add(opt.leeway).Before(iat) {
+		return errors.Errorf("token used before issued")
 	}
 
-	pubKey, err := jwt.ParseECPublicKeyFromPEM(opt.pubKey)
+	nbf, ok, err := jwtTimeClaim(claims, "nbf")
 	if err != nil {
-		return errors.Wrap(err, "parse es256 public key")
+		return err
+	} else if ok && now.Add(opt.leeway).Before(nbf) {
+		return errors.Errorf("token is not valid yet")
 	}
 
-	if _, err = jwt.ParseWithClaims(token, claimsPtr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
-			return nil, errors.Errorf("unexpected signing method: %v", token.Header["alg"])
+	exp, ok, err := jwtTimeClaim(claims, "exp")
+	if err != nil {
+		return err
+	} else if ok && now.After(exp.Add(opt.leeway)) {
+		return errors.Errorf("token is expired by %s", now.Sub(exp))
+	}
+
+	if opt.maxAge > 0 {
+		if !hasIat {
+			return errors.Errorf("token has no `iat`")
+		}
+		if now.Sub(iat) > opt.maxAge+opt.leeway {
+			return errors.Errorf("token is too old, issued at %s", iat.Format(time.RFC3339))
 		}
+	}
 
-		return pubKey, nil
-	}); err != nil {
-		return errors.Wrap(err, "parse token by es256")
+	if opt.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != opt.issuer {
+			return errors.Errorf("unexpected issuer `%s`", iss)
+		}
+	}
+
+	if len(opt.audiences) != 0 {
+		var auds []string
+		switch aud := claims["aud"].(type) {
+		case string:
+			auds = []string{aud}
+		case []interface{}:
+			for _, a := range aud {
+				if as, ok := a.(string); ok {
+					auds = append(auds, as)
+				}
+			}
+		}
+
+		matched := false
+	AUD_LOOP:
+		for _, expect := range opt.audiences {
+			for _, aud := range auds {
+				if aud == expect {
+					matched = true
+					break AUD_LOOP
+				}
+			}
+		}
+		if !matched {
+			return errors.Errorf("unexpected audience `%v`", claims["aud"])
+		}
+	}
+
+	for _, name := range opt.requiredClaims {
+		if v, ok := claims[name]; !ok || v == nil {
+			return errors.Errorf("missing required claim `%s`", name)
+		}
+	}
+
+	if opt.revocation != nil {
+		jti, _ := claims["jti"].(string)
+		if jti == "" {
+			return errors.Errorf("token has no `jti`")
+		}
+
+		revoked, err := opt.revocation.IsRevoked(context.Background(), jti)
+		if err != nil {
+			return errors.Wrap(err, "check revocation")
+		}
+		if revoked {
+			return ErrJWTTokenRevoked
+		}
 	}
 
 	return nil
 }
 
-// ParseClaimsByRS256 parse token to claims by rs256
-func (e *JWT) ParseClaimsByRS256(token string, claimsPtr jwt.Claims, opts ...JWTDiviceOptFunc) error {
-	opt := &jwtDivideOpt{
-		pubKey: e.pubKey,
-		priKey: e.priKey,
+// jwtTimeClaim load NumericDate claim
+func jwtTimeClaim(claims jwt.MapClaims, name string) (t time.Time, ok bool, err error) {
+	v, ok := claims[name]
+	if !ok || v == nil {
+		return t, false, nil
 	}
-	for _, optf := range opts {
-		if err := optf(opt); err != nil {
-			return errors.Wrap(err, "apply optf")
-		}
+
+	// json.Number
+	num, isNum := v.(interface{ Float64() (float64, error) })
+	if !isNum {
+		return t, false, errors.Errorf("claim `%s` should be number, got %T", name, v)
 	}
 
-	pubKey, err := jwt.ParseRSAPublicKeyFromPEM(opt.pubKey)
+	ts, err := num.Float64()
 	if err != nil {
-		return errors.Wrap(err, "parse rs256 public key")
+		return t, false, errors.Wrapf(err, "parse claim `%s`", name)
 	}
 
-	if _, err = jwt.ParseWithClaims(token, claimsPtr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, errors.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+	sec := int64(ts)
+	return time.Unix(sec, int64((ts-float64(sec))*float64(time.Second))).UTC(), true, nil
+}
 
-		return pubKey, nil
-	}); err != nil {
-		return errors.Wrap(err, "parse token by rs256")
+// checkJWTMethodKey make sure key type matches signing method,
+// to prevent from alg confusion
+func checkJWTMethodKey(method jwt.SigningMethod, key interface{}) error {
+	var ok bool
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		_, ok = key.([]byte)
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok = key.(*rsa.PublicKey)
+	case *jwt.SigningMethodECDSA:
+		_, ok = key.(*ecdsa.PublicKey)
+	case *SigningMethodEdDSA:
+		_, ok = key.(ed25519.PublicKey)
+	}
+
+	if !ok {
+		return errors.Errorf("key type %T not match signing method `%s`", key, method.Alg())
 	}
 
 	return nil
@@ -0,0 +1,347 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// JWTTokenTypeAccess type of access token
+	JWTTokenTypeAccess = "access"
+	// JWTTokenTypeRefresh type of refresh token
+	JWTTokenTypeRefresh = "refresh"
+
+	defaultJWTTokenManagerAccessTTL  = 15 * time.Minute
+	defaultJWTTokenManagerRefreshTTL = 7 * 24 * time.Hour
+	defaultJWTTokenIDLen             = 32
+)
+
+var (
+	// ErrJWTTokenRevoked token has been revoked
+	ErrJWTTokenRevoked = errors.New("token has been revoked")
+	// ErrJWTRefreshTokenReused refresh token has been used before,
+	// the whole session will be revoked
+	ErrJWTRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// JWTRevocationStore storage of revoked token ids
+type JWTRevocationStore interface {
+	// Revoke mark id as revoked until exp,
+	// return true if id has already been revoked before.
+	//
+	// should be atomic, to detect refresh token reuse.
+	Revoke(ctx context.Context, id string, exp time.Time) (revoked bool, err error)
+	// IsRevoked check whether id is revoked
+	IsRevoked(ctx context.Context, id string) (bool, error)
+}
+
+// MemoryJWTRevocationStore in-memory JWTRevocationStore backed by ExpCache
+type MemoryJWTRevocationStore struct {
+	mu    sync.Mutex
+	cache *ExpCache
+}
+
+// NewMemoryJWTRevocationStore new in-memory revocation store
+//
+// ttl is the max duration to keep revoked ids,
+// should not less than the lifetime of refresh token.
+func NewMemoryJWTRevocationStore(ctx context.Context, ttl time.Duration) *MemoryJWTRevocationStore {
+	return &MemoryJWTRevocationStore{
+		cache: NewExpCache(ctx, ttl),
+	}
+}
+
+// Revoke mark id as revoked until exp
+func (s *MemoryJWTRevocationStore) Revoke(_ context.Context, id string, exp time.Time) (revoked bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.cache.Load(id); ok && Clock.GetUTCNow().Before(v.(time.Time)) {
+		revoked = true
+		if exp.Before(v.(time.Time)) {
+			return revoked, nil
+		}
+	}
+
+	s.cache.Store(id, exp)
+	return revoked, nil
+}
+
+// IsRevoked check whether id is revoked
+func (s *MemoryJWTRevocationStore) IsRevoked(_ context.Context, id string) (bool, error) {
+	v, ok := s.cache.Load(id)
+	return ok && Clock.GetUTCNow().Before(v.(time.Time)), nil
+}
+
+// JWTSessionClaims claims of tokens issued by JWTTokenManager
+type JWTSessionClaims struct {
+	jwt.StandardClaims
+	// FamilyID all tokens rotated from the same login share one family
+	FamilyID string `json:"fid"`
+	// TokenType `access` or `refresh`
+	TokenType string `json:"typ"`
+	// Extra custom payload, will be inherited by refreshed tokens
+	Extra map[string]interface{} `json:"ext,omitempty"`
+}
+
+// JWTTokenPair access token and refresh token
+type JWTTokenPair struct {
+	AccessToken      string    `json:"access_token"`
+	AccessExpiresAt  time.Time `json:"access_expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// JWTTokenManager issue and refresh access/refresh token pairs
+//
+// refresh token will be rotated on every use,
+// if a used refresh token is presented again,
+// the whole session (token family) will be revoked.
+type JWTTokenManager struct {
+	jwt   *JWT
+	store JWTRevocationStore
+	accessTTL,
+	refreshTTL time.Duration
+	issuer string
+}
+
+// JWTTokenManagerOptFunc options for JWTTokenManager
+type JWTTokenManagerOptFunc func(*JWTTokenManager) error
+
+// WithJWTTokenManagerAccessTTL set lifetime of access token
+//
+// default to 15m
+func WithJWTTokenManagerAccessTTL(ttl time.Duration) JWTTokenManagerOptFunc {
+	return func(m *JWTTokenManager) error {
+		if ttl <= 0 {
+			return errors.Errorf("ttl should greater than 0, got %s", ttl)
+		}
+
+		m.accessTTL = ttl
+		return nil
+	}
+}
+
+// WithJWTTokenManagerRefreshTTL set lifetime of refresh token
+//
+// default to 7d
+func WithJWTTokenManagerRefreshTTL(ttl time.Duration) JWTTokenManagerOptFunc {
+	return func(m *JWTTokenManager) error {
+		if ttl <= 0 {
+			return errors.Errorf("ttl should greater than 0, got %s", ttl)
+		}
+
+		m.refreshTTL = ttl
+		return nil
+	}
+}
+
+// WithJWTTokenManagerIssuer set `iss` of tokens, and validate it in parsing
+func WithJWTTokenManagerIssuer(issuer string) JWTTokenManagerOptFunc {
+	return func(m *JWTTokenManager) error {
+		m.issuer = issuer
+		return nil
+	}
+}
+
+// NewJWTTokenManager create new JWTTokenManager
+func NewJWTTokenManager(j *JWT, store JWTRevocationStore, opts ...JWTTokenManagerOptFunc) (m *JWTTokenManager, err error) {
+	if j == nil {
+		return nil, errors.Errorf("jwt cannot be nil")
+	}
+	if store == nil {
+		return nil, errors.Errorf("store cannot be nil")
+	}
+
+	m = &JWTTokenManager{
+		jwt:        j,
+		store:      store,
+		accessTTL:  defaultJWTTokenManagerAccessTTL,
+		refreshTTL: defaultJWTTokenManagerRefreshTTL,
+	}
+	for _, optf := range opts {
+		if err = optf(m); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	return m, nil
+}
+
+// Issue issue new token pair for subject, start a new session
+func (m *JWTTokenManager) Issue(ctx context.Context, subject string, extra map[string]interface{}) (*JWTTokenPair, error) {
+	fid, err := SecRandomStringWithLength(defaultJWTTokenIDLen)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate family id")
+	}
+
+	return m.issue(subject, fid, extra)
+}
+
+func (m *JWTTokenManager) issue(subject, fid string, extra map[string]interface{}) (pair *JWTTokenPair, err error) {
+	now := Clock.GetUTCNow()
+	pair = &JWTTokenPair{
+		AccessExpiresAt:  now.Add(m.accessTTL),
+		RefreshExpiresAt: now.Add(m.refreshTTL),
+	}
+
+	if pair.AccessToken, err = m.sign(JWTTokenTypeAccess, subject, fid, extra, now, pair.AccessExpiresAt); err != nil {
+		return nil, errors.Wrap(err, "sign access token")
+	}
+	if pair.RefreshToken, err = m.sign(JWTTokenTypeRefresh, subject, fid, extra, now, pair.RefreshExpiresAt); err != nil {
+		return nil, errors.Wrap(err, "sign refresh token")
+	}
+
+	return pair, nil
+}
+
+func (m *JWTTokenManager) sign(typ, subject, fid string,
+	extra map[string]interface{},
+	now, exp time.Time) (string, error) {
+	jti, err := SecRandomStringWithLength(defaultJWTTokenIDLen)
+	if err != nil {
+		return "", errors.Wrap(err, "generate jti")
+	}
+
+	return m.jwt.Sign(&JWTSessionClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Subject:   subject,
+			Issuer:    m.issuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: exp.Unix(),
+		},
+		FamilyID:  fid,
+		TokenType: typ,
+		Extra:     extra,
+	})
+}
+
+func (m *JWTTokenManager) parseOpts(opts ...JWTDiviceOptFunc) []JWTDiviceOptFunc {
+	if m.issuer != "" {
+		opts = append(opts, WithJWTExpectIssuer(m.issuer))
+	}
+
+	return opts
+}
+
+// parse parse token and check its type and revocation
+func (m *JWTTokenManager) parse(ctx context.Context, token, typ string) (*JWTSessionClaims, error) {
+	claims := new(JWTSessionClaims)
+	if err := m.jwt.ParseClaims(token, claims, m.parseOpts()...); err != nil {
+		return nil, err
+	}
+
+	if claims.TokenType != typ {
+		return nil, errors.Errorf("expect %s token, got `%s`", typ, claims.TokenType)
+	}
+	if claims.Id == "" || claims.FamilyID == "" {
+		return nil, errors.Errorf("token has no jti or fid")
+	}
+
+	for _, id := range []string{claims.FamilyID, claims.Id} {
+		revoked, err := m.store.IsRevoked(ctx, id)
+		if err != nil {
+			return nil, errors.Wrap(err, "check revocation")
+		}
+		if revoked {
+			return nil, ErrJWTTokenRevoked
+		}
+	}
+
+	return claims, nil
+}
+
+// ParseAccessToken parse and validate access token
+func (m *JWTTokenManager) ParseAccessToken(ctx context.Context, token string) (*JWTSessionClaims, error) {
+	return m.parse(ctx, token, JWTTokenTypeAccess)
+}
+
+// Refresh rotate refresh token, return new token pair
+//
+// the refresh token can only be used once,
+// reusing it will revoke the whole session and return ErrJWTRefreshTokenReused.
+// return ErrJWTTokenRevoked if the session has already been revoked.
+func (m *JWTTokenManager) Refresh(ctx context.Context, refreshToken string) (*JWTTokenPair, error) {
+	claims, err := m.parse(ctx, refreshToken, JWTTokenTypeRefresh)
+	if err != nil {
+		if errors.Cause(err) != ErrJWTTokenRevoked {
+			return nil, err
+		}
+
+		if claims, err = m.parseRevoked(refreshToken); err != nil {
+			return nil, err
+		}
+		familyRevoked, err := m.store.IsRevoked(ctx, claims.FamilyID)
+		if err != nil {
+			return nil, errors.Wrap(err, "check revocation")
+		}
+		if familyRevoked {
+			return nil, ErrJWTTokenRevoked
+		}
+
+		// reuse of rotated refresh token, revoke whole family
+		if err = m.revokeFamily(ctx, claims.FamilyID); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrJWTRefreshTokenReused
+	}
+
+	revoked, err := m.store.Revoke(ctx, claims.Id, ParseUnix2UTC(claims.ExpiresAt))
+	if err != nil {
+		return nil, errors.Wrap(err, "revoke refresh token")
+	}
+	if revoked {
+		// concurrent reuse
+		if err = m.revokeFamily(ctx, claims.FamilyID); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrJWTRefreshTokenReused
+	}
+
+	return m.issue(claims.Subject, claims.FamilyID, claims.Extra)
+}
+
+// parseRevoked parse verified refresh token without checking revocation
+func (m *JWTTokenManager) parseRevoked(token string) (*JWTSessionClaims, error) {
+	claims := new(JWTSessionClaims)
+	if err := m.jwt.ParseClaims(token, claims, m.parseOpts(withoutJWTRevocation())...); err != nil {
+		return nil, err
+	}
+	if claims.TokenType != JWTTokenTypeRefresh {
+		return nil, errors.Errorf("expect %s token, got `%s`", JWTTokenTypeRefresh, claims.TokenType)
+	}
+	if claims.FamilyID == "" {
+		return nil, errors.Errorf("token has no fid")
+	}
+
+	return claims, nil
+}
+
+func (m *JWTTokenManager) revokeFamily(ctx context.Context, fid string) error {
+	if _, err := m.store.Revoke(ctx, fid, Clock.GetUTCNow().Add(m.refreshTTL)); err != nil {
+		return errors.Wrapf(err, "revoke family `%s`", fid)
+	}
+
+	return nil
+}
+
+// Revoke revoke the session of token (access or refresh),
+// all tokens in the same family will be invalid.
+func (m *JWTTokenManager) Revoke(ctx context.Context, token string) error {
+	claims := new(JWTSessionClaims)
+	if err := m.jwt.ParseClaims(token, claims, m.parseOpts(withoutJWTRevocation())...); err != nil {
+		return err
+	}
+	if claims.FamilyID == "" {
+		return errors.Errorf("token has no fid")
+	}
+
+	return m.revokeFamily(ctx, claims.FamilyID)
+}
@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryJWTRevocationStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryJWTRevocationStore(ctx, time.Hour)
+	revoked, err := store.IsRevoked(ctx, "a")
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	revoked, err = store.Revoke(ctx, "a", Clock.GetUTCNow().Add(time.Hour))
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	revoked, err = store.Revoke(ctx, "a", Clock.GetUTCNow().Add(time.Hour))
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	revoked, err = store.IsRevoked(ctx, "a")
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	// already expired
+	_, err = store.Revoke(ctx, "b", Clock.GetUTCNow().Add(-time.Second))
+	require.NoError(t, err)
+	revoked, err = store.IsRevoked(ctx, "b")
+	require.NoError(t, err)
+	require.False(t, revoked)
+}
+
+func TestJWTTokenManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	j, err := NewJWT(
+		WithJWTSignMethod(SignMethodHS256),
+		WithJWTSecretByte(secret),
+	)
+	require.NoError(t, err)
+
+	store := NewMemoryJWTRevocationStore(ctx, time.Hour)
+	m, err := NewJWTTokenManager(j, store,
+		WithJWTTokenManagerAccessTTL(time.Minute),
+		WithJWTTokenManagerRefreshTTL(time.Hour),
+		WithJWTTokenManagerIssuer("go-utils"),
+	)
+	require.NoError(t, err)
+
+	pair, err := m.Issue(ctx, "laisky", map[string]interface{}{"role": "admin"})
+	require.NoError(t, err)
+	require.True(t, pair.RefreshExpiresAt.After(pair.AccessExpiresAt))
+
+	claims, err := m.ParseAccessToken(ctx, pair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, "laisky", claims.Subject)
+	require.Equal(t, "admin", claims.Extra["role"])
+	require.Equal(t, "go-utils", claims.Issuer)
+	require.NotEmpty(t, claims.Id)
+
+	// refresh token cannot be used as access token
+	_, err = m.ParseAccessToken(ctx, pair.RefreshToken)
+	require.Error(t, err)
+	_, err = m.Refresh(ctx, pair.AccessToken)
+	require.Error(t, err)
+
+	// rotate
+	pair2, err := m.Refresh(ctx, pair.RefreshToken)
+	require.NoError(t, err)
+	require.NotEqual(t, pair.RefreshToken, pair2.RefreshToken)
+	claims2, err := m.ParseAccessToken(ctx, pair2.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, claims.FamilyID, claims2.FamilyID)
+	require.Equal(t, "admin", claims2.Extra["role"])
+
+	// reuse old refresh token, revoke the whole family
+	_, err = m.Refresh(ctx, pair.RefreshToken)
+	require.Equal(t, ErrJWTRefreshTokenReused, errors.Cause(err))
+
+	_, err = m.ParseAccessToken(ctx, pair2.AccessToken)
+	require.Equal(t, ErrJWTTokenRevoked, errors.Cause(err))
+	_, err = m.Refresh(ctx, pair2.RefreshToken)
+	require.Equal(t, ErrJWTTokenRevoked, errors.Cause(err))
+
+	// other sessions are not affected
+	pair3, err := m.Issue(ctx, "laisky", nil)
+	require.NoError(t, err)
+	_, err = m.ParseAccessToken(ctx, pair3.AccessToken)
+	require.NoError(t, err)
+
+	// logout
+	err = m.Revoke(ctx, pair3.AccessToken)
+	require.NoError(t, err)
+	_, err = m.ParseAccessToken(ctx, pair3.AccessToken)
+	require.Equal(t, ErrJWTTokenRevoked, errors.Cause(err))
+	_, err = m.Refresh(ctx, pair3.RefreshToken)
+	require.Equal(t, ErrJWTTokenRevoked, errors.Cause(err))
+	require.NoError(t, m.Revoke(ctx, pair3.RefreshToken))
+}
+
+func TestJWTTokenManagerWithRevocationStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryJWTRevocationStore(ctx, time.Hour)
+	j, err := NewJWT(
+		WithJWTSignMethod(SignMethodHS256),
+		WithJWTSecretByte(secret),
+		WithJWTRevocationStore(store),
+	)
+	require.NoError(t, err)
+	m, err := NewJWTTokenManager(j, store)
+	require.NoError(t, err)
+
+	pair, err := m.Issue(ctx, "laisky", nil)
+	require.NoError(t, err)
+	pair2, err := m.Refresh(ctx, pair.RefreshToken)
+	require.NoError(t, err)
+
+	// jti of used refresh token is rejected by jwt, still detected as reuse
+	_, err = m.Refresh(ctx, pair.RefreshToken)
+	require.Equal(t, ErrJWTRefreshTokenReused, errors.Cause(err))
+	_, err = m.ParseAccessToken(ctx, pair2.AccessToken)
+	require.Equal(t, ErrJWTTokenRevoked, errors.Cause(err))
+	_, err = m.Refresh(ctx, pair2.RefreshToken)
+	require.Equal(t, ErrJWTTokenRevoked, errors.Cause(err))
+}
+
+func TestJWTWithRevocationStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryJWTRevocationStore(ctx, time.Hour)
+	j, err := NewJWT(
+		WithJWTSignMethod(SignMethodHS256),
+		WithJWTSecretByte(secret),
+		WithJWTRevocationStore(store),
+	)
+	require.NoError(t, err)
+
+	token, err := j.Sign(&jwt.StandardClaims{Id: "123"})
+	require.NoError(t, err)
+	err = j.ParseClaims(token, new(jwt.StandardClaims))
+	require.NoError(t, err)
+
+	_, err = store.Revoke(ctx, "123", Clock.GetUTCNow().Add(time.Minute))
+	require.NoError(t, err)
+	err = j.ParseClaims(token, new(jwt.StandardClaims))
+	require.Equal(t, ErrJWTTokenRevoked, errors.Cause(err))
+
+	// jti is required
+	token, err = j.Sign(&jwt.StandardClaims{})
+	require.NoError(t, err)
+	err = j.ParseClaims(token, new(jwt.StandardClaims))
+	require.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/Laisky/zap"
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// HTTPHeaderAuthorization HTTP header name
+	HTTPHeaderAuthorization = "Authorization"
+	// HTTPHeaderWWWAuthenticate HTTP header name
+	HTTPHeaderWWWAuthenticate = "WWW-Authenticate"
+
+	defaultJWTMiddlewareRealm = "restricted"
+	jwtBearerPrefix           = "bearer "
+)
+
+type jwtClaimsCtxKey struct{}
+
+// JWTClaimsFromContext load claims that parsed by jwt middleware
+func JWTClaimsFromContext(ctx context.Context) (claims jwt.Claims, ok bool) {
+	claims, ok = ctx.Value(jwtClaimsCtxKey{}).(jwt.Claims)
+	return
+}
+
+type jwtMiddlewareOption struct {
+	newClaims func() jwt.Claims
+	cookieName,
+	queryName,
+	realm string
+	parseOpts []JWTDiviceOptFunc
+}
+
+// JWTMiddlewareOptFunc options for jwt middleware
+type JWTMiddlewareOptFunc func(*jwtMiddlewareOption) error
+
+// WithJWTMiddlewareClaims set constructor of claims,
+// should return a pointer.
+//
+// default to `&jwt.MapClaims{}`
+func WithJWTMiddlewareClaims(newClaims func() jwt.Claims) JWTMiddlewareOptFunc {
+	return func(opt *jwtMiddlewareOption) error {
+		if newClaims == nil {
+			return errors.Errorf("newClaims cannot be nil")
+		}
+
+		opt.newClaims = newClaims
+		return nil
+	}
+}
+
+// WithJWTMiddlewareCookie also load token from cookie
+func WithJWTMiddlewareCookie(name string) JWTMiddlewareOptFunc {
+	return func(opt *jwtMiddlewareOption) error {
+		if name == "" {
+			return errors.Errorf("cookie name cannot be empty")
+		}
+
+		opt.cookieName = name
+		return nil
+	}
+}
+
+// WithJWTMiddlewareQuery also load token from query parameter
+func WithJWTMiddlewareQuery(name string) JWTMiddlewareOptFunc {
+	return func(opt *jwtMiddlewareOption) error {
+		if name == "" {
+			return errors.Errorf("query name cannot be empty")
+		}
+
+		opt.queryName = name
+		return nil
+	}
+}
+
+// WithJWTMiddlewareRealm set realm in `WWW-Authenticate`
+//
+// default to `restricted`
+func WithJWTMiddlewareRealm(realm string) JWTMiddlewareOptFunc {
+	return func(opt *jwtMiddlewareOption) error {
+		opt.realm = realm
+		return nil
+	}
+}
+
+// WithJWTMiddlewareParseOptions set options for `JWT.ParseClaims`
+func WithJWTMiddlewareParseOptions(opts ...JWTDiviceOptFunc) JWTMiddlewareOptFunc {
+	return func(opt *jwtMiddlewareOption) error {
+		opt.parseOpts = append(opt.parseOpts, opts...)
+		return nil
+	}
+}
+
+// NewJWTMiddleware create net/http middleware to authenticate request by jwt
+//
+// token is loaded from `Authorization: Bearer <token>` header,
+// then cookie and query parameter if enabled.
+// parsed claims can be loaded by `JWTClaimsFromContext`.
+//
+// unauthenticated request will got 401 with RFC 6750 `WWW-Authenticate` header.
+func NewJWTMiddleware(j *JWT, opts ...JWTMiddlewareOptFunc) (func(http.Handler) http.Handler, error) {
+	if j == nil {
+		return nil, errors.Errorf("jwt cannot be nil")
+	}
+
+	opt := &jwtMiddlewareOption{
+		newClaims: func() jwt.Claims { return &jwt.MapClaims{} },
+		realm:     defaultJWTMiddlewareRealm,
+	}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := opt.extractToken(r)
+			if err != nil {
+				opt.challenge(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			if token == "" {
+				opt.challenge(w, http.StatusUnauthorized, "", "")
+				return
+			}
+
+			claims := opt.newClaims()
+			if err = j.ParseClaims(token, claims, opt.parseOpts...); err != nil {
+				Logger.Debug("invalid jwt", zap.Error(err), zap.String("path", r.URL.Path))
+				desc := "the access token is invalid"
+				if errors.Cause(err) == ErrJWTTokenRevoked {
+					desc = "the access token has been revoked"
+				}
+
+				opt.challenge(w, http.StatusUnauthorized, "invalid_token", desc)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), jwtClaimsCtxKey{}, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}, nil
+}
+
+func (opt *jwtMiddlewareOption) extractToken(r *http.Request) (string, error) {
+	if auth := r.Header.Get(HTTPHeaderAuthorization); auth != "" {
+		if len(auth) <= len(jwtBearerPrefix) ||
+			!strings.EqualFold(auth[:len(jwtBearerPrefix)], jwtBearerPrefix) {
+			return "", errors.Errorf("authorization header should be `Bearer <token>`")
+		}
+
+		return strings.TrimSpace(auth[len(jwtBearerPrefix):]), nil
+	}
+
+	if opt.cookieName != "" {
+		if c, err := r.Cookie(opt.cookieName); err == nil && c.Value != "" {
+			return c.Value, nil
+		}
+	}
+
+	if opt.queryName != "" {
+		if v := r.URL.Query().Get(opt.queryName); v != "" {
+			return v, nil
+		}
+	}
+
+	return "", nil
+}
+
+// challenge response error with `WWW-Authenticate`
+//
+// https://datatracker.ietf.org/doc/html/rfc6750#section-3
+func (opt *jwtMiddlewareOption) challenge(w http.ResponseWriter, status int, errCode, desc string) {
+	params := []string{`realm="` + escapeAuthParam(opt.realm) + `"`}
+	if errCode != "" {
+		params = append(params, `error="`+errCode+`"`)
+	}
+	if desc != "" {
+		params = append(params, `error_description="`+escapeAuthParam(desc)+`"`)
+	}
+
+	w.Header().Set(HTTPHeaderWWWAuthenticate, "Bearer "+strings.Join(params, ", "))
+	http.Error(w, http.StatusText(status), status)
+}
+
+func escapeAuthParam(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v)
+}
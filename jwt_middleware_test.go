@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewJWTMiddleware(t *testing.T) {
+	j, err := NewJWT(
+		WithJWTSignMethod(SignMethodHS256),
+		WithJWTSecretByte(secret),
+	)
+	require.NoError(t, err)
+
+	mw, err := NewJWTMiddleware(j,
+		WithJWTMiddlewareClaims(func() jwt.Claims { return new(jwt.StandardClaims) }),
+		WithJWTMiddlewareCookie("token"),
+		WithJWTMiddlewareQuery("access_token"),
+		WithJWTMiddlewareRealm("go-utils"),
+		WithJWTMiddlewareParseOptions(WithJWTExpectIssuer("laisky")),
+	)
+	require.NoError(t, err)
+
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := JWTClaimsFromContext(r.Context())
+		require.True(t, ok)
+		_, _ = w.Write([]byte(claims.(*jwt.StandardClaims).Subject))
+	}))
+
+	token, err := j.Sign(&jwt.StandardClaims{Subject: "dune", Issuer: "laisky"})
+	require.NoError(t, err)
+	badIssToken, err := j.Sign(&jwt.StandardClaims{Subject: "dune", Issuer: "another"})
+	require.NoError(t, err)
+
+	for name, c := range map[string]struct {
+		setup     func(r *http.Request)
+		status    int
+		challenge string
+	}{
+		"header": {
+			setup:  func(r *http.Request) { r.Header.Set(HTTPHeaderAuthorization, "Bearer "+token) },
+			status: http.StatusOK,
+		},
+		"cookie": {
+			setup:  func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "token", Value: token}) },
+			status: http.StatusOK,
+		},
+		"query": {
+			setup:  func(r *http.Request) { r.URL.RawQuery = "access_token=" + token },
+			status: http.StatusOK,
+		},
+		"missing": {
+			setup:     func(r *http.Request) {},
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="go-utils"`,
+		},
+		"malformed header": {
+			setup:     func(r *http.Request) { r.Header.Set(HTTPHeaderAuthorization, "Basic abc") },
+			status:    http.StatusBadRequest,
+			challenge: `Bearer realm="go-utils", error="invalid_request", error_description="authorization header should be ` + "`Bearer <token>`" + `"`,
+		},
+		"invalid token": {
+			setup:     func(r *http.Request) { r.Header.Set(HTTPHeaderAuthorization, "Bearer "+token+"x") },
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="go-utils", error="invalid_token", error_description="the access token is invalid"`,
+		},
+		"invalid issuer": {
+			setup:     func(r *http.Request) { r.Header.Set(HTTPHeaderAuthorization, "Bearer "+badIssToken) },
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="go-utils", error="invalid_token", error_description="the access token is invalid"`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			c.setup(r)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			require.Equal(t, c.status, w.Code)
+			require.Equal(t, c.challenge, w.Header().Get(HTTPHeaderWWWAuthenticate))
+			if c.status == http.StatusOK {
+				require.Equal(t, "dune", w.Body.String())
+			}
+		})
+	}
+
+	_, err = NewJWTMiddleware(nil)
+	require.Error(t, err)
+}
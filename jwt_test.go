@@ -1,12 +1,20 @@
 package utils
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/Laisky/zap"
 	"github.com/form3tech-oss/jwt-go"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -198,3 +206,268 @@ func TestJWTAudValunerable(t *testing.T) {
 		require.False(t, ok)
 	}
 }
+
+type testJWTKeys struct {
+	priKey, pubKey []byte
+}
+
+func testGenerateJWTKeys(t *testing.T) (rsaKeys, es384Keys, es512Keys, edKeys testJWTKeys) {
+	rsaPri, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaKeys.priKey, err = EncodeRSAPrivateKey(rsaPri)
+	require.NoError(t, err)
+	rsaKeys.pubKey, err = EncodeRSAPublicKey(&rsaPri.PublicKey)
+	require.NoError(t, err)
+
+	for curve, keys := range map[elliptic.Curve]*testJWTKeys{
+		elliptic.P384(): &es384Keys,
+		elliptic.P521(): &es512Keys,
+	} {
+		esPri, err := ecdsa.GenerateKey(curve, rand.Reader)
+		require.NoError(t, err)
+		keys.priKey, err = EncodeECDSAPrivateKey(esPri)
+		require.NoError(t, err)
+		keys.pubKey, err = EncodeECDSAPublicKey(&esPri.PublicKey)
+		require.NoError(t, err)
+	}
+
+	edPub, edPri, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(edPri)
+	require.NoError(t, err)
+	edKeys.priKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	der, err = x509.MarshalPKIXPublicKey(edPub)
+	require.NoError(t, err)
+	edKeys.pubKey = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	return
+}
+
+func TestJWTAllSignMethods(t *testing.T) {
+	rsaKeys, es384Keys, es512Keys, edKeys := testGenerateJWTKeys(t)
+	es256Keys := testJWTKeys{priKey: es256PriByte, pubKey: es256PubByte}
+
+	for _, c := range []struct {
+		method jwt.SigningMethod
+		keys   testJWTKeys
+	}{
+		{SignMethodHS256, testJWTKeys{}},
+		{SignMethodHS384, testJWTKeys{}},
+		{SignMethodHS512, testJWTKeys{}},
+		{SignMethodRS256, rsaKeys},
+		{SignMethodRS384, rsaKeys},
+		{SignMethodRS512, rsaKeys},
+		{SignMethodPS256, rsaKeys},
+		{SignMethodES256, es256Keys},
+		{SignMethodES384, es384Keys},
+		{SignMethodES512, es512Keys},
+		{SignMethodEdDSA, edKeys},
+	} {
+		t.Run(c.method.Alg(), func(t *testing.T) {
+			j, err := NewJWT(
+				WithJWTSignMethod(c.method),
+				WithJWTSecretByte(secret),
+				WithJWTPriKeyByte(c.keys.priKey),
+				WithJWTPubKeyByte(c.keys.pubKey),
+			)
+			require.NoError(t, err)
+
+			token, err := j.Sign(&jwt.StandardClaims{Subject: "laisky"})
+			require.NoError(t, err)
+
+			claims := new(jwt.StandardClaims)
+			err = j.ParseClaims(token, claims)
+			require.NoError(t, err)
+			require.Equal(t, "laisky", claims.Subject)
+
+			// verify by private key only
+			if len(c.keys.priKey) != 0 {
+				jPri, err := NewJWT(
+					WithJWTSignMethod(c.method),
+					WithJWTPriKeyByte(c.keys.priKey),
+				)
+				require.NoError(t, err)
+				err = jPri.ParseClaims(token, claims)
+				require.NoError(t, err)
+			}
+
+			// token signed by another method should be rejected,
+			// even if the key is valid
+			for _, other := range []jwt.SigningMethod{SignMethodHS256, SignMethodRS256, SignMethodPS256, SignMethodES256} {
+				if other == c.method {
+					continue
+				}
+
+				jOther, err := NewJWT(
+					WithJWTSignMethod(other),
+					WithJWTSecretByte(secret),
+					WithJWTPriKeyByte(c.keys.priKey),
+					WithJWTPubKeyByte(c.keys.pubKey),
+				)
+				require.NoError(t, err)
+				err = jOther.ParseClaims(token, claims)
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestJWTAlgConfusion(t *testing.T) {
+	rsaKeys, _, _, _ := testGenerateJWTKeys(t)
+
+	verifier, err := NewJWT(
+		WithJWTSignMethod(SignMethodRS256),
+		WithJWTAllowedSignMethods(SignMethodRS256, SignMethodHS256),
+		WithJWTPubKeyByte(rsaKeys.pubKey),
+	)
+	require.NoError(t, err)
+
+	// hs256 token signed by rsa public key
+	attacker, err := NewJWT(
+		WithJWTSignMethod(SignMethodHS256),
+		WithJWTSecretByte(rsaKeys.pubKey),
+	)
+	require.NoError(t, err)
+	token, err := attacker.Sign(&jwt.StandardClaims{Subject: "laisky"})
+	require.NoError(t, err)
+	err = verifier.ParseClaims(token, new(jwt.StandardClaims))
+	require.Error(t, err)
+
+	// alg none
+	token, err = jwt.NewWithClaims(jwt.SigningMethodNone, &jwt.StandardClaims{Subject: "laisky"}).
+		SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	err = verifier.ParseClaims(token, new(jwt.StandardClaims))
+	require.Error(t, err)
+
+	_, err = NewJWT(WithJWTAllowedSignMethods())
+	require.Error(t, err)
+}
+
+func TestJWTClaimsValidation(t *testing.T) {
+	j, err := NewJWT(
+		WithJWTSignMethod(SignMethodHS256),
+		WithJWTSecretByte(secret),
+	)
+	require.NoError(t, err)
+
+	now := Clock.GetUTCNow()
+	sign := func(claims jwt.Claims) string {
+		token, err := j.Sign(claims)
+		require.NoError(t, err)
+		return token
+	}
+
+	t.Run("leeway", func(t *testing.T) {
+		token := sign(&jwt.StandardClaims{ExpiresAt: now.Add(-10 * time.Second).Unix()})
+		err := j.ParseClaims(token, new(jwt.StandardClaims))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "token is expired")
+		err = j.ParseClaims(token, new(jwt.StandardClaims), WithJWTLeeway(time.Minute))
+		require.NoError(t, err)
+
+		token = sign(&jwt.StandardClaims{NotBefore: now.Add(10 * time.Second).Unix()})
+		err = j.ParseClaims(token, new(jwt.StandardClaims))
+		require.Error(t, err)
+		err = j.ParseClaims(token, new(jwt.StandardClaims), WithJWTLeeway(time.Minute))
+		require.NoError(t, err)
+
+		_, err = j.Sign(&jwt.StandardClaims{}, WithJWTLeeway(-time.Second))
+		require.Error(t, err)
+	})
+
+	t.Run("issuer", func(t *testing.T) {
+		token := sign(&jwt.StandardClaims{Issuer: "laisky"})
+		err := j.ParseClaims(token, new(jwt.StandardClaims), WithJWTExpectIssuer("laisky"))
+		require.NoError(t, err)
+		err = j.ParseClaims(token, new(jwt.StandardClaims), WithJWTExpectIssuer("dune"))
+		require.Error(t, err)
+	})
+
+	t.Run("audience", func(t *testing.T) {
+		token := sign(&jwt.StandardClaims{Audience: []string{"a", "b"}})
+		err := j.ParseClaims(token, new(jwt.StandardClaims), WithJWTExpectAudience("c", "b"))
+		require.NoError(t, err)
+		err = j.ParseClaims(token, new(jwt.StandardClaims), WithJWTExpectAudience("c"))
+		require.Error(t, err)
+
+		token = sign(jwt.MapClaims{"aud": "a"})
+		err = j.ParseClaims(token, &jwt.MapClaims{}, WithJWTExpectAudience("a"))
+		require.NoError(t, err)
+
+		token = sign(&jwt.StandardClaims{})
+		err = j.ParseClaims(token, new(jwt.StandardClaims), WithJWTExpectAudience("a"))
+		require.Error(t, err)
+	})
+
+	t.Run("required", func(t *testing.T) {
+		token := sign(jwt.MapClaims{"uid": "laisky", "empty": nil})
+		err := j.ParseClaims(token, &jwt.MapClaims{}, WithJWTRequiredClaims("uid"))
+		require.NoError(t, err)
+		err = j.ParseClaims(token, &jwt.MapClaims{}, WithJWTRequiredClaims("uid", "empty"))
+		require.Error(t, err)
+		err = j.ParseClaims(token, &jwt.MapClaims{}, WithJWTRequiredClaims("role"))
+		require.Error(t, err)
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		token := sign(&jwt.StandardClaims{IssuedAt: now.Add(-time.Hour).Unix()})
+		err := j.ParseClaims(token, new(jwt.StandardClaims), WithJWTMaxAge(2*time.Hour))
+		require.NoError(t, err)
+		err = j.ParseClaims(token, new(jwt.StandardClaims), WithJWTMaxAge(time.Minute))
+		require.Error(t, err)
+		err = j.ParseClaims(token, new(jwt.StandardClaims),
+			WithJWTMaxAge(time.Minute), WithJWTLeeway(2*time.Hour))
+		require.NoError(t, err)
+
+		token = sign(&jwt.StandardClaims{})
+		err = j.ParseClaims(token, new(jwt.StandardClaims), WithJWTMaxAge(time.Hour))
+		require.Error(t, err)
+	})
+
+	t.Run("custom valid", func(t *testing.T) {
+		token := sign(&testJWTRoleClaims{
+			StandardClaims: jwt.StandardClaims{ExpiresAt: now.Add(-10 * time.Second).Unix()},
+			Role:           "admin",
+		})
+		err := j.ParseClaims(token, new(testJWTRoleClaims), WithJWTLeeway(time.Minute))
+		require.NoError(t, err)
+
+		token = sign(&testJWTRoleClaims{Role: "guest"})
+		err = j.ParseClaims(token, new(testJWTRoleClaims))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "unknown role")
+	})
+
+	t.Run("verify signature only", func(t *testing.T) {
+		token := sign(&jwt.StandardClaims{ExpiresAt: now.Add(-time.Hour).Unix()})
+		require.Error(t, j.ParseClaims(token, new(jwt.StandardClaims)))
+		require.NoError(t, j.VerifySignature(token))
+
+		j2, err := NewJWT(
+			WithJWTSignMethod(SignMethodHS256),
+			WithJWTSecretByte([]byte("another secret")),
+		)
+		require.NoError(t, err)
+		require.Error(t, j2.VerifySignature(token))
+	})
+
+	t.Run("invalid time claim", func(t *testing.T) {
+		token := sign(jwt.MapClaims{"exp": "tomorrow"})
+		err := j.ParseClaims(token, &jwt.MapClaims{})
+		require.Error(t, err)
+	})
+}
+
+type testJWTRoleClaims struct {
+	jwt.StandardClaims
+	Role string `json:"role"`
+}
+
+func (c *testJWTRoleClaims) Valid() error {
+	if c.Role != "admin" {
+		return errors.Errorf("unknown role `%s`", c.Role)
+	}
+
+	return c.StandardClaims.Valid()
+}
@@ -0,0 +1,440 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RotateFilePatternTime placeholder of time in file pattern
+	RotateFilePatternTime = "{time}"
+	// RotateFilePatternSeq placeholder of sequence number in file pattern
+	RotateFilePatternSeq = "{seq}"
+
+	defaultRotateTimeLayout  = "20060102150405"
+	defaultRotateFileMode    = 0644
+	defaultRotateMaxFileSeek = 10000
+)
+
+// RotateCompressWriterNewCompressor create compressor for each new file
+type RotateCompressWriterNewCompressor func(io.Writer) (CompressorItf, error)
+
+type rotateCompressWriterOption struct {
+	maxSizeByte int64
+	maxRecords  int
+	interval    time.Duration
+	timeLayout  string
+	fsync       bool
+	fileMode    os.FileMode
+	callback    func(fpath string)
+}
+
+// RotateCompressWriterOptFunc options for RotateCompressWriter
+type RotateCompressWriterOptFunc func(*rotateCompressWriterOption) error
+
+// WithRotateMaxSizeByte roll over when compressed bytes written to file exceed n.
+//
+// compressor will be flushed once the uncompressed bytes buffered in it
+// may make the file exceed n, so the file exceeds n by at most the last record.
+func WithRotateMaxSizeByte(n int64) RotateCompressWriterOptFunc {
+	return func(opt *rotateCompressWriterOption) error {
+		if n <= 0 {
+			return errors.Errorf("max size should greater than 0, got %d", n)
+		}
+
+		opt.maxSizeByte = n
+		return nil
+	}
+}
+
+// WithRotateMaxRecords roll over when written records exceed n,
+// every `Write` is one record.
+func WithRotateMaxRecords(n int) RotateCompressWriterOptFunc {
+	return func(opt *rotateCompressWriterOption) error {
+		if n <= 0 {
+			return errors.Errorf("max records should greater than 0, got %d", n)
+		}
+
+		opt.maxRecords = n
+		return nil
+	}
+}
+
+// WithRotateInterval roll over every interval, start from file created
+func WithRotateInterval(interval time.Duration) RotateCompressWriterOptFunc {
+	return func(opt *rotateCompressWriterOption) error {
+		if interval <= 0 {
+			return errors.Errorf("interval should greater than 0, got %s", interval)
+		}
+
+		opt.interval = interval
+		return nil
+	}
+}
+
+// WithRotateTimeLayout set time layout for `{time}` in file pattern
+//
+// default to `20060102150405`
+func WithRotateTimeLayout(layout string) RotateCompressWriterOptFunc {
+	return func(opt *rotateCompressWriterOption) error {
+		if layout == "" {
+			return errors.Errorf("layout cannot be empty")
+		}
+
+		opt.timeLayout = layout
+		return nil
+	}
+}
+
+// WithRotateFsync fsync file before closing it
+func WithRotateFsync(fsync bool) RotateCompressWriterOptFunc {
+	return func(opt *rotateCompressWriterOption) error {
+		opt.fsync = fsync
+		return nil
+	}
+}
+
+// WithRotateFileMode set mode of new files
+//
+// default to 0644
+func WithRotateFileMode(mode os.FileMode) RotateCompressWriterOptFunc {
+	return func(opt *rotateCompressWriterOption) error {
+		opt.fileMode = mode
+		return nil
+	}
+}
+
+// WithRotateCallback set callback that will be called
+// with file path after each file is completed.
+//
+// callback is called synchronously, should not block too long.
+func WithRotateCallback(callback func(fpath string)) RotateCompressWriterOptFunc {
+	return func(opt *rotateCompressWriterOption) error {
+		opt.callback = callback
+		return nil
+	}
+}
+
+// RotateCompressWriter write data via compressor into files,
+// roll over to new file by size, records or time interval.
+//
+// file is created lazily on first write, its name is generated from pattern,
+// `{time}` will be replaced by the creation time,
+// `{seq}` will be replaced by an increasing sequence number.
+// if pattern has no `{seq}`, suffix like `.1` will be appended to the time
+// when the file name already exists.
+type RotateCompressWriter struct {
+	*rotateCompressWriterOption
+	mu            sync.Mutex
+	pattern       string
+	newCompressor RotateCompressWriterNewCompressor
+	closed        bool
+	seq           int
+
+	// current file
+	fp         *os.File
+	fpath      string
+	compressor CompressorItf
+	// size compressed bytes written to file
+	size int64
+	// pending uncompressed bytes written after the last flush
+	pending  int64
+	records  int
+	openedAt time.Time
+}
+
+// NewRotateCompressWriter create new RotateCompressWriter
+//
+// pattern should contain `{time}` or `{seq}`, like `/var/log/app.{time}.{seq}.gz`.
+// if interval is set, will roll over in background until ctx done.
+func NewRotateCompressWriter(ctx context.Context,
+	pattern string,
+	newCompressor RotateCompressWriterNewCompressor,
+	opts ...RotateCompressWriterOptFunc) (w *RotateCompressWriter, err error) {
+	if !strings.Contains(pattern, RotateFilePatternTime) &&
+		!strings.Contains(pattern, RotateFilePatternSeq) {
+		return nil, errors.Errorf("pattern should contain `%s` or `%s`",
+			RotateFilePatternTime, RotateFilePatternSeq)
+	}
+	if newCompressor == nil {
+		return nil, errors.Errorf("newCompressor cannot be nil")
+	}
+
+	opt := &rotateCompressWriterOption{
+		timeLayout: defaultRotateTimeLayout,
+		fileMode:   defaultRotateFileMode,
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	w = &RotateCompressWriter{
+		rotateCompressWriterOption: opt,
+		pattern:                    pattern,
+		newCompressor:              newCompressor,
+	}
+	if w.interval > 0 {
+		go w.runRotateByInterval(ctx)
+	}
+
+	return w, nil
+}
+
+// runRotateByInterval roll over expired file even if there is no write
+func (w *RotateCompressWriter) runRotateByInterval(ctx context.Context) {
+	tick := w.interval / 10
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+
+		var (
+			fpath string
+			err   error
+		)
+		if w.fp != nil && !Clock.GetUTCNow().Before(w.openedAt.Add(w.interval)) {
+			fpath, err = w.closeFile()
+		}
+		w.mu.Unlock()
+
+		if err != nil {
+			Logger.Error("rotate file", zap.Error(err))
+		}
+		w.notify(fpath)
+	}
+}
+
+// Filename return the path of current file,
+// empty if no file is opened.
+func (w *RotateCompressWriter) Filename() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.fpath
+}
+
+// Write write one record
+func (w *RotateCompressWriter) Write(p []byte) (n int, err error) {
+	var fpaths []string
+	w.mu.Lock()
+	n, fpaths, err = w.write(p)
+	w.mu.Unlock()
+
+	w.notify(fpaths...)
+	return n, err
+}
+
+// WriteString write one record
+func (w *RotateCompressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// write write record and roll over if needed,
+// return the paths of completed files.
+func (w *RotateCompressWriter) write(p []byte) (n int, fpaths []string, err error) {
+	if w.closed {
+		return 0, nil, errors.Errorf("writer closed")
+	}
+
+	var fpath string
+	if w.fp != nil && w.interval > 0 &&
+		!Clock.GetUTCNow().Before(w.openedAt.Add(w.interval)) {
+		if fpath, err = w.closeFile(); err != nil {
+			return 0, nil, err
+		}
+
+		fpaths = append(fpaths, fpath)
+	}
+	if w.fp == nil {
+		if err = w.openFile(); err != nil {
+			return 0, fpaths, err
+		}
+	}
+
+	if n, err = w.compressor.Write(p); err != nil {
+		return n, fpaths, errors.Wrapf(err, "write to `%s`", w.fpath)
+	}
+	w.records++
+	w.pending += int64(n)
+
+	// make size accurate before comparing
+	if w.maxSizeByte > 0 && w.size+w.pending >= w.maxSizeByte {
+		if err = w.compressor.Flush(); err != nil {
+			return n, fpaths, errors.Wrapf(err, "flush file `%s`", w.fpath)
+		}
+		w.pending = 0
+	}
+
+	if (w.maxRecords > 0 && w.records >= w.maxRecords) ||
+		(w.maxSizeByte > 0 && w.size >= w.maxSizeByte) {
+		if fpath, err = w.closeFile(); err != nil {
+			return n, fpaths, err
+		}
+
+		fpaths = append(fpaths, fpath)
+	}
+
+	return n, fpaths, nil
+}
+
+// Flush flush compressed data into current file
+func (w *RotateCompressWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.compressor == nil {
+		return nil
+	}
+
+	w.pending = 0
+	return w.compressor.Flush()
+}
+
+// Rotate complete current file, the next write will create new file
+func (w *RotateCompressWriter) Rotate() (err error) {
+	var fpath string
+	w.mu.Lock()
+	if w.fp != nil {
+		fpath, err = w.closeFile()
+	}
+	w.mu.Unlock()
+
+	w.notify(fpath)
+	return err
+}
+
+// Close complete current file, writer cannot be used anymore
+func (w *RotateCompressWriter) Close() (err error) {
+	var fpath string
+	w.mu.Lock()
+	w.closed = true
+	if w.fp != nil {
+		fpath, err = w.closeFile()
+	}
+	w.mu.Unlock()
+
+	w.notify(fpath)
+	return err
+}
+
+func (w *RotateCompressWriter) notify(fpaths ...string) {
+	if w.callback == nil {
+		return
+	}
+
+	for _, fpath := range fpaths {
+		if fpath != "" {
+			w.callback(fpath)
+		}
+	}
+}
+
+// genFilePath generate file path by pattern,
+// dup is appended to time if greater than 0.
+func (w *RotateCompressWriter) genFilePath(now time.Time, dup int) string {
+	ts := now.Format(w.timeLayout)
+	if dup > 0 {
+		ts += "." + strconv.Itoa(dup)
+	}
+
+	fpath := strings.Replace(w.pattern, RotateFilePatternTime, ts, -1)
+	return strings.Replace(fpath, RotateFilePatternSeq, strconv.Itoa(w.seq), -1)
+}
+
+func (w *RotateCompressWriter) openFile() (err error) {
+	now := Clock.GetUTCNow()
+	hasSeq := strings.Contains(w.pattern, RotateFilePatternSeq)
+	for dup := 0; dup < defaultRotateMaxFileSeek; dup++ {
+		var fpath string
+		if hasSeq {
+			fpath = w.genFilePath(now, 0)
+			w.seq++
+		} else {
+			// file may be rolled over more than once in the same time
+			fpath = w.genFilePath(now, dup)
+		}
+
+		w.fp, err = os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, w.fileMode)
+		if err == nil {
+			w.fpath = fpath
+			break
+		}
+		if !os.IsExist(err) {
+			return errors.Wrapf(err, "create file `%s`", fpath)
+		}
+	}
+	if w.fp == nil {
+		return errors.Errorf("cannot find available file name for pattern `%s`", w.pattern)
+	}
+
+	w.size, w.pending = 0, 0
+	if w.compressor, err = w.newCompressor(&rotateCountWriter{w: w.fp, n: &w.size}); err != nil {
+		CloseQuietly(w.fp)
+		w.fp = nil
+		return errors.Wrap(err, "new compressor")
+	}
+
+	w.records = 0
+	w.openedAt = now
+	Logger.Debug("create new rotate file", zap.String("file", w.fpath))
+	return nil
+}
+
+// closeFile write footer and close current file, return its path
+func (w *RotateCompressWriter) closeFile() (fpath string, err error) {
+	fp, compressor := w.fp, w.compressor
+	fpath = w.fpath
+	w.fp, w.fpath, w.compressor = nil, "", nil
+	defer CloseQuietly(fp)
+
+	if err = compressor.Flush(); err != nil {
+		return "", errors.Wrapf(err, "flush file `%s`", fpath)
+	}
+	if w.fsync {
+		if err = fp.Sync(); err != nil {
+			return "", errors.Wrapf(err, "fsync file `%s`", fpath)
+		}
+	}
+	if err = fp.Close(); err != nil {
+		return "", errors.Wrapf(err, "close file `%s`", fpath)
+	}
+
+	Logger.Debug("rotate file completed", zap.String("file", fpath))
+	return fpath, nil
+}
+
+// rotateCountWriter count bytes written to file
+type rotateCountWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *rotateCountWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
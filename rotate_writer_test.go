@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testReadGzipFile(t *testing.T, fpath string) string {
+	fp, err := os.Open(fpath)
+	require.NoError(t, err)
+	defer fp.Close()
+
+	d, err := NewDecompressor(fp)
+	require.NoError(t, err)
+	defer d.Close()
+	cnt, err := ioutil.ReadAll(d)
+	require.NoError(t, err)
+	return string(cnt)
+}
+
+func TestRotateCompressWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "rotate-writer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newGz := func(w io.Writer) (CompressorItf, error) {
+		return NewGZCompressor(w)
+	}
+
+	var (
+		mu        sync.Mutex
+		completed []string
+	)
+	callback := func(fpath string) {
+		mu.Lock()
+		completed = append(completed, fpath)
+		mu.Unlock()
+	}
+	getCompleted := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, completed...)
+	}
+
+	t.Run("records", func(t *testing.T) {
+		completed = nil
+		w, err := NewRotateCompressWriter(ctx,
+			filepath.Join(dir, "records.{seq}.gz"), newGz,
+			WithRotateMaxRecords(2),
+			WithRotateFsync(true),
+			WithRotateCallback(callback),
+		)
+		require.NoError(t, err)
+
+		for _, r := range []string{"a", "b", "c", "d", "e"} {
+			_, err = w.WriteString(r)
+			require.NoError(t, err)
+		}
+		require.Equal(t, filepath.Join(dir, "records.2.gz"), w.Filename())
+		require.NoError(t, w.Close())
+		_, err = w.WriteString("f")
+		require.Error(t, err)
+
+		files := getCompleted()
+		require.Equal(t, []string{
+			filepath.Join(dir, "records.0.gz"),
+			filepath.Join(dir, "records.1.gz"),
+			filepath.Join(dir, "records.2.gz"),
+		}, files)
+		for i, expect := range []string{"ab", "cd", "e"} {
+			require.Equal(t, expect, testReadGzipFile(t, files[i]))
+		}
+
+		// skip existed files
+		w, err = NewRotateCompressWriter(ctx, filepath.Join(dir, "records.{seq}.gz"), newGz)
+		require.NoError(t, err)
+		_, err = w.WriteString("g")
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, "records.3.gz"), w.Filename())
+		require.NoError(t, w.Close())
+	})
+
+	t.Run("size", func(t *testing.T) {
+		completed = nil
+		w, err := NewRotateCompressWriter(ctx,
+			filepath.Join(dir, "size.{seq}.gz"),
+			func(w io.Writer) (CompressorItf, error) {
+				return NewGZCompressor(w, WithCompressBufSizeByte(1024))
+			},
+			WithRotateMaxSizeByte(100*1024),
+			WithRotateCallback(callback),
+		)
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			_, err = w.WriteString(RandomStringWithLength(50 * 1024))
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+		require.True(t, len(getCompleted()) > 1)
+
+		// small limit should not be overshot by compressor buffer
+		completed = nil
+		w, err = NewRotateCompressWriter(ctx,
+			filepath.Join(dir, "small.{seq}.gz"), newGz,
+			WithRotateMaxSizeByte(10*1024),
+			WithRotateCallback(callback),
+		)
+		require.NoError(t, err)
+		var expect string
+		for i := 0; i < 100; i++ {
+			r := RandomStringWithLength(1024)
+			expect += r
+			_, err = w.WriteString(r)
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+
+		files := getCompleted()
+		require.True(t, len(files) > 5)
+		var got string
+		for _, fpath := range files {
+			finfo, err := os.Stat(fpath)
+			require.NoError(t, err)
+			require.LessOrEqual(t, finfo.Size(), int64(12*1024), fpath)
+			got += testReadGzipFile(t, fpath)
+		}
+		require.Equal(t, expect, got)
+	})
+
+	t.Run("time only", func(t *testing.T) {
+		completed = nil
+		w, err := NewRotateCompressWriter(ctx,
+			filepath.Join(dir, "time.{time}.gz"), newGz,
+			WithRotateMaxRecords(1),
+			WithRotateCallback(callback),
+		)
+		require.NoError(t, err)
+
+		// roll over several times in the same second
+		for _, r := range []string{"a", "b", "c"} {
+			_, err = w.WriteString(r)
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+
+		files := getCompleted()
+		require.Len(t, files, 3)
+		for i, expect := range []string{"a", "b", "c"} {
+			require.Equal(t, expect, testReadGzipFile(t, files[i]))
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		completed = nil
+		w, err := NewRotateCompressWriter(ctx,
+			filepath.Join(dir, "interval.{time}.{seq}.gz"), newGz,
+			WithRotateInterval(100*time.Millisecond),
+			WithRotateCallback(callback),
+		)
+		require.NoError(t, err)
+
+		_, err = w.WriteString("a")
+		require.NoError(t, err)
+		require.Eventually(t, func() bool { return len(getCompleted()) == 1 },
+			time.Second, 10*time.Millisecond)
+		require.Equal(t, "a", testReadGzipFile(t, getCompleted()[0]))
+		require.Empty(t, w.Filename())
+		require.NoError(t, w.Close())
+		require.Len(t, getCompleted(), 1)
+	})
+
+	_, err = NewRotateCompressWriter(ctx, filepath.Join(dir, "a.gz"), newGz)
+	require.Error(t, err)
+	_, err = NewRotateCompressWriter(ctx, filepath.Join(dir, "a.{seq}.gz"), nil)
+	require.Error(t, err)
+	_, err = NewRotateCompressWriter(ctx, filepath.Join(dir, "a.{seq}.gz"), newGz, WithRotateMaxRecords(0))
+	require.Error(t, err)
+}
@@ -1,32 +1,44 @@
 package utils
 
 import (
+	"container/list"
 	"context"
+	"fmt"
 	"io"
+	"os"
+	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/Laisky/zap"
 	"github.com/pkg/errors"
 )
 
+// ErrRunTimeout func not finished before timeout
+var ErrRunTimeout = errors.New("run timeout")
+
 // Race return when any goroutine returned
+//
+// other goroutines keep running after Race returned,
+// use FirstOf to cancel them by ctx.
 func Race(gs ...func()) {
-	cond := sync.NewCond(&sync.Mutex{})
+	if len(gs) == 0 {
+		return
+	}
+
+	done := make(chan struct{}, len(gs))
 	for i := range gs {
 		g := gs[i]
 		go func() {
 			g()
-			cond.L.Lock()
-			cond.Signal()
-			cond.L.Unlock()
+			done <- struct{}{}
 		}()
 	}
 
-	cond.L.Lock()
-	cond.Wait()
-	cond.L.Unlock()
+	<-done
 }
 
 // RaceWithCtx return when any goroutine returned or ctx canceled
@@ -44,24 +56,203 @@ func RaceWithCtx(ctx context.Context, gs ...func()) {
 	<-ctx.Done()
 }
 
-// RunWithTimeout run func with timeout
-func RunWithTimeout(timeout time.Duration, f func()) {
-	Race(f, func() { time.Sleep(timeout) })
+// RunWithTimeout run func with timeout,
+// return ErrRunTimeout if f not finished in time.
+//
+// f keeps running after timeout since it cannot be interrupted.
+func RunWithTimeout(timeout time.Duration, f func()) error {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return errors.Wrapf(ErrRunTimeout, "not finished in %s", timeout)
+	}
+}
+
+// FirstOf run fns concurrently, return the result of the first succeed fn,
+// ctx passed to other fns will be canceled.
+//
+// return MultiError of all fns if all failed,
+// or ctx's error if ctx done before any fn succeed.
+func FirstOf(ctx context.Context, fns ...func(context.Context) (interface{}, error)) (interface{}, error) {
+	if len(fns) == 0 {
+		return nil, errors.Errorf("fns should not be empty")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i   int
+		val interface{}
+		err error
+	}
+	results := make(chan result, len(fns))
+	for i, fn := range fns {
+		go func(i int, fn func(context.Context) (interface{}, error)) {
+			val, err := fn(ctx)
+			results <- result{i, val, err}
+		}(i, fn)
+	}
+
+	errs := make([]error, len(fns))
+	for range fns {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case r := <-results:
+			if r.err == nil {
+				return r.val, nil
+			}
+
+			errs[r.i] = r.err
+		}
+	}
+
+	return nil, NewMultiError(errs...)
+}
+
+// All run fns concurrently with at most concurrency goroutines,
+// wait until all fns returned.
+//
+// concurrency <= 0 means unlimited.
+// fns not started before ctx done will fail with ctx's error.
+// return MultiError of all failed fns.
+func All(ctx context.Context, concurrency int, fns ...func(context.Context) error) error {
+	if concurrency <= 0 || concurrency > len(fns) {
+		concurrency = len(fns)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, concurrency)
+		errs = make([]error, len(fns))
+	)
+	for i, fn := range fns {
+		if ctx.Err() != nil {
+			errs[i] = ctx.Err()
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(i int, fn func(context.Context) error) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(ctx)
+		}(i, fn)
+	}
+
+	wg.Wait()
+	return NewMultiError(errs...)
+}
+
+type mutexOption struct {
+	fair,
+	metrics,
+	debug bool
+	buckets []time.Duration
 }
 
-// const (
-// 	defaultLaiskyRemoteLockTokenUserKey    = "uid"
-// 	defaultLaiskyRemoteLockAuthCookieName  = "general"
-// 	defaultLaiskyRemoteLockTimeout         = 5 * time.Second
-// 	defaultLaiskyRemoteLockRenewalDuration = 10 * time.Second
-// 	defaultLaiskyRemoteLockRenewalInterval = 1 * time.Second
-// 	defaultLaiskyRemoteLockIsRenewal       = false
-// 	defaultLaiskyRemoteLockMaxRetry        = 3
-// )
+// MutexOptFunc options for Mutex
+type MutexOptFunc func(*mutexOption) error
+
+// WithMutexFair waiters acquire lock in FIFO order,
+// lock is handed off to the longest waiter directly on release,
+// and TryLock will not succeed while there are waiters.
+//
+// default to false, woken waiter competes with new comers,
+// which has better throughput.
+func WithMutexFair() MutexOptFunc {
+	return func(opt *mutexOption) error {
+		opt.fair = true
+		return nil
+	}
+}
+
+// WithMutexMetrics collect contention metrics, see `Mutex.Stats`.
+//
+// buckets are upper bounds of wait time histogram,
+// default to 1ms, 10ms, 100ms, 1s.
+func WithMutexMetrics(buckets ...time.Duration) MutexOptFunc {
+	return func(opt *mutexOption) error {
+		for i, b := range buckets {
+			if i > 0 && b <= buckets[i-1] {
+				return errors.Errorf("buckets should be in increasing order, got %v", buckets)
+			}
+		}
+
+		opt.metrics = true
+		if len(buckets) != 0 {
+			opt.buckets = buckets
+		}
+		return nil
+	}
+}
+
+// WithMutexDebug capture stack of holder on every acquire,
+// see `Mutex.HolderStack`.
+//
+// it's expensive, only for debugging deadlocks.
+func WithMutexDebug() MutexOptFunc {
+	return func(opt *mutexOption) error {
+		opt.debug = true
+		return nil
+	}
+}
+
+// MutexWaitBucket bucket of wait time histogram
+type MutexWaitBucket struct {
+	// Le upper bound of wait time, 0 means +Inf
+	Le    time.Duration
+	Count uint64
+}
+
+// MutexStats contention metrics of Mutex
+type MutexStats struct {
+	// Acquired number of acquired by lock methods
+	Acquired uint64
+	// Contended number of lock calls that had to wait
+	Contended uint64
+	// Canceled number of lock calls that gave up waiting
+	Canceled uint64
+	// WaitTotal total wait time of all acquired lock calls
+	WaitTotal time.Duration
+	// WaitHistogram wait time histogram of acquired lock calls
+	WaitHistogram []MutexWaitBucket
+}
 
 // Mutex mutex that support unblocking lock
+//
+// waiters are parked until lock is released or ctx done.
 type Mutex struct {
 	l uint32
+	mutexOption
+
+	mu          sync.Mutex
+	waiters     list.List
+	holderStack []byte
+
+	acquired,
+	contended,
+	canceled,
+	waitTotal uint64
+	// waitHist the last one is +Inf
+	waitHist []uint64
 }
 
 // NewMutex create new mutex
@@ -71,9 +262,147 @@ func NewMutex() *Mutex {
 	}
 }
 
+// NewMutexWithOptions create new mutex with options
+func NewMutexWithOptions(opts ...MutexOptFunc) (*Mutex, error) {
+	m := NewMutex()
+	m.buckets = []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond, time.Second}
+	for _, optf := range opts {
+		if err := optf(&m.mutexOption); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	if m.metrics {
+		m.waitHist = make([]uint64, len(m.buckets)+1)
+	}
+	return m, nil
+}
+
 // TryLock return true if succeed locked
 func (m *Mutex) TryLock() bool {
-	return atomic.CompareAndSwapUint32(&m.l, 0, 1)
+	if !m.tryLock() {
+		return false
+	}
+
+	m.onAcquired(0, false)
+	return true
+}
+
+func (m *Mutex) tryLock() bool {
+	if !m.fair {
+		return atomic.CompareAndSwapUint32(&m.l, 0, 1)
+	}
+
+	// should not jump the queue
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.waiters.Len() == 0 && atomic.CompareAndSwapUint32(&m.l, 0, 1)
+}
+
+// Lock block until acquired lock
+func (m *Mutex) Lock() {
+	_ = m.LockCtx(context.Background())
+}
+
+// LockCtx block until acquired lock or ctx done,
+// return ctx's error if not acquired.
+func (m *Mutex) LockCtx(ctx context.Context) error {
+	if m.TryLock() {
+		return nil
+	}
+
+	var (
+		startAt = Clock.GetUTCNow()
+		woken   bool
+	)
+	for {
+		m.mu.Lock()
+		if (!m.fair || m.waiters.Len() == 0) &&
+			atomic.CompareAndSwapUint32(&m.l, 0, 1) {
+			m.mu.Unlock()
+			m.onAcquired(Clock.GetUTCNow().Sub(startAt), true)
+			return nil
+		}
+
+		w := make(chan struct{})
+		var elem *list.Element
+		if woken {
+			// woken waiter keeps its position
+			elem = m.waiters.PushFront(w)
+		} else {
+			elem = m.waiters.PushBack(w)
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-w:
+			if m.fair {
+				// lock is handed off
+				m.onAcquired(Clock.GetUTCNow().Sub(startAt), true)
+				return nil
+			}
+
+			woken = true
+			continue
+		case <-ctx.Done():
+		}
+
+		m.mu.Lock()
+		select {
+		case <-w:
+			// woken at the same time, pass on to next waiter
+			if m.fair {
+				m.mu.Unlock()
+				m.release()
+				break
+			}
+
+			if atomic.LoadUint32(&m.l) == 0 {
+				m.wakeLocked()
+			}
+			m.mu.Unlock()
+		default:
+			m.waiters.Remove(elem)
+			m.mu.Unlock()
+		}
+
+		if m.metrics {
+			atomic.AddUint64(&m.canceled, 1)
+		}
+		return ctx.Err()
+	}
+}
+
+// TryLockTimeout block until acquired lock or timeout,
+// return true if succeed locked.
+func (m *Mutex) TryLockTimeout(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.LockCtx(ctx) == nil
+}
+
+// onAcquired update metrics and holder stack
+func (m *Mutex) onAcquired(wait time.Duration, contended bool) {
+	if m.debug {
+		buf := make([]byte, 4096)
+		buf = buf[:runtime.Stack(buf, false)]
+		m.mu.Lock()
+		m.holderStack = buf
+		m.mu.Unlock()
+	}
+	if !m.metrics {
+		return
+	}
+
+	atomic.AddUint64(&m.acquired, 1)
+	if contended {
+		atomic.AddUint64(&m.contended, 1)
+	}
+	atomic.AddUint64(&m.waitTotal, uint64(wait))
+	i := sort.Search(len(m.buckets), func(i int) bool {
+		return wait <= m.buckets[i]
+	})
+	atomic.AddUint64(&m.waitHist[i], 1)
 }
 
 // IsLocked return true if is locked
@@ -81,212 +410,86 @@ func (m *Mutex) IsLocked() bool {
 	return atomic.LoadUint32(&m.l) == 1
 }
 
+// Unlock release lock
+func (m *Mutex) Unlock() {
+	m.release()
+}
+
 // TryRelease return true if succeed release
 func (m *Mutex) TryRelease() bool {
-	return atomic.CompareAndSwapUint32(&m.l, 1, 0)
+	return m.release()
 }
 
 // ForceRelease force release lock
 func (m *Mutex) ForceRelease() {
+	m.release()
+}
+
+// release return false if not locked
+func (m *Mutex) release() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if atomic.LoadUint32(&m.l) == 0 {
+		return false
+	}
+
+	m.holderStack = nil
+	if m.fair && m.waiters.Len() != 0 {
+		// hand off to the longest waiter, keep locked
+		close(m.waiters.Remove(m.waiters.Front()).(chan struct{}))
+		return true
+	}
+
 	atomic.StoreUint32(&m.l, 0)
+	m.wakeLocked()
+	return true
+}
+
+// wakeLocked wake up the first waiter, m.mu should be held
+func (m *Mutex) wakeLocked() {
+	if e := m.waiters.Front(); e != nil {
+		close(m.waiters.Remove(e).(chan struct{}))
+	}
 }
 
 // SpinLock block until succee acquired lock
+//
+// Deprecated: use TryLockTimeout or LockCtx instead
 func (m *Mutex) SpinLock(step, timeout time.Duration) {
-	start := Clock.GetUTCNow()
-	for {
-		if m.TryLock() || Clock.GetUTCNow().Sub(start) > timeout {
-			return
+	m.TryLockTimeout(timeout)
+}
+
+// HolderStack stack of current holder,
+// only available with WithMutexDebug.
+func (m *Mutex) HolderStack() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return string(m.holderStack)
+}
+
+// Stats contention metrics, only available with WithMutexMetrics.
+func (m *Mutex) Stats() *MutexStats {
+	if !m.metrics {
+		return &MutexStats{}
+	}
+
+	stats := &MutexStats{
+		Acquired:  atomic.LoadUint64(&m.acquired),
+		Contended: atomic.LoadUint64(&m.contended),
+		Canceled:  atomic.LoadUint64(&m.canceled),
+		WaitTotal: time.Duration(atomic.LoadUint64(&m.waitTotal)),
+	}
+	for i := range m.waitHist {
+		b := MutexWaitBucket{Count: atomic.LoadUint64(&m.waitHist[i])}
+		if i < len(m.buckets) {
+			b.Le = m.buckets[i]
 		}
-		time.Sleep(step)
-	}
-}
-
-// // LaiskyRemoteLock acquire lock from Laisky's GraphQL API
-// type LaiskyRemoteLock struct {
-// 	cli *graphql.Client
-// 	token,
-// 	tokenCookieName,
-// 	userID string
-
-// 	timeout time.Duration
-// }
-
-// // LaiskyRemoteLockOptFunc laisky's lock option
-// type LaiskyRemoteLockOptFunc func(*LaiskyRemoteLock) error
-
-// // WithLaiskyRemoteLockTimeout set http client timeout
-// func WithLaiskyRemoteLockTimeout(timeout time.Duration) LaiskyRemoteLockOptFunc {
-// 	return func(opt *LaiskyRemoteLock) error {
-// 		opt.timeout = timeout
-// 		return nil
-// 	}
-// }
-
-// type headerTransport struct {
-// 	base    http.RoundTripper
-// 	headers map[string]string
-// }
-
-// // NewLaiskyRemoteLock create remote lock
-// func NewLaiskyRemoteLock(api, token string, opts ...LaiskyRemoteLockOptFunc) (l *LaiskyRemoteLock, err error) {
-// 	var payload jwt.MapClaims
-// 	if payload, err = ParseJWTTokenWithoutValidate(token); err != nil {
-// 		return nil, errors.Wrap(err, "token invalidate")
-// 	}
-
-// 	l = &LaiskyRemoteLock{
-// 		token:           token,
-// 		tokenCookieName: defaultLaiskyRemoteLockAuthCookieName,
-// 		timeout:         defaultLaiskyRemoteLockTimeout,
-// 	}
-// 	var ok bool
-// 	if l.userID, ok = payload[defaultLaiskyRemoteLockTokenUserKey].(string); !ok {
-// 		return nil, errors.Errorf("unknown typo of %s, should be string", defaultLaiskyRemoteLockTokenUserKey)
-// 	}
-// 	for _, optf := range opts {
-// 		if err = optf(l); err != nil {
-// 			return nil, errors.Wrap(err, "set option")
-// 		}
-// 	}
-
-// 	l.cli = graphql.NewClient(
-// 		api,
-// 		&http.Client{
-// 			Timeout: l.timeout,
-// 		},
-// 		graphql.WithCookie(l.tokenCookieName, l.token),
-// 	)
-
-// 	return l, nil
-// }
-
-// type acquireLockMutation struct {
-// 	AcquireLock bool `graphql:"AcquireLock(
-// lock_name: $lock_name,
-//  is_renewal: $is_renewal,
-//  duration_sec: $duration_sec)"`
-// }
-
-// type acquireLockOption struct {
-// 	renewalInterval,
-// 	duration time.Duration
-// 	isRenewal bool
-// 	maxRetry  int
-// }
-
-// // AcquireLockOptFunc options for acquire lock
-// type AcquireLockOptFunc func(*acquireLockOption) error
-
-// // WithAcquireLockDuration set how long to extend lock
-// func WithAcquireLockDuration(duration time.Duration) AcquireLockOptFunc {
-// 	return func(opt *acquireLockOption) error {
-// 		if duration <= 0 {
-// 			return errors.Errorf("duration should greater than 0, got %d", duration)
-// 		}
-
-// 		opt.duration = duration
-// 		return nil
-// 	}
-// }
-
-// // WithAcquireLockRenewalInterval set how ofter to renewal lock
-// func WithAcquireLockRenewalInterval(renewalInterval time.Duration) AcquireLockOptFunc {
-// 	return func(opt *acquireLockOption) error {
-// 		if renewalInterval < 100*time.Millisecond {
-// 			return errors.Errorf("renewalInterval must greater than 100ms, got %d", renewalInterval)
-// 		}
-
-// 		opt.renewalInterval = renewalInterval
-// 		return nil
-// 	}
-// }
-
-// // WithAcquireLockIsRenewal set whether to auto renewal lock
-// func WithAcquireLockIsRenewal(isRenewal bool) AcquireLockOptFunc {
-// 	return func(opt *acquireLockOption) error {
-// 		opt.isRenewal = isRenewal
-// 		return nil
-// 	}
-// }
-
-// // WithAcquireLockMaxRetry set max retry to acquire lock
-// func WithAcquireLockMaxRetry(maxRetry int) AcquireLockOptFunc {
-// 	return func(opt *acquireLockOption) error {
-// 		if maxRetry < 0 {
-// 			return errors.Errorf("maxRetry must greater than 0, got %d", maxRetry)
-// 		}
-
-// 		opt.maxRetry = maxRetry
-// 		return nil
-// 	}
-// }
-
-// // AcquireLock acquire lock with lockname,
-// // if `isRenewal=true`, will automate refresh lock's lease until ctx done.
-// // duration to specify how much time each renewal will extend.
-// func (l *LaiskyRemoteLock) AcquireLock(ctx context.Context,
-// lockName string,
-// opts ...AcquireLockOptFunc) (ok bool, err error) {
-// 	opt := &acquireLockOption{
-// 		renewalInterval: defaultLaiskyRemoteLockRenewalInterval,
-// 		duration:        defaultLaiskyRemoteLockRenewalDuration,
-// 		isRenewal:       defaultLaiskyRemoteLockIsRenewal,
-// 		maxRetry:        defaultLaiskyRemoteLockMaxRetry,
-// 	}
-// 	for _, optf := range opts {
-// 		if err = optf(opt); err != nil {
-// 			return ok, errors.Wrap(err, "set option")
-// 		}
-// 	}
-
-// 	var (
-// 		query = new(acquireLockMutation)
-// 		vars  = map[string]interface{}{
-// 			"lock_name":    graphql.String(lockName),
-// 			"is_renewal":   graphql.Boolean(opt.isRenewal),
-// 			"duration_sec": graphql.Int(opt.duration.Seconds()),
-// 		}
-// 	)
-// 	if err = l.cli.Mutate(ctx, query, vars); err != nil {
-// 		return ok, errors.Wrap(err, "request graphql mutation")
-// 	}
-// 	if ok = query.AcquireLock; opt.isRenewal && ok {
-// 		go l.renewalLock(ctx, query, vars, opt)
-// 	}
-// 	return ok, nil
-// }
-
-// func (l *LaiskyRemoteLock) renewalLock(ctx context.Context,
-// query *acquireLockMutation,
-//  vars map[string]interface{}, opt *acquireLockOption) {
-// 	var (
-// 		nRetry   = 0
-// 		err      error
-// 		ticker   = time.NewTicker(opt.renewalInterval)
-// 		lockName = string(vars["lock_name"].(graphql.String))
-// 	)
-// 	defer ticker.Stop()
-// 	Logger.Debug("start to auto renewal lock", zap.String("lock_name", lockName))
-// 	for nRetry < opt.maxRetry {
-// 		select {
-// 		case <-ctx.Done():
-// 			return
-// 		case <-ticker.C:
-// 		}
-
-// 		if err = l.cli.Mutate(ctx, query, vars); err != nil {
-// 			Logger.Error("renewal lock",
-// zap.Error(err),
-// zap.Int("n_retry", nRetry), zap.String("lock_name", lockName))
-// 			time.Sleep(1 * time.Second)
-// 			nRetry++
-// 			continue
-// 		}
-// 		nRetry = 0
-// 		Logger.Debug("success renewal lock", zap.String("lock_name", lockName))
-// 	}
-// }
+
+		stats.WaitHistogram = append(stats.WaitHistogram, b)
+	}
+
+	return stats
+}
 
 // ExpiredRLock Lock with expire time
 type ExpiredRLock struct {
@@ -308,48 +511,292 @@ func (e *ExpiredRLock) GetLock(key string) *sync.RWMutex {
 	return e.m.Get(key).(*sync.RWMutex)
 }
 
-// FLock lock by file
+const defaultFlockPollInterval = 50 * time.Millisecond
+
+// FlockHolder holder info written in lock file by exclusive lock
+type FlockHolder struct {
+	PID        int       `json:"pid"`
+	Host       string    `json:"host"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	// Stale holder is on this host but its process is dead.
+	//
+	// it's informational only, lock is already released by kernel
+	// when holder process died, no need to take over.
+	Stale bool `json:"-"`
+}
+
+// FLock lock by file, based on fcntl record locks.
+//
+// locks are held by process, so FLocks on the same file in one process
+// will not exclude each other, and unlock any of them will release all.
 type FLock interface {
+	// Lock acquire exclusive lock, block until acquired
 	Lock() error
+	// LockCtx acquire exclusive lock, block until acquired or ctx done
+	LockCtx(ctx context.Context) error
+	// TryLock return true if succeed acquired exclusive lock
+	TryLock() (bool, error)
+	// RLock acquire shared lock, block until acquired
+	RLock() error
+	// RLockCtx acquire shared lock, block until acquired or ctx done
+	RLockCtx(ctx context.Context) error
+	// TryRLock return true if succeed acquired shared lock
+	TryRLock() (bool, error)
+	// Unlock release lock, lock file will not be removed
 	Unlock() error
+	// Holder read holder of exclusive lock from lock file,
+	// return nil if there is no holder info.
+	Holder() (*FlockHolder, error)
 }
 
 type flock struct {
+	mu    sync.Mutex
 	fpath string
-	fd    int
+	// fd opened lock file, -1 if not opened.
+	//
+	// closing any fd of lock file will release all locks of process,
+	// so fd is kept opened during acquiring and holding lock.
+	fd int
+	// typ type of holding lock, valid only if locked
+	typ int16
+	acquiring,
+	locked bool
 }
 
 // NewFlock new file lock
 func NewFlock(lockFilePath string) FLock {
 	return &flock{
 		fpath: lockFilePath,
+		fd:    -1,
 	}
 }
 
-func (f *flock) Lock() (err error) {
-	f.fd, err = syscall.Open(f.fpath, syscall.O_CREAT|syscall.O_RDWR|syscall.O_CLOEXEC, 0666)
+func (f *flock) Lock() error {
+	return f.LockCtx(context.Background())
+}
+
+func (f *flock) LockCtx(ctx context.Context) error {
+	_, err := f.lock(ctx, syscall.F_WRLCK, true)
+	return err
+}
+
+func (f *flock) TryLock() (bool, error) {
+	return f.lock(context.Background(), syscall.F_WRLCK, false)
+}
+
+func (f *flock) RLock() error {
+	return f.RLockCtx(context.Background())
+}
+
+func (f *flock) RLockCtx(ctx context.Context) error {
+	_, err := f.lock(ctx, syscall.F_RDLCK, true)
+	return err
+}
+
+func (f *flock) TryRLock() (bool, error) {
+	return f.lock(context.Background(), syscall.F_RDLCK, false)
+}
+
+func (f *flock) lock(ctx context.Context, typ int16, block bool) (ok bool, err error) {
+	f.mu.Lock()
+	if f.locked || f.acquiring {
+		f.mu.Unlock()
+		return false, errors.Errorf("`%s` already locked", f.fpath)
+	}
+
+	fd, err := syscall.Open(f.fpath, syscall.O_CREAT|syscall.O_RDWR|syscall.O_CLOEXEC, 0666)
 	if err != nil {
-		return errors.Wrapf(err, "open `%s`", f.fpath)
+		f.mu.Unlock()
+		return false, errors.Wrapf(err, "open `%s`", f.fpath)
+	}
+	f.fd = fd
+	f.acquiring = true
+	f.mu.Unlock()
+
+	// do not hold mu during waiting
+	ok, err = f.waitLock(ctx, fd, typ, block)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acquiring = false
+	if ok && typ == syscall.F_WRLCK {
+		if err = f.writeHolder(fd); err != nil {
+			ok = false
+		}
 	}
+	if !ok {
+		_ = syscall.Close(fd)
+		f.fd = -1
+		return false, err
+	}
+
+	f.typ = typ
+	f.locked = true
+	return true, nil
+}
 
-	flock := syscall.Flock_t{
-		Type:   syscall.F_WRLCK,
+// waitLock set lock on fd, poll until acquired or ctx done if block
+func (f *flock) waitLock(ctx context.Context, fd int, typ int16, block bool) (ok bool, err error) {
+	var timer *time.Timer
+	lk := syscall.Flock_t{
+		Type:   typ,
 		Whence: io.SeekStart,
 		Start:  0,
 		Len:    0,
 	}
-	if err := syscall.FcntlFlock(uintptr(f.fd), syscall.F_SETLK, &flock); err != nil {
-		return errors.Wrap(err, "FcntlFlock(F_SETLK)")
+	for {
+		if err = syscall.FcntlFlock(uintptr(fd), syscall.F_SETLK, &lk); err == nil {
+			break
+		}
+
+		if err != syscall.EAGAIN && err != syscall.EACCES {
+			return false, errors.Wrap(err, "FcntlFlock(F_SETLK)")
+		}
+		if !block {
+			return false, nil
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(defaultFlockPollInterval)
+			defer timer.Stop()
+		} else {
+			timer.Reset(defaultFlockPollInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return false, errors.Wrapf(ctx.Err(), "wait lock `%s` %s", f.fpath, lockedBy(fd, typ))
+		case <-timer.C:
+		}
+	}
+
+	return true, nil
+}
+
+// lockedBy describe which process is holding lock conflicts with typ
+func lockedBy(fd int, typ int16) string {
+	lk := syscall.Flock_t{
+		Type:   typ,
+		Whence: io.SeekStart,
+	}
+	if err := syscall.FcntlFlock(uintptr(fd), syscall.F_GETLK, &lk); err != nil ||
+		lk.Type == syscall.F_UNLCK {
+		return ""
+	}
+
+	return fmt.Sprintf("locked by pid %d", lk.Pid)
+}
+
+// writeHolder replace holder info in lock file with current process
+func (f *flock) writeHolder(fd int) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return errors.Wrap(err, "get hostname")
+	}
+	cnt, err := json.Marshal(&FlockHolder{
+		PID:        os.Getpid(),
+		Host:       host,
+		AcquiredAt: Clock.GetUTCNow(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal holder")
+	}
+
+	if err = syscall.Ftruncate(fd, 0); err != nil {
+		return errors.Wrapf(err, "truncate `%s`", f.fpath)
+	}
+	if _, err = syscall.Pwrite(fd, cnt, 0); err != nil {
+		return errors.Wrapf(err, "write holder to `%s`", f.fpath)
 	}
 
 	return nil
 }
 
+func readFlockHolder(fd int) (holder *FlockHolder, err error) {
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return nil, errors.Wrap(err, "stat lock file")
+	}
+	if st.Size == 0 {
+		return nil, nil
+	}
+
+	cnt := make([]byte, st.Size)
+	n, err := syscall.Pread(fd, cnt, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "read lock file")
+	}
+
+	holder = new(FlockHolder)
+	if err = json.Unmarshal(cnt[:n], holder); err != nil {
+		return nil, errors.Wrap(err, "unmarshal holder")
+	}
+
+	if host, err := os.Hostname(); err == nil && host == holder.Host {
+		holder.Stale = !isProcessAlive(holder.PID)
+	}
+
+	return holder, nil
+}
+
+// isProcessAlive return true if process with pid exists
+func isProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Holder read holder by opened fd if f is acquiring or holding lock,
+// otherwise open lock file temporarily.
+//
+// closing temporary fd will release locks held by other FLocks
+// on the same file in this process.
+func (f *flock) Holder() (*FlockHolder, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fd >= 0 {
+		return readFlockHolder(f.fd)
+	}
+
+	fd, err := syscall.Open(f.fpath, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open `%s`", f.fpath)
+	}
+	defer syscall.Close(fd) // nolint: errcheck
+
+	return readFlockHolder(fd)
+}
+
 func (f *flock) Unlock() error {
-	if err := syscall.Close(f.fd); err != nil {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.locked {
+		return errors.Errorf("`%s` not locked", f.fpath)
+	}
+
+	if f.typ == syscall.F_WRLCK {
+		// clear holder info before release
+		if err := syscall.Ftruncate(f.fd, 0); err != nil {
+			Logger.Warn("truncate lock file", zap.String("file", f.fpath), zap.Error(err))
+		}
+	}
+
+	fd := f.fd
+	f.locked = false
+	f.fd = -1
+	lk := syscall.Flock_t{
+		Type:   syscall.F_UNLCK,
+		Whence: io.SeekStart,
+	}
+	if err := syscall.FcntlFlock(uintptr(fd), syscall.F_SETLK, &lk); err != nil {
+		_ = syscall.Close(fd)
+		return errors.Wrap(err, "FcntlFlock(F_UNLCK)")
+	}
+	if err := syscall.Close(fd); err != nil {
 		return errors.Wrap(err, "close file")
 	}
 
-	_ = syscall.Unlink(f.fpath)
 	return nil
 }
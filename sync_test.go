@@ -1,14 +1,19 @@
 package utils
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -34,6 +39,111 @@ func TestMutex(t *testing.T) {
 	require.False(t, l.IsLocked(), "should not locked")
 }
 
+func TestMutexLockCtx(t *testing.T) {
+	for _, fair := range []bool{false, true} {
+		opts := []MutexOptFunc{WithMutexMetrics(), WithMutexDebug()}
+		if fair {
+			opts = append(opts, WithMutexFair())
+		}
+
+		t.Run(fmt.Sprintf("fair %v", fair), func(t *testing.T) {
+			l, err := NewMutexWithOptions(opts...)
+			require.NoError(t, err)
+			l.Lock()
+			require.Contains(t, l.HolderStack(), "TestMutexLockCtx")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			require.Equal(t, context.DeadlineExceeded, l.LockCtx(ctx))
+			require.False(t, l.TryLockTimeout(10*time.Millisecond))
+
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				l.Unlock()
+			}()
+			require.True(t, l.TryLockTimeout(time.Second))
+			l.Unlock()
+			require.Empty(t, l.HolderStack())
+
+			// goroutines parked and canceled randomly
+			var (
+				cnt int
+				wg  sync.WaitGroup
+			)
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for k := 0; k < 50; k++ {
+						ctx, cancel := context.WithTimeout(context.Background(), time.Duration(k%3)*time.Millisecond)
+						if (i+k)%4 == 0 {
+							ctx, cancel = context.WithCancel(context.Background())
+						}
+						if l.LockCtx(ctx) == nil {
+							cnt++
+							l.Unlock()
+						}
+						cancel()
+					}
+				}(i)
+			}
+			wg.Wait()
+			require.False(t, l.IsLocked())
+
+			stats := l.Stats()
+			require.Equal(t, uint64(cnt+2), stats.Acquired)
+			require.Equal(t, uint64(1000-cnt+2), stats.Canceled)
+			require.Len(t, stats.WaitHistogram, 5)
+			var total uint64
+			for _, b := range stats.WaitHistogram {
+				total += b.Count
+			}
+			require.Equal(t, stats.Acquired, total)
+		})
+	}
+
+	t.Run("fifo", func(t *testing.T) {
+		l, err := NewMutexWithOptions(WithMutexFair())
+		require.NoError(t, err)
+		l.Lock()
+
+		var (
+			order   = make(chan int, 5)
+			cancels []context.CancelFunc
+		)
+		for i := 0; i < 5; i++ {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancels = append(cancels, cancel)
+			go func(i int) {
+				if l.LockCtx(ctx) == nil {
+					order <- i
+					l.Unlock()
+				}
+			}(i)
+
+			// wait until parked
+			for {
+				l.mu.Lock()
+				n := l.waiters.Len()
+				l.mu.Unlock()
+				if n == i+1 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		// new comer should not jump the queue
+		require.False(t, l.TryLockTimeout(10*time.Millisecond))
+		cancels[2]()
+		l.Unlock()
+
+		for _, i := range []int{0, 1, 3, 4} {
+			require.Equal(t, i, <-order)
+		}
+	})
+}
+
 func ExampleMutex() {
 	l := NewMutex()
 	if !l.TryLock() {
@@ -163,9 +273,85 @@ func ExampleRunWithTimeout() {
 func TestRunWithTimeout(t *testing.T) {
 	slow := func() { time.Sleep(10 * time.Second) }
 	startAt := time.Now()
-	RunWithTimeout(5*time.Millisecond, slow)
+	err := RunWithTimeout(5*time.Millisecond, slow)
 	require.GreaterOrEqual(t, time.Since(startAt), 5*time.Millisecond)
 	require.Less(t, time.Since(startAt), 10*time.Millisecond)
+	require.Equal(t, ErrRunTimeout, errors.Cause(err))
+
+	require.NoError(t, RunWithTimeout(time.Second, func() {}))
+}
+
+func TestFirstOf(t *testing.T) {
+	var canceled int32
+	slow := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		atomic.AddInt32(&canceled, 1)
+		return nil, ctx.Err()
+	}
+	failed := func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("failed")
+	}
+	succeed := func(ctx context.Context) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		return 1, nil
+	}
+
+	val, err := FirstOf(context.Background(), slow, failed, succeed, slow)
+	require.NoError(t, err)
+	require.Equal(t, 1, val)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&canceled) == 2
+	}, time.Second, time.Millisecond)
+
+	_, err = FirstOf(context.Background(), failed, failed)
+	require.Error(t, err)
+	require.Len(t, err.(*MultiError).Errors, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = FirstOf(ctx, failed, slow)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestAll(t *testing.T) {
+	var running, maxRunning int32
+	fns := make([]func(context.Context) error, 10)
+	for i := range fns {
+		i := i
+		fns[i] = func(ctx context.Context) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			if i%3 == 0 {
+				return errors.Errorf("task %d", i)
+			}
+			return nil
+		}
+	}
+
+	err := All(context.Background(), 3, fns...)
+	require.Error(t, err)
+	require.LessOrEqual(t, atomic.LoadInt32(&maxRunning), int32(3))
+	merr := err.(*MultiError)
+	require.Len(t, merr.Errors, 10)
+	for i, err := range merr.Errors {
+		require.Equal(t, i%3 == 0, err != nil, i)
+	}
+	require.Contains(t, err.Error(), "4 of 10 tasks failed")
+
+	require.NoError(t, All(context.Background(), 0, fns[1], fns[2]))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = All(ctx, 1, fns[1], fns[2])
+	require.Equal(t, context.Canceled, err.(*MultiError).Errors[1])
 }
 
 func ExampleRace() {
@@ -192,6 +378,11 @@ func TestRace(t *testing.T) {
 
 	require.GreaterOrEqual(t, time.Since(startAt), time.Millisecond)
 	require.Less(t, time.Since(startAt), time.Second)
+
+	// should not miss goroutines returned immediately
+	for i := 0; i < 100; i++ {
+		Race(func() {}, func() {})
+	}
 }
 
 func TestRaceWithCtx(t *testing.T) {
@@ -238,4 +429,147 @@ func TestNewFlock(t *testing.T) {
 		require.NoError(t, flock1.Unlock())
 		require.NoError(t, flock2.Unlock())
 	})
+
+	t.Run("lock twice", func(t *testing.T) {
+		f := NewFlock(lockfile)
+		ok, err := f.TryLock()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Error(t, f.RLock())
+
+		holder, err := f.Holder()
+		require.NoError(t, err)
+		require.Equal(t, os.Getpid(), holder.PID)
+		require.False(t, holder.Stale)
+
+		require.NoError(t, f.Unlock())
+		require.Error(t, f.Unlock())
+		holder, err = f.Holder()
+		require.NoError(t, err)
+		require.Nil(t, holder)
+	})
+
+	// fcntl locks only exclude other processes
+	startHolder := func(t *testing.T, mode string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=TestFlockHelperProcess")
+		cmd.Env = append(os.Environ(), "FLOCK_HELPER_MODE="+mode, "FLOCK_HELPER_FILE="+lockfile)
+		stdout, err := cmd.StdoutPipe()
+		require.NoError(t, err)
+		require.NoError(t, cmd.Start())
+
+		// wait for helper locked, logs are also written to stdout
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if scanner.Text() == "locked" {
+				return cmd
+			}
+		}
+
+		t.Fatalf("helper exited: %v", scanner.Err())
+		return nil
+	}
+
+	t.Run("other process exclusive", func(t *testing.T) {
+		cmd := startHolder(t, "lock")
+		f := NewFlock(lockfile)
+
+		ok, err := f.TryLock()
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = f.TryRLock()
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err = f.LockCtx(ctx)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), fmt.Sprintf("locked by pid %d", cmd.Process.Pid))
+
+		holder, err := f.Holder()
+		require.NoError(t, err)
+		require.Equal(t, cmd.Process.Pid, holder.PID)
+		require.False(t, holder.Stale)
+
+		// lock released after holder died
+		locked := make(chan error)
+		go func() {
+			locked <- f.Lock()
+		}()
+		require.NoError(t, cmd.Process.Kill())
+		_ = cmd.Wait()
+		require.NoError(t, <-locked)
+		require.NoError(t, f.Unlock())
+	})
+
+	t.Run("read holder when locked", func(t *testing.T) {
+		cmd := startHolder(t, "holder")
+		defer func() {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}()
+
+		f := NewFlock(lockfile)
+		ok, err := f.TryRLock()
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("stale holder", func(t *testing.T) {
+		cmd := startHolder(t, "lock")
+		require.NoError(t, cmd.Process.Kill())
+		_ = cmd.Wait()
+
+		holder, err := NewFlock(lockfile).Holder()
+		require.NoError(t, err)
+		require.Equal(t, cmd.Process.Pid, holder.PID)
+		require.True(t, holder.Stale)
+	})
+
+	t.Run("other process shared", func(t *testing.T) {
+		cmd := startHolder(t, "rlock")
+		defer func() {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}()
+		f := NewFlock(lockfile)
+
+		ok, err := f.TryLock()
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		ok, err = f.TryRLock()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, f.Unlock())
+	})
+}
+
+// TestFlockHelperProcess hold lock in another process for TestNewFlock
+func TestFlockHelperProcess(t *testing.T) {
+	mode := os.Getenv("FLOCK_HELPER_MODE")
+	if mode == "" {
+		return
+	}
+
+	f := NewFlock(os.Getenv("FLOCK_HELPER_FILE"))
+	var err error
+	if mode == "rlock" {
+		err = f.RLock()
+	} else {
+		err = f.Lock()
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+	if mode == "holder" {
+		// read holder should not release lock
+		if holder, err := f.Holder(); err != nil || holder.PID != os.Getpid() {
+			os.Exit(1)
+		}
+	}
+
+	fmt.Println("locked")
+	time.Sleep(time.Minute)
+	os.Exit(0)
 }
@@ -0,0 +1,437 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+type tarOption struct {
+	format       CompressFormat
+	compressOpts []CompressOptFunc
+	excludes     []string
+	symlink      UnzipSymlinkPolicy
+	fs           FS
+}
+
+// TarOptFunc options for tar
+type TarOptFunc func(*tarOption) error
+
+// WithTarCompress compress tar archive by format,
+// support all formats of `NewCompressor`, like `gzip` or `zstd`.
+//
+// extraction will detect compression by magic bytes automatically.
+func WithTarCompress(format CompressFormat, opts ...CompressOptFunc) TarOptFunc {
+	return func(opt *tarOption) error {
+		opt.format = format
+		opt.compressOpts = opts
+		return nil
+	}
+}
+
+// WithTarExclude do not add files that match any of patterns,
+// pattern syntax is the same as `WithUnzipInclude`.
+func WithTarExclude(patterns ...string) TarOptFunc {
+	return func(opt *tarOption) error {
+		if err := checkArchivePatterns(patterns); err != nil {
+			return err
+		}
+
+		opt.excludes = append(opt.excludes, patterns...)
+		return nil
+	}
+}
+
+// WithTarSymlinkPolicy set how to deal with symlinks when extracting,
+// the same as `WithUnzipSymlinkPolicy`.
+//
+// default to UnzipSymlinkSkip
+func WithTarSymlinkPolicy(policy UnzipSymlinkPolicy) TarOptFunc {
+	return func(opt *tarOption) error {
+		switch policy {
+		case UnzipSymlinkSkip, UnzipSymlinkInDir, UnzipSymlinkError:
+		default:
+			return errors.Errorf("unknown symlink policy %d", policy)
+		}
+
+		opt.symlink = policy
+		return nil
+	}
+}
+
+// WithTarFS read and write files in fsys, default to OSFS
+func WithTarFS(fsys FS) TarOptFunc {
+	return func(opt *tarOption) error {
+		if fsys == nil {
+			return errors.Errorf("fs cannot be nil")
+		}
+
+		opt.fs = fsys
+		return nil
+	}
+}
+
+func newTarOption(opts []TarOptFunc) (*tarOption, error) {
+	opt := &tarOption{fs: OSFS}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	return opt, nil
+}
+
+// TarFiles archive files into tar file.
+//
+// Args:
+//   * output: is the output tar file's name.
+//   * files: is a list of files to add to the tar.
+//            files can be directory.
+func TarFiles(output string, files []string, opts ...TarOptFunc) (err error) {
+	opt, err := newTarOption(opts)
+	if err != nil {
+		return err
+	}
+
+	fp, err := opt.fs.OpenFile(output, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "create file `%s`", output)
+	}
+	defer CloseQuietly(fp)
+
+	if err = WriteTar(fp, files, opts...); err != nil {
+		return err
+	}
+
+	return fp.Close()
+}
+
+// WriteTar write tar archive of files into writer,
+// mode, mtime and symlinks will be preserved.
+//
+// writer will not be closed.
+func WriteTar(writer io.Writer, files []string, opts ...TarOptFunc) (err error) {
+	opt, err := newTarOption(opts)
+	if err != nil {
+		return err
+	}
+
+	var compressor CompressorItf
+	if opt.format != CompressFormatUnknown {
+		if compressor, err = NewCompressor(string(opt.format), writer, opt.compressOpts...); err != nil {
+			return errors.Wrap(err, "new compressor")
+		}
+
+		writer = compressor
+	}
+
+	tw := tar.NewWriter(writer)
+	for _, file := range files {
+		if err = opt.addFileToTar(tw, file); err != nil {
+			return errors.Wrapf(err, "add `%s` to tar", file)
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return errors.Wrap(err, "close tar")
+	}
+	if compressor != nil {
+		if err = compressor.Flush(); err != nil {
+			return errors.Wrap(err, "flush compressor")
+		}
+	}
+
+	return nil
+}
+
+// addFileToTar add file or directory recursively into tar,
+// entries are named relative to the parent of root.
+func (opt *tarOption) addFileToTar(tw *tar.Writer, root string) error {
+	root = filepath.Clean(root)
+	basedir := filepath.Dir(root)
+	return walkFS(opt.fs, root, func(fpath string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(basedir, fpath)
+		if err != nil {
+			return errors.Wrapf(err, "get relative path of `%s`", fpath)
+		}
+
+		if matchArchivePatterns(opt.excludes, filepath.ToSlash(name)) {
+			Logger.Debug("skip excluded file", zap.String("file", fpath))
+			if finfo.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		var link string
+		if finfo.Mode()&os.ModeSymlink != 0 {
+			if link, err = opt.fs.Readlink(fpath); err != nil {
+				return errors.Wrapf(err, "read link `%s`", fpath)
+			}
+		}
+
+		header, err := tar.FileInfoHeader(finfo, link)
+		if err != nil {
+			return errors.Wrapf(err, "get header of `%s`", fpath)
+		}
+		header.Name = filepath.ToSlash(name)
+		if finfo.IsDir() {
+			header.Name += "/"
+		}
+
+		if err = tw.WriteHeader(header); err != nil {
+			return errors.Wrapf(err, "write header of `%s`", fpath)
+		}
+		if !finfo.Mode().IsRegular() {
+			return nil
+		}
+
+		fp, err := opt.fs.Open(fpath)
+		if err != nil {
+			return errors.Wrapf(err, "open file `%s`", fpath)
+		}
+		defer CloseQuietly(fp)
+
+		if _, err = io.Copy(tw, fp); err != nil {
+			return errors.Wrapf(err, "copy file `%s`", fpath)
+		}
+
+		Logger.Debug("add file to tar", zap.String("file", fpath))
+		return nil
+	})
+}
+
+// Untar extract tar archive file into dest directory,
+// compression will be detected automatically.
+func Untar(src, dest string, opts ...TarOptFunc) (filenames []string, err error) {
+	opt, err := newTarOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := opt.fs.Open(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file `%s`", src)
+	}
+	defer CloseQuietly(fp)
+
+	return ExtractTar(fp, dest, opts...)
+}
+
+// ExtractTar extract tar archive from reader into dest directory,
+// compression will be detected automatically.
+//
+// mode and mtime will be restored, symlinks depend on `WithTarSymlinkPolicy`.
+// entries or links that point outside of dest, or be written through
+// any symlink under dest, will be rejected.
+func ExtractTar(reader io.Reader, dest string, opts ...TarOptFunc) (filenames []string, err error) {
+	opt, err := newTarOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bufio.NewReader(reader)
+	header, err := buf.Peek(compressMagicPeekLen)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "read header")
+	}
+
+	reader = buf
+	if format := DetectCompressFormat(header); format != CompressFormatUnknown {
+		d, err := NewDecompressorByFormat(format, buf)
+		if err != nil {
+			return nil, errors.Wrap(err, "new decompressor")
+		}
+		defer CloseQuietly(d)
+
+		reader = d
+	}
+
+	dest = filepath.Clean(dest)
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTime
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return filenames, errors.Wrap(err, "read tar")
+		}
+
+		fpath := filepath.Join(dest, hdr.Name)
+		if err = checkArchivePath(opt.fs, dest, fpath, hdr.Typeflag == tar.TypeDir); err != nil {
+			return filenames, errors.Wrapf(err, "illegal file path: %s", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = opt.fs.MkdirAll(fpath, os.FileMode(hdr.Mode).Perm()|0700); err != nil {
+				return filenames, errors.Wrapf(err, "create dir `%s`", fpath)
+			}
+
+			dirs = append(dirs, dirTime{fpath, hdr.ModTime})
+			Logger.Debug("create basedir", zap.String("path", fpath))
+		case tar.TypeReg, tar.TypeRegA:
+			if err = opt.extractTarFile(tr, hdr, fpath); err != nil {
+				return filenames, err
+			}
+		case tar.TypeSymlink:
+			switch opt.symlink {
+			case UnzipSymlinkSkip:
+				Logger.Debug("skip symlink", zap.String("name", hdr.Name))
+				continue
+			case UnzipSymlinkError:
+				return filenames, errors.Errorf("symlink is not allowed: %s", hdr.Name)
+			}
+
+			target := hdr.Linkname
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(fpath), target)
+			}
+			if err = checkArchivePath(opt.fs, dest, target, true); err != nil {
+				return filenames, errors.Wrapf(err, "illegal link `%s` -> `%s`", hdr.Name, hdr.Linkname)
+			}
+			if err = opt.fs.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+				return filenames, errors.Wrapf(err, "mkdir: %s", fpath)
+			}
+			if err = opt.fs.Symlink(hdr.Linkname, fpath); err != nil {
+				return filenames, errors.Wrapf(err, "create symlink `%s`", fpath)
+			}
+		case tar.TypeLink:
+			target := filepath.Join(dest, hdr.Linkname)
+			if err = checkArchivePath(opt.fs, dest, target, true); err != nil {
+				return filenames, errors.Wrapf(err, "illegal link `%s` -> `%s`", hdr.Name, hdr.Linkname)
+			}
+			if err = opt.fs.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+				return filenames, errors.Wrapf(err, "mkdir: %s", fpath)
+			}
+			if err = opt.fs.Link(target, fpath); err != nil {
+				return filenames, errors.Wrapf(err, "create hard link `%s`", fpath)
+			}
+		default:
+			Logger.Debug("skip unsupported tar entry",
+				zap.String("name", hdr.Name),
+				zap.ByteString("type", []byte{hdr.Typeflag}))
+			continue
+		}
+
+		filenames = append(filenames, fpath)
+	}
+
+	// restore mtime of dirs after all files are written
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = opt.fs.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime); err != nil {
+			return filenames, errors.Wrapf(err, "set mtime of `%s`", dirs[i].path)
+		}
+	}
+
+	return filenames, nil
+}
+
+func (opt *tarOption) extractTarFile(tr *tar.Reader, hdr *tar.Header, fpath string) (err error) {
+	if err = opt.fs.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+		return errors.Wrapf(err, "mkdir: %s", fpath)
+	}
+
+	// do not write through existed symlink
+	if finfo, err := opt.fs.Lstat(fpath); err == nil && finfo.Mode()&os.ModeSymlink != 0 {
+		if err = opt.fs.Remove(fpath); err != nil {
+			return errors.Wrapf(err, "remove existed symlink: %s", fpath)
+		}
+	}
+
+	fp, err := opt.fs.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|oNoFollow, os.FileMode(hdr.Mode).Perm())
+	if err != nil {
+		return errors.Wrapf(err, "open file to write: %s", fpath)
+	}
+	defer CloseQuietly(fp)
+
+	if _, err = io.Copy(fp, tr); err != nil {
+		return errors.Wrapf(err, "write file `%s`", fpath)
+	}
+	if err = fp.Close(); err != nil {
+		return errors.Wrapf(err, "close file `%s`", fpath)
+	}
+	// mode may be masked by umask
+	if err = opt.fs.Chmod(fpath, os.FileMode(hdr.Mode).Perm()); err != nil {
+		return errors.Wrapf(err, "chmod `%s`", fpath)
+	}
+	if err = opt.fs.Chtimes(fpath, hdr.ModTime, hdr.ModTime); err != nil {
+		return errors.Wrapf(err, "set mtime of `%s`", fpath)
+	}
+
+	Logger.Debug("create file", zap.String("path", fpath))
+	return nil
+}
+
+// isPathInDir check whether path is dir or inside dir,
+// to prevent zip-slip.
+//
+// https://snyk.io/research/zip-slip-vulnerability#go
+func isPathInDir(path, dir string) bool {
+	path = filepath.Clean(path)
+	dir = filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// checkArchivePath make sure writing to fpath will not escape dir.
+//
+// fpath should be inside dir, and none of the existed elements
+// between dir and fpath should be symlink, since the symlink may be
+// created by previous entries of archive and point to anywhere.
+// the last element of fpath is checked only if checkSelf.
+func checkArchivePath(fsys FS, dir, fpath string, checkSelf bool) error {
+	if !isPathInDir(fpath, dir) {
+		return errors.Errorf("`%s` is outside of `%s`", fpath, dir)
+	}
+
+	rel, err := filepath.Rel(dir, fpath)
+	if err != nil {
+		return errors.Wrapf(err, "get relative path of `%s`", fpath)
+	}
+	if rel == "." {
+		return nil
+	}
+
+	elems := strings.Split(rel, string(os.PathSeparator))
+	if !checkSelf {
+		elems = elems[:len(elems)-1]
+	}
+
+	cur := dir
+	for _, elem := range elems {
+		cur = filepath.Join(cur, elem)
+		finfo, err := fsys.Lstat(cur)
+		if os.IsNotExist(err) {
+			// the rest will be created as dirs
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "get stat of `%s`", cur)
+		}
+		if finfo.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("`%s` is a symlink", cur)
+		}
+	}
+
+	return nil
+}
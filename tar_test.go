@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarFilesAndUntar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tar-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "child"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("yoo"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "child", "b.sh"), []byte("#!/bin/sh"), 0755))
+	require.NoError(t, os.Symlink("child/b.sh", filepath.Join(src, "link")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "child", "c.tmp"), []byte("tmp"), 0600))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime))
+
+	for _, format := range []CompressFormat{CompressFormatUnknown, CompressFormatGzip, CompressFormatZstd} {
+		t.Run("tar "+string(format), func(t *testing.T) {
+			archive := filepath.Join(dir, "src.tar."+string(format))
+			err := TarFiles(archive, []string{src},
+				WithTarCompress(format),
+				WithTarExclude("*.tmp"),
+			)
+			require.NoError(t, err)
+
+			dst := filepath.Join(dir, "dst-"+string(format))
+			files, err := Untar(archive, dst, WithTarSymlinkPolicy(UnzipSymlinkInDir))
+			require.NoError(t, err)
+			require.Len(t, files, 5)
+
+			cnt, err := ioutil.ReadFile(filepath.Join(dst, "src", "a.txt"))
+			require.NoError(t, err)
+			require.Equal(t, "yoo", string(cnt))
+
+			finfo, err := os.Stat(filepath.Join(dst, "src", "a.txt"))
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0600), finfo.Mode().Perm())
+			require.True(t, mtime.Equal(finfo.ModTime()))
+
+			finfo, err = os.Stat(filepath.Join(dst, "src", "child", "b.sh"))
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0755), finfo.Mode().Perm())
+
+			link, err := os.Readlink(filepath.Join(dst, "src", "link"))
+			require.NoError(t, err)
+			require.Equal(t, "child/b.sh", link)
+		})
+	}
+}
+
+func TestExtractTarIllegalPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tar-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, hdr := range map[string]*tar.Header{
+		"zip slip":         {Name: "../evil.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		"absolute symlink": {Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		"relative symlink": {Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"},
+		"hard link":        {Name: "link", Typeflag: tar.TypeLink, Linkname: "../evil.txt"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			require.NoError(t, tw.WriteHeader(hdr))
+			require.NoError(t, tw.Close())
+
+			_, err := ExtractTar(buf, filepath.Join(dir, "dst"), WithTarSymlinkPolicy(UnzipSymlinkInDir))
+			require.Error(t, err)
+		})
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "evil.txt"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestExtractTarSymlinkChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tar-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// `a -> .` and `a/x -> ..` are both inside dest lexically,
+	// but `a/x/evil` will be written into parent of dest
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: "a/x", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "a/x/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err = tw.Write([]byte("evil"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	archive := buf.Bytes()
+
+	dest := filepath.Join(dir, "dst")
+	_, err = ExtractTar(bytes.NewReader(archive), dest, WithTarSymlinkPolicy(UnzipSymlinkInDir))
+	require.Error(t, err)
+	_, err = os.Lstat(filepath.Join(dir, "evil"))
+	require.True(t, os.IsNotExist(err))
+
+	// symlinks are skipped by default
+	dest = filepath.Join(dir, "dst-skip")
+	files, err := ExtractTar(bytes.NewReader(archive), dest)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dest, "a", "x", "evil")}, files)
+	_, err = os.Lstat(filepath.Join(dir, "evil"))
+	require.True(t, os.IsNotExist(err))
+
+	_, err = ExtractTar(bytes.NewReader(archive), filepath.Join(dir, "dst-err"), WithTarSymlinkPolicy(UnzipSymlinkError))
+	require.Error(t, err)
+
+	// do not write through symlink already in dest
+	dest = filepath.Join(dir, "dst-existed")
+	require.NoError(t, os.MkdirAll(dest, 0755))
+	require.NoError(t, os.Symlink("..", filepath.Join(dest, "a")))
+	_, err = ExtractTar(bytes.NewReader(archive), dest)
+	require.Error(t, err)
+	_, err = os.Lstat(filepath.Join(dir, "x"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -4,11 +4,8 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -272,41 +269,14 @@ func GetStructFieldByName(st interface{}, fieldName string) interface{} {
 
 // ValidateFileHash validate file content with hashed string
 //
+// support all algorithms registered by `RegisterHasher`,
+// use `ValidateFileHashes` to validate multiple hashes in one pass.
+//
 // Args:
 //   * filepath: file path to check
 //   * hashed: hashed string, like `sha256: xxxx`
 func ValidateFileHash(filepath string, hashed string) error {
-	hs := strings.Split(hashed, ":")
-	if len(hs) != 2 {
-		return errors.Errorf("unknown hashed format, expect is `sha256:xxxx`, but got `%s`", hashed)
-	}
-
-	var hasher hash.Hash
-	switch hs[0] {
-	case "sha256":
-		hasher = sha256.New()
-	case "md5":
-		hasher = md5.New()
-	default:
-		return errors.Errorf("unknown hasher `%s`", hs[0])
-	}
-
-	fp, err := os.Open(filepath)
-	if err != nil {
-		return errors.Wrapf(err, "open file `%s`", filepath)
-	}
-	defer CloseQuietly(fp)
-
-	if _, err = io.Copy(hasher, fp); err != nil {
-		return errors.Wrap(err, "read file content")
-	}
-
-	actualHash := hex.EncodeToString(hasher.Sum(nil))
-	if hs[1] != actualHash {
-		return errors.Errorf("hash `%s` not match expect `%s`", actualHash, hs[1])
-	}
-
-	return nil
+	return ValidateFileHashes(filepath, hashed)
 }
 
 // GetFuncName return the name of func
@@ -749,7 +719,7 @@ func (c *ExpCache) runClean(ctx context.Context) {
 		}
 
 		c.data.Range(func(k, v interface{}) bool {
-			if v.(*expCacheItem).exp.After(Clock.GetUTCNow()) {
+			if v.(*expCacheItem).exp.Before(Clock.GetUTCNow()) {
 				// expired
 				//
 				// if new expCacheItem stored just before delete,
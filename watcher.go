@@ -0,0 +1,559 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWatchDebounce       = 100 * time.Millisecond
+	defaultWatchMaxDelayFactor = 10
+	defaultWatchPollInterval   = time.Second
+	defaultWatchChanSize       = 1024
+)
+
+// FileEventOp operations of file event,
+// could be combined by `|` after coalescing
+type FileEventOp uint32
+
+const (
+	// FileEventCreate file or dir created
+	FileEventCreate FileEventOp = 1 << iota
+	// FileEventWrite file content changed
+	FileEventWrite
+	// FileEventRemove file or dir removed
+	FileEventRemove
+	// FileEventRename file or dir renamed to other path,
+	// only emitted by inotify, polling will emit FileEventRemove
+	FileEventRename
+	// FileEventChmod file mode changed
+	FileEventChmod
+)
+
+var fileEventOpNames = []struct {
+	op   FileEventOp
+	name string
+}{
+	{FileEventCreate, "CREATE"},
+	{FileEventWrite, "WRITE"},
+	{FileEventRemove, "REMOVE"},
+	{FileEventRename, "RENAME"},
+	{FileEventChmod, "CHMOD"},
+}
+
+// Has check whether op contains other
+func (op FileEventOp) Has(other FileEventOp) bool {
+	return op&other == other
+}
+
+// String like `CREATE|WRITE`
+func (op FileEventOp) String() string {
+	var names []string
+	for _, v := range fileEventOpNames {
+		if op.Has(v.op) {
+			names = append(names, v.name)
+		}
+	}
+
+	return strings.Join(names, "|")
+}
+
+// FileEvent event of file changed
+type FileEvent struct {
+	// Path path of changed file or dir
+	Path string
+	// Op operations happened during debounce interval
+	Op FileEventOp
+}
+
+type watchOption struct {
+	recursive    bool
+	debounce     time.Duration
+	maxDelay     time.Duration
+	pollInterval time.Duration
+	forcePolling bool
+}
+
+// WatchOptFunc options for WatchFiles
+type WatchOptFunc func(*watchOption) error
+
+// WithWatchRecursive watch all sub dirs of dirs,
+// include dirs created after watching.
+func WithWatchRecursive() WatchOptFunc {
+	return func(opt *watchOption) error {
+		opt.recursive = true
+		return nil
+	}
+}
+
+// WithWatchDebounce emit events after no new event in d,
+// events of the same path are coalesced into one.
+//
+// default to 100ms, 0 means emit every event immediately without coalescing.
+func WithWatchDebounce(d time.Duration) WatchOptFunc {
+	return func(opt *watchOption) error {
+		if d < 0 {
+			return errors.Errorf("debounce must not less than 0, got %s", d)
+		}
+
+		opt.debounce = d
+		return nil
+	}
+}
+
+// WithWatchMaxDelay emit pending events at most d after the first of them,
+// even if new events keep arriving within debounce.
+//
+// default to 10 times of debounce, 0 means use default.
+func WithWatchMaxDelay(d time.Duration) WatchOptFunc {
+	return func(opt *watchOption) error {
+		if d < 0 {
+			return errors.Errorf("max delay must not less than 0, got %s", d)
+		}
+
+		opt.maxDelay = d
+		return nil
+	}
+}
+
+// WithWatchPollInterval set interval of polling,
+// polling is used when inotify is unavailable, default to 1s.
+func WithWatchPollInterval(interval time.Duration) WatchOptFunc {
+	return func(opt *watchOption) error {
+		if interval <= 0 {
+			return errors.Errorf("poll interval must greater than 0, got %s", interval)
+		}
+
+		opt.pollInterval = interval
+		return nil
+	}
+}
+
+// WithWatchForcePolling always use polling,
+// useful for network filesystems that do not support inotify.
+func WithWatchForcePolling() WatchOptFunc {
+	return func(opt *watchOption) error {
+		opt.forcePolling = true
+		return nil
+	}
+}
+
+type fileWatcher struct {
+	*watchOption
+	// files watched files, events of other files in their dirs are ignored
+	files map[string]bool
+	// dirs watched dirs
+	dirs []string
+	raw  chan FileEvent
+}
+
+// WatchFiles watch files or dirs changed,
+// events will be sent to returned chan, chan will be closed when ctx done.
+//
+// use inotify (by fsnotify) if available, otherwise fallback to polling.
+// file is watched by its parent dir, so it can be replaced by rename,
+// like kubernetes configmap or certificates renewed by certbot.
+//
+// paths must exist when start watching.
+func WatchFiles(ctx context.Context, paths []string, opts ...WatchOptFunc) (<-chan FileEvent, error) {
+	w := &fileWatcher{
+		watchOption: &watchOption{
+			debounce:     defaultWatchDebounce,
+			pollInterval: defaultWatchPollInterval,
+		},
+		files: map[string]bool{},
+		raw:   make(chan FileEvent, defaultWatchChanSize),
+	}
+	for _, optf := range opts {
+		if err := optf(w.watchOption); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	if w.maxDelay == 0 {
+		w.maxDelay = defaultWatchMaxDelayFactor * w.debounce
+	}
+	if w.maxDelay < w.debounce {
+		return nil, errors.Errorf("max delay %s must not less than debounce %s", w.maxDelay, w.debounce)
+	}
+
+	if len(paths) == 0 {
+		return nil, errors.Errorf("paths cannot be empty")
+	}
+	for _, fpath := range paths {
+		fpath, err := filepath.Abs(fpath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get abs path of `%s`", fpath)
+		}
+
+		finfo, err := os.Stat(fpath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get stat of `%s`", fpath)
+		}
+
+		if finfo.IsDir() {
+			w.dirs = append(w.dirs, fpath)
+		} else {
+			w.files[fpath] = true
+		}
+	}
+
+	started := false
+	if !w.forcePolling {
+		if err := w.startInotify(ctx); err != nil {
+			Logger.Warn("inotify unavailable, fallback to polling", zap.Error(err))
+		} else {
+			started = true
+		}
+	}
+	if !started {
+		// take first snapshot before return, so no change will be missed
+		go w.runPolling(ctx, w.snapshot())
+	}
+
+	events := make(chan FileEvent, defaultWatchChanSize)
+	go w.runDebounce(ctx, events)
+	return events, nil
+}
+
+// isWatched check whether events of fpath should be emitted
+func (w *fileWatcher) isWatched(fpath string) bool {
+	if w.files[fpath] {
+		return true
+	}
+
+	for _, dir := range w.dirs {
+		if fpath == dir ||
+			filepath.Dir(fpath) == dir ||
+			(w.recursive && isPathInDir(fpath, dir)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// emit send event to debouncer, return false if ctx done
+func (w *fileWatcher) emit(ctx context.Context, evt FileEvent) bool {
+	if !w.isWatched(evt.Path) {
+		return true
+	}
+
+	select {
+	case w.raw <- evt:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// watchedDirs list dirs that should be added to inotify
+func (w *fileWatcher) watchedDirs() (dirs []string, err error) {
+	seen := map[string]bool{}
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for fpath := range w.files {
+		add(filepath.Dir(fpath))
+	}
+	for _, dir := range w.dirs {
+		if !w.recursive {
+			add(dir)
+			continue
+		}
+
+		if err = filepath.Walk(dir, func(fpath string, finfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if finfo.IsDir() {
+				add(fpath)
+			}
+
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "walk dir `%s`", dir)
+		}
+	}
+
+	return dirs, nil
+}
+
+func (w *fileWatcher) startInotify(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "new fsnotify watcher")
+	}
+
+	dirs, err := w.watchedDirs()
+	if err != nil {
+		CloseQuietly(watcher)
+		return err
+	}
+	for _, dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			CloseQuietly(watcher)
+			return errors.Wrapf(err, "watch dir `%s`", dir)
+		}
+	}
+
+	go func() {
+		defer CloseQuietly(watcher)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				Logger.Error("watch files", zap.Error(err))
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if !w.handleInotifyEvent(ctx, watcher, e) {
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (w *fileWatcher) handleInotifyEvent(ctx context.Context, watcher *fsnotify.Watcher, e fsnotify.Event) bool {
+	fpath := filepath.Clean(e.Name)
+	var op FileEventOp
+	for _, v := range []struct {
+		from fsnotify.Op
+		to   FileEventOp
+	}{
+		{fsnotify.Create, FileEventCreate},
+		{fsnotify.Write, FileEventWrite},
+		{fsnotify.Remove, FileEventRemove},
+		{fsnotify.Rename, FileEventRename},
+		{fsnotify.Chmod, FileEventChmod},
+	} {
+		if e.Op&v.from != 0 {
+			op |= v.to
+		}
+	}
+	if !w.emit(ctx, FileEvent{Path: fpath, Op: op}) {
+		return false
+	}
+
+	if !w.recursive || !op.Has(FileEventCreate) || !w.isWatched(fpath) {
+		return true
+	}
+	if finfo, err := os.Stat(fpath); err != nil || !finfo.IsDir() {
+		return true
+	}
+
+	// watch new dir, entries created before watching should be emitted
+	ok := true
+	if err := filepath.Walk(fpath, func(child string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if finfo.IsDir() {
+			if err = watcher.Add(child); err != nil {
+				return errors.Wrapf(err, "watch dir `%s`", child)
+			}
+		}
+		if child != fpath {
+			if ok = w.emit(ctx, FileEvent{Path: child, Op: FileEventCreate}); !ok {
+				return ctx.Err()
+			}
+		}
+
+		return nil
+	}); err != nil && ok {
+		Logger.Error("watch new dir", zap.String("dir", fpath), zap.Error(err))
+	}
+
+	return ok
+}
+
+type watchPollState struct {
+	size  int64
+	mtime time.Time
+	mode  os.FileMode
+}
+
+// snapshot get states of all watched files and dirs
+func (w *fileWatcher) snapshot() map[string]watchPollState {
+	states := map[string]watchPollState{}
+	add := func(fpath string, finfo os.FileInfo) {
+		states[fpath] = watchPollState{
+			size:  finfo.Size(),
+			mtime: finfo.ModTime(),
+			mode:  finfo.Mode(),
+		}
+	}
+
+	for fpath := range w.files {
+		if finfo, err := os.Stat(fpath); err == nil {
+			add(fpath, finfo)
+		}
+	}
+	for _, dir := range w.dirs {
+		if !w.recursive {
+			fs, err := ioutil.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+
+			for _, finfo := range fs {
+				add(filepath.Join(dir, finfo.Name()), finfo)
+			}
+
+			continue
+		}
+
+		_ = filepath.Walk(dir, func(fpath string, finfo os.FileInfo, err error) error {
+			// file may be removed during walking
+			if err != nil {
+				return nil
+			}
+			if fpath != dir {
+				add(fpath, finfo)
+			}
+
+			return nil
+		})
+	}
+
+	return states
+}
+
+func (w *fileWatcher) runPolling(ctx context.Context, prev map[string]watchPollState) {
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cur := w.snapshot()
+		var events []FileEvent
+		for fpath, st := range cur {
+			old, ok := prev[fpath]
+			switch {
+			case !ok:
+				events = append(events, FileEvent{Path: fpath, Op: FileEventCreate})
+			case old.size != st.size || !old.mtime.Equal(st.mtime):
+				if !st.mode.IsDir() {
+					events = append(events, FileEvent{Path: fpath, Op: FileEventWrite})
+				}
+			case old.mode != st.mode:
+				events = append(events, FileEvent{Path: fpath, Op: FileEventChmod})
+			}
+		}
+		for fpath := range prev {
+			if _, ok := cur[fpath]; !ok {
+				events = append(events, FileEvent{Path: fpath, Op: FileEventRemove})
+			}
+		}
+
+		sort.Slice(events, func(i, j int) bool {
+			return events[i].Path < events[j].Path
+		})
+		for _, evt := range events {
+			if !w.emit(ctx, evt) {
+				return
+			}
+		}
+
+		prev = cur
+	}
+}
+
+// runDebounce coalesce raw events by path, send to events after debounce,
+// or after maxDelay since the first pending event
+func (w *fileWatcher) runDebounce(ctx context.Context, events chan<- FileEvent) {
+	defer close(events)
+
+	send := func(evt FileEvent) bool {
+		select {
+		case events <- evt:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	pending := map[string]FileEventOp{}
+	var deadline time.Time
+	timer := time.NewTimer(w.debounce)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case evt := <-w.raw:
+			if w.debounce == 0 {
+				if !send(evt) {
+					return
+				}
+
+				continue
+			}
+
+			now := time.Now()
+			if len(pending) == 0 {
+				deadline = now.Add(w.maxDelay)
+			}
+			pending[evt.Path] |= evt.Op
+
+			wait := w.debounce
+			if remain := deadline.Sub(now); remain < wait {
+				wait = remain
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			paths := make([]string, 0, len(pending))
+			for fpath := range pending {
+				paths = append(paths, fpath)
+			}
+			sort.Strings(paths)
+
+			for _, fpath := range paths {
+				if !send(FileEvent{Path: fpath, Op: pending[fpath]}) {
+					return
+				}
+			}
+
+			pending = map[string]FileEventOp{}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitFileEvent wait event of fpath, ignore events of other paths
+func waitFileEvent(t *testing.T, events <-chan FileEvent, fpath string) FileEvent {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case evt, ok := <-events:
+			require.True(t, ok, "events closed")
+			if evt.Path == fpath {
+				return evt
+			}
+		case <-timeout:
+			t.Fatalf("wait event of `%s` timeout", fpath)
+		}
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	for name, opts := range map[string][]WatchOptFunc{
+		"inotify": {WithWatchRecursive()},
+		"polling": {WithWatchRecursive(), WithWatchForcePolling(), WithWatchPollInterval(50 * time.Millisecond)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestWatchFiles")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			dir, err = filepath.EvalSymlinks(dir)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			events, err := WatchFiles(ctx, []string{dir}, opts...)
+			require.NoError(t, err)
+
+			// coalesce multiple writes
+			fpath := filepath.Join(dir, "a.txt")
+			require.NoError(t, ioutil.WriteFile(fpath, []byte("1"), 0600))
+			require.NoError(t, ioutil.WriteFile(fpath, []byte("22"), 0600))
+			evt := waitFileEvent(t, events, fpath)
+			require.True(t, evt.Op.Has(FileEventCreate), evt.Op.String())
+
+			// recursive
+			child := filepath.Join(dir, "d1", "d2", "b.txt")
+			require.NoError(t, os.MkdirAll(filepath.Dir(child), os.ModePerm))
+			require.NoError(t, ioutil.WriteFile(child, []byte("b"), 0600))
+			evt = waitFileEvent(t, events, child)
+			require.True(t, evt.Op.Has(FileEventCreate), evt.Op.String())
+
+			require.NoError(t, os.Remove(fpath))
+			evt = waitFileEvent(t, events, fpath)
+			require.True(t, evt.Op.Has(FileEventRemove), evt.Op.String())
+
+			cancel()
+			for range events {
+			}
+		})
+	}
+}
+
+func TestWatchFilesReplacedByRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWatchFilesReplacedByRename")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "cert.pem")
+	require.NoError(t, ioutil.WriteFile(fpath, []byte("v1"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other"), []byte("v1"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := WatchFiles(ctx, []string{fpath}, WithWatchDebounce(0))
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other"), []byte("v2"), 0600))
+	require.NoError(t, WriteFileAtomic(fpath, []byte("v2"), 0600))
+	evt := <-events
+	require.Equal(t, fpath, evt.Path)
+	require.True(t, evt.Op.Has(FileEventCreate), evt.Op.String())
+
+	require.Equal(t, "CREATE|WRITE", (FileEventCreate | FileEventWrite).String())
+}
+
+func TestWatchFilesMaxDelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWatchFilesMaxDelay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "log")
+	require.NoError(t, ioutil.WriteFile(fpath, []byte("v0"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = WatchFiles(ctx, []string{fpath}, WithWatchDebounce(100*time.Millisecond), WithWatchMaxDelay(50*time.Millisecond))
+	require.Error(t, err)
+	_, err = WatchFiles(ctx, []string{fpath}, WithWatchMaxDelay(-time.Second))
+	require.Error(t, err)
+
+	events, err := WatchFiles(ctx, []string{fpath},
+		WithWatchDebounce(100*time.Millisecond),
+		WithWatchMaxDelay(200*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	// keep writing faster than debounce, events should not be starved
+	stop := time.After(2 * time.Second)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case evt := <-events:
+			require.Equal(t, fpath, evt.Path)
+			require.True(t, evt.Op.Has(FileEventWrite), evt.Op.String())
+			return
+		case <-stop:
+			t.Fatal("no event emitted while writing continuously")
+		case <-ticker.C:
+			require.NoError(t, ioutil.WriteFile(fpath, []byte(strconv.Itoa(i)), 0600))
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package utils
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWorkerPoolQueueSize   = 100
+	defaultWorkerPoolIdleTimeout = 10 * time.Second
+)
+
+var (
+	// ErrWorkerPoolClosed pool has been closed, no more task accepted
+	ErrWorkerPoolClosed = errors.New("worker pool closed")
+	// ErrWorkerPoolFull queue of pool is full
+	ErrWorkerPoolFull = errors.New("worker pool queue is full")
+)
+
+// WorkerPoolTask task run by WorkerPool,
+// task is failed if it returns error or panics.
+type WorkerPoolTask func() error
+
+type workerPoolOption struct {
+	minWorkers,
+	maxWorkers,
+	queueSize int
+	idleTimeout time.Duration
+}
+
+// WorkerPoolOptFunc options for WorkerPool
+type WorkerPoolOptFunc func(*workerPoolOption) error
+
+// WithWorkerPoolWorkers run fixed n workers,
+// default to number of CPUs.
+func WithWorkerPoolWorkers(n int) WorkerPoolOptFunc {
+	return func(opt *workerPoolOption) error {
+		if n <= 0 {
+			return errors.Errorf("workers should greater than 0, got %d", n)
+		}
+
+		opt.minWorkers = n
+		opt.maxWorkers = n
+		return nil
+	}
+}
+
+// WithWorkerPoolAutoscale keep at least min workers,
+// start new worker when all workers are busy until max workers.
+func WithWorkerPoolAutoscale(min, max int) WorkerPoolOptFunc {
+	return func(opt *workerPoolOption) error {
+		if min < 0 || max <= 0 || min > max {
+			return errors.Errorf("invalid workers range [%d, %d]", min, max)
+		}
+
+		opt.minWorkers = min
+		opt.maxWorkers = max
+		return nil
+	}
+}
+
+// WithWorkerPoolQueueSize set max number of tasks waiting for workers,
+// default to 100.
+//
+// submit will block or fail when queue is full.
+func WithWorkerPoolQueueSize(size int) WorkerPoolOptFunc {
+	return func(opt *workerPoolOption) error {
+		if size <= 0 {
+			return errors.Errorf("queue size should greater than 0, got %d", size)
+		}
+
+		opt.queueSize = size
+		return nil
+	}
+}
+
+// WithWorkerPoolIdleTimeout autoscaled workers exceed min workers
+// will exit after idle for timeout, default to 10s.
+func WithWorkerPoolIdleTimeout(timeout time.Duration) WorkerPoolOptFunc {
+	return func(opt *workerPoolOption) error {
+		if timeout <= 0 {
+			return errors.Errorf("idle timeout should greater than 0, got %s", timeout)
+		}
+
+		opt.idleTimeout = timeout
+		return nil
+	}
+}
+
+// WorkerPoolStats stats of WorkerPool
+type WorkerPoolStats struct {
+	// Workers number of alive workers
+	Workers int
+	// Queued number of tasks waiting in queue
+	Queued int
+	// Running number of running tasks
+	Running int
+	// Completed number of succeed tasks
+	Completed uint64
+	// Failed number of tasks returned error or panicked
+	Failed uint64
+}
+
+// WorkerPool run tasks by bounded workers
+type WorkerPool struct {
+	*workerPoolOption
+	queue chan WorkerPoolTask
+
+	mu     sync.RWMutex
+	closed bool
+	// closing closed when Close called, to unblock submitters
+	closing chan struct{}
+	// stop closed after all submitters returned, workers exit after queue drained
+	stop       chan struct{}
+	submitting sync.WaitGroup
+	workersWg  sync.WaitGroup
+
+	workers,
+	running int32
+	completed,
+	failed uint64
+}
+
+// NewWorkerPool create and start WorkerPool
+func NewWorkerPool(opts ...WorkerPoolOptFunc) (*WorkerPool, error) {
+	opt := &workerPoolOption{
+		minWorkers:  runtime.NumCPU(),
+		maxWorkers:  runtime.NumCPU(),
+		queueSize:   defaultWorkerPoolQueueSize,
+		idleTimeout: defaultWorkerPoolIdleTimeout,
+	}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	p := &WorkerPool{
+		workerPoolOption: opt,
+		queue:            make(chan WorkerPoolTask, opt.queueSize),
+		closing:          make(chan struct{}),
+		stop:             make(chan struct{}),
+	}
+	for i := 0; i < opt.minWorkers; i++ {
+		atomic.AddInt32(&p.workers, 1)
+		p.startWorker()
+	}
+
+	return p, nil
+}
+
+// Submit block until task is queued
+func (p *WorkerPool) Submit(task WorkerPoolTask) error {
+	return p.SubmitCtx(context.Background(), task)
+}
+
+// SubmitCtx block until task is queued or ctx done
+func (p *WorkerPool) SubmitCtx(ctx context.Context, task WorkerPoolTask) error {
+	return p.submit(ctx, task, true)
+}
+
+// TrySubmit return ErrWorkerPoolFull if queue is full
+func (p *WorkerPool) TrySubmit(task WorkerPoolTask) error {
+	return p.submit(context.Background(), task, false)
+}
+
+func (p *WorkerPool) submit(ctx context.Context, task WorkerPoolTask, block bool) error {
+	if task == nil {
+		return errors.Errorf("task cannot be nil")
+	}
+
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrWorkerPoolClosed
+	}
+	p.submitting.Add(1)
+	p.mu.RUnlock()
+	defer p.submitting.Done()
+
+	if !block {
+		select {
+		case p.queue <- task:
+			p.scaleUp()
+			return nil
+		default:
+			return ErrWorkerPoolFull
+		}
+	}
+
+	select {
+	case p.queue <- task:
+		p.scaleUp()
+		return nil
+	case <-p.closing:
+		return ErrWorkerPoolClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// scaleUp start new worker if there are more tasks than workers
+func (p *WorkerPool) scaleUp() {
+	for {
+		n := atomic.LoadInt32(&p.workers)
+		if int(n) >= p.maxWorkers || len(p.queue) == 0 ||
+			int(atomic.LoadInt32(&p.running))+len(p.queue) <= int(n) {
+			return
+		}
+
+		if atomic.CompareAndSwapInt32(&p.workers, n, n+1) {
+			p.startWorker()
+			return
+		}
+	}
+}
+
+// startWorker p.workers should be increased before
+func (p *WorkerPool) startWorker() {
+	p.workersWg.Add(1)
+	go func() {
+		defer p.workersWg.Done()
+		p.runWorker()
+	}()
+}
+
+func (p *WorkerPool) runWorker() {
+	idle := time.NewTimer(p.idleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case task := <-p.queue:
+			p.runTask(task)
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(p.idleTimeout)
+		case <-idle.C:
+			idle.Reset(p.idleTimeout)
+			n := atomic.LoadInt32(&p.workers)
+			if int(n) > p.minWorkers && atomic.CompareAndSwapInt32(&p.workers, n, n-1) {
+				// task may be queued during exiting
+				p.scaleUp()
+				return
+			}
+		case <-p.stop:
+			// drain queue
+			for {
+				select {
+				case task := <-p.queue:
+					p.runTask(task)
+				default:
+					atomic.AddInt32(&p.workers, -1)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *WorkerPool) runTask(task WorkerPoolTask) {
+	atomic.AddInt32(&p.running, 1)
+	defer atomic.AddInt32(&p.running, -1)
+
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			Logger.Error("worker pool task panic",
+				zap.Any("panic", r),
+				zap.Stack("stack"))
+			atomic.AddUint64(&p.failed, 1)
+			return
+		}
+
+		if err != nil {
+			Logger.Warn("worker pool task failed", zap.Error(err))
+			atomic.AddUint64(&p.failed, 1)
+			return
+		}
+
+		atomic.AddUint64(&p.completed, 1)
+	}()
+
+	err = task()
+}
+
+// Close stop accepting tasks, wait until all queued and running tasks finished.
+//
+// return ctx's error if ctx done before all tasks finished,
+// remaining tasks will still be run in background.
+func (p *WorkerPool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.closing)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.submitting.Wait()
+		p.mu.Lock()
+		select {
+		case <-p.stop:
+		default:
+			close(p.stop)
+		}
+		p.mu.Unlock()
+
+		p.workersWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "wait tasks finished")
+	}
+}
+
+// Stats current stats of pool
+func (p *WorkerPool) Stats() WorkerPoolStats {
+	return WorkerPoolStats{
+		Workers:   int(atomic.LoadInt32(&p.workers)),
+		Queued:    len(p.queue),
+		Running:   int(atomic.LoadInt32(&p.running)),
+		Completed: atomic.LoadUint64(&p.completed),
+		Failed:    atomic.LoadUint64(&p.failed),
+	}
+}
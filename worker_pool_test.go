@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkerPool(t *testing.T) {
+	t.Run("fixed", func(t *testing.T) {
+		p, err := NewWorkerPool(WithWorkerPoolWorkers(2), WithWorkerPoolQueueSize(1))
+		require.NoError(t, err)
+
+		block := make(chan struct{})
+		blocked := func() error {
+			<-block
+			return nil
+		}
+		require.NoError(t, p.Submit(blocked))
+		require.NoError(t, p.Submit(blocked))
+		require.Eventually(t, func() bool {
+			return p.Stats().Running == 2
+		}, time.Second, time.Millisecond)
+
+		require.NoError(t, p.TrySubmit(blocked))
+		require.Equal(t, ErrWorkerPoolFull, p.TrySubmit(blocked))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		require.Equal(t, context.DeadlineExceeded, p.SubmitCtx(ctx, blocked))
+
+		stats := p.Stats()
+		require.Equal(t, 2, stats.Workers)
+		require.Equal(t, 1, stats.Queued)
+
+		close(block)
+		require.NoError(t, p.Submit(func() error { panic("boom") }))
+		require.NoError(t, p.Submit(func() error { return errors.New("failed") }))
+		require.NoError(t, p.Close(context.Background()))
+
+		stats = p.Stats()
+		require.Equal(t, uint64(3), stats.Completed)
+		require.Equal(t, uint64(2), stats.Failed)
+		require.Equal(t, 0, stats.Workers)
+		require.Equal(t, ErrWorkerPoolClosed, p.Submit(blocked))
+	})
+
+	t.Run("autoscale", func(t *testing.T) {
+		p, err := NewWorkerPool(
+			WithWorkerPoolAutoscale(0, 4),
+			WithWorkerPoolIdleTimeout(20*time.Millisecond),
+		)
+		require.NoError(t, err)
+		require.Equal(t, 0, p.Stats().Workers)
+
+		block := make(chan struct{})
+		for i := 0; i < 6; i++ {
+			require.NoError(t, p.Submit(func() error {
+				<-block
+				return nil
+			}))
+		}
+		require.Eventually(t, func() bool {
+			return p.Stats().Running == 4
+		}, time.Second, time.Millisecond)
+		require.Equal(t, 4, p.Stats().Workers)
+		require.Equal(t, 2, p.Stats().Queued)
+
+		close(block)
+		require.Eventually(t, func() bool {
+			return p.Stats().Workers == 0
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, uint64(6), p.Stats().Completed)
+		require.NoError(t, p.Close(context.Background()))
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		p, err := NewWorkerPool(WithWorkerPoolWorkers(2))
+		require.NoError(t, err)
+
+		var cnt int32
+		for i := 0; i < 20; i++ {
+			require.NoError(t, p.Submit(func() error {
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&cnt, 1)
+				return nil
+			}))
+		}
+
+		block := make(chan struct{})
+		require.NoError(t, p.Submit(func() error {
+			<-block
+			return nil
+		}))
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		require.Error(t, p.Close(ctx))
+		require.Equal(t, int32(20), atomic.LoadInt32(&cnt))
+
+		close(block)
+		require.NoError(t, p.Close(context.Background()))
+	})
+}